@@ -0,0 +1,137 @@
+/*
+	Persistent append handles for the live log and its index file.
+
+	Rather than opening, seeking, writing and closing a file for every record,
+	the live log and its index file each keep one handle open for appending,
+	with a write buffer in front of it.  The buffer is written out when it
+	fills, whenever the file is opened for reading, when the file is synced
+	(according to the DURABILITY setting), and when the handle is closed on
+	NewLiveLog, Close, or before the file is replaced, truncated or removed.
+	Positions are tracked from the file size, so appending needs no seek.  A
+	failed write is undone, so that nothing left in the buffer can reach the
+	file later.
+*/
+package logbase
+
+import (
+	"os"
+	"sync"
+)
+
+const (
+	APPEND_BUFFER_SIZE int = 65536 // bytes
+)
+
+// An open handle for appending to a file, with a write buffer.  The handle
+// is closed when gofile is nil.
+type Appender struct {
+	gofile	*os.File
+	bfr		[]byte // bytes not yet written to the file
+	pos		LBUINT // file position of the start of the buffer
+	sync.Mutex
+}
+
+// Append the bytes to the file through its append handle, opening it if
+// need be.  Returns the position of the bytes in the file.
+func (file *File) Append(byts []byte) (pos LBUINT, err error) {
+	app := &file.appender
+	app.Lock()
+	defer app.Unlock()
+	if app.gofile == nil {
+		app.gofile, err = OpenFile(file.abspath, CREATE | WRITE_ONLY)
+		if err != nil {return}
+		app.pos = AsLBUINT(file.size)
+	}
+	pos = app.pos.Plus(len(app.bfr))
+	app.bfr = append(app.bfr, byts...)
+	file.size += len(byts)
+	if len(app.bfr) >= APPEND_BUFFER_SIZE {err = app.flush()}
+	return
+}
+
+// Write out any buffered bytes.
+func (file *File) Flush() error {
+	file.appender.Lock()
+	defer file.appender.Unlock()
+	return file.appender.flush()
+}
+
+// Write out the buffer, with the appender locked.
+func (app *Appender) flush() error {
+	if len(app.bfr) == 0 {return nil}
+	nw, err := app.gofile.WriteAt(app.bfr, int64(app.pos))
+	app.pos = app.pos.Plus(nw)
+	app.bfr = app.bfr[nw:]
+	if len(app.bfr) == 0 {app.bfr = nil}
+	return err
+}
+
+// Flush the file to disk, through the append handle if it is open.  A file
+// that has since been removed has nothing left to flush.
+func (file *File) Sync() error {
+	app := &file.appender
+	app.Lock()
+	defer app.Unlock()
+	if app.gofile != nil {
+		if err := app.flush(); err != nil {return err}
+		return app.gofile.Sync()
+	}
+	gofile, err := OpenFile(file.abspath, WRITE_ONLY)
+	if os.IsNotExist(err) {return nil}
+	if err != nil {return err}
+	defer gofile.Close()
+	return gofile.Sync()
+}
+
+// Undo appends back to the given file size, dropping anything still
+// buffered past it and cutting back anything already written.
+func (file *File) Unappend(size int) (err error) {
+	app := &file.appender
+	app.Lock()
+	defer app.Unlock()
+	written := file.size
+	if app.gofile != nil {
+		written = int(app.pos)
+		if keep := size - written; keep < len(app.bfr) {
+			if keep < 0 {keep = 0}
+			app.bfr = app.bfr[:keep]
+		}
+	}
+	if written > size {
+		if app.gofile != nil {
+			err = app.gofile.Truncate(int64(size))
+			app.pos = AsLBUINT(size)
+		} else {
+			err = os.Truncate(file.abspath, int64(size))
+		}
+	}
+	file.size = size
+	return
+}
+
+// Flush and close the append handle, if open.
+func (file *File) CloseAppender() error {
+	app := &file.appender
+	app.Lock()
+	defer app.Unlock()
+	if app.gofile == nil {return nil}
+	err := app.flush()
+	if err2 := app.gofile.Close(); err == nil {err = err2}
+	app.gofile = nil
+	app.bfr = nil
+	return err
+}
+
+// Flush and close the append handles of the logfile and its index file.
+func (lfile *Logfile) CloseAppenders() error {
+	err := lfile.indexfile.CloseAppender()
+	if err2 := lfile.CloseAppender(); err == nil {err = err2}
+	return err
+}
+
+// Write out the buffers of the logfile and its index file.
+func (lfile *Logfile) Flush() error {
+	err := lfile.indexfile.Flush()
+	if err2 := lfile.File.Flush(); err == nil {err = err2}
+	return err
+}
@@ -0,0 +1,217 @@
+/*
+	Online backup of a logbase.
+
+	Backup takes a consistent copy of a logbase while it stays open for
+	writes.  Under the logbase lock, it seals the live log, saves the
+	catalogs and zapmap with a checkpoint at the start of the new, empty live
+	log, copies every file but the sealed logfiles and their index files, and
+	pins the sealed logfiles.  The lock is then released, and the sealed
+	logfiles and index files are copied, or hard linked if BACKUP_HARD_LINKS
+	is on, while writes carry on into the new live log.  Pinning keeps them
+	from being zapped, merged or migrated meanwhile.  Sealed logfiles are
+	never written in place, and index files are always rewritten by way of a
+	tmp twin renamed over the old file, whether by a zap, a check with repair
+	or a forced index refresh, so a hard link is never changed once made.
+
+	Last of all, a manifest listing the path, size and SHA-256 of every file
+	in the backup is written to the backup.manifest file, so a backup
+	without one is incomplete.  The backup directory is itself a logbase
+	which can be opened as it is.
+*/
+package logbase
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	BACKUP_MANIFEST_FILENAME string = "backup.manifest"
+)
+
+// The contents of a backup, as recorded in its manifest.
+type BackupManifest struct {
+	Logbase		string // name of the logbase backed up
+	Created		time.Time
+	Seq			uint64 // last sequence number handed out
+	Livelog		LBUINT // the new live log, empty in the backup
+	Files		[]*BackupFile
+}
+
+// A file in a backup.
+type BackupFile struct {
+	Path		string // relative to the backup directory
+	Size		int64
+	SHA256		string // hex
+}
+
+// Total size of the files in the backup.
+func (man *BackupManifest) Size() (size int64) {
+	for _, bf := range man.Files {size += bf.Size}
+	return
+}
+
+// Back up the logbase into the given directory, which must be empty or not
+// exist, returning its manifest.
+func (lbase *Logbase) Backup(dest string) (man *BackupManifest, err error) {
+	dest, err = filepath.Abs(dest)
+	if err != nil {return}
+	if rel, err2 := filepath.Rel(lbase.abspath, dest); err2 == nil &&
+		!strings.HasPrefix(rel, "..") {
+		return nil, FmtErrBadArgs(
+			"Backup directory %q lies inside logbase directory %q", dest, lbase.abspath)
+	}
+	if entries, _ := ioutil.ReadDir(dest); len(entries) > 0 {
+		return nil, FmtErrBadArgs("Backup directory %q is not empty", dest)
+	}
+	if err = os.MkdirAll(dest, 0777); err != nil {return}
+	lbase.debug.Basic("Backing up logbase %q to %s", lbase.name, dest)
+
+	man, sealed, err := lbase.backupMetadata(dest)
+	if err != nil {return}
+	fnums := make([]LBUINT, 0, len(sealed))
+	for fnum := range sealed {fnums = append(fnums, fnum)}
+	defer lbase.Unpin(fnums)
+
+	// Copy the sealed logfiles while writes carry on
+	sort.Slice(fnums, func(i, j int) bool {return fnums[i] < fnums[j]})
+	for _, fnum := range fnums {
+		for _, relpath := range sealed[fnum] {
+			var bf *BackupFile
+			bf, err = lbase.copyInto(dest, relpath, lbase.config.BACKUP_HARD_LINKS)
+			if err != nil {return}
+			man.Files = append(man.Files, bf)
+		}
+	}
+	if err = man.Save(dest); err != nil {return}
+	lbase.debug.Advise("Backed up logbase %q to %s, %d files of %d bytes",
+		lbase.name, dest, len(man.Files), man.Size())
+	return
+}
+
+// Seal the live log, save the catalogs and zapmap, copy every file but the
+// sealed logfiles and index files, and pin the sealed logfiles, all under
+// the logbase lock.  Returns the relative paths of the sealed logfile and
+// index file for each pinned logfile.
+func (lbase *Logbase) backupMetadata(dest string) (man *BackupManifest, sealed map[LBUINT][]string, err error) {
+	lbase.Lock()
+	defer lbase.Unlock()
+	if err = lbase.CheckLiveLog(); err != nil {return}
+	if lbase.livelog.size > 0 {
+		if err = lbase.NewLiveLog(); err != nil {return}
+	}
+	lbase.mcat.changed = true // move the checkpoint to the new live log
+	if err = lbase.save(); err != nil {return}
+	man = &BackupManifest{
+		Logbase:	lbase.name,
+		Created:	time.Now(),
+		Seq:		lbase.seq,
+		Livelog:	lbase.livelog.fnum,
+	}
+
+	_, fnums, err := lbase.GetLogfilePaths()
+	if err != nil {return}
+	sealed = make(map[LBUINT][]string)
+	skip := make(map[string]bool)
+	for _, fnum := range fnums {
+		if fnum >= lbase.livelog.fnum {continue}
+		relpaths := []string{lbase.MakeLogfileRelPath(fnum)}
+		if ipath := lbase.MakeIndexfileRelPath(fnum); Exists(filepath.Join(lbase.abspath, ipath)) {
+			relpaths = append(relpaths, ipath)
+		}
+		sealed[fnum] = relpaths
+		for _, relpath := range relpaths {skip[relpath] = true}
+	}
+
+	err = filepath.Walk(lbase.abspath, func(fpath string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {return err}
+		relpath, err := filepath.Rel(lbase.abspath, fpath)
+		if err != nil {return err}
+		if skip[relpath] || strings.HasPrefix(info.Name(), TMPFILE_PREFIX) {return nil}
+		bf, err := lbase.copyInto(dest, relpath, false)
+		if err != nil {return err}
+		man.Files = append(man.Files, bf)
+		return nil
+	})
+	if err != nil {return}
+	fnums = fnums[:0]
+	for fnum := range sealed {fnums = append(fnums, fnum)}
+	lbase.Pin(fnums)
+	return
+}
+
+// Copy, or hard link, a file of the logbase into the given directory,
+// returning its entry in a backup manifest.  A hard link falls back to a copy if it fails.
+func (lbase *Logbase) copyInto(dest, relpath string, link bool) (*BackupFile, error) {
+	src := filepath.Join(lbase.abspath, relpath)
+	dst := filepath.Join(dest, relpath)
+	if err := os.MkdirAll(filepath.Dir(dst), 0777); err != nil {return nil, err}
+	if link {
+		if err := os.Link(src, dst); err == nil {
+			return MakeBackupFile(dest, relpath)
+		}
+		lbase.debug.Fine("Could not hard link %s, copying it instead", src)
+	}
+	in, err := os.Open(src)
+	if err != nil {return nil, lbase.debug.Error(err)}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_CREATE | os.O_EXCL | os.O_WRONLY, 0666)
+	if err != nil {return nil, lbase.debug.Error(err)}
+	hash := sha256.New()
+	size, err := io.Copy(io.MultiWriter(out, hash), in)
+	if err == nil {err = out.Sync()}
+	if err2 := out.Close(); err == nil {err = err2}
+	if err != nil {return nil, lbase.debug.Error(err)}
+	return &BackupFile{
+		Path:	filepath.ToSlash(relpath),
+		Size:	size,
+		SHA256:	hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// Return the manifest entry for a file in a backup, reading it through.
+func MakeBackupFile(dir, relpath string) (*BackupFile, error) {
+	in, err := os.Open(filepath.Join(dir, relpath))
+	if err != nil {return nil, err}
+	defer in.Close()
+	hash := sha256.New()
+	size, err := io.Copy(hash, in)
+	if err != nil {return nil, err}
+	return &BackupFile{
+		Path:	filepath.ToSlash(relpath),
+		Size:	size,
+		SHA256:	hex.EncodeToString(hash.Sum(nil)),
+	}, nil
+}
+
+// Write the manifest into the backup directory, by way of a temporary file
+// so that it is never seen half written.
+func (man *BackupManifest) Save(dir string) error {
+	byts, err := json.MarshalIndent(man, "", "\t")
+	if err != nil {return err}
+	tmp := filepath.Join(dir, TMPFILE_PREFIX + BACKUP_MANIFEST_FILENAME)
+	out, err := os.Create(tmp)
+	if err != nil {return err}
+	_, err = out.Write(byts)
+	if err == nil {err = out.Sync()}
+	if err2 := out.Close(); err == nil {err = err2}
+	if err != nil {return err}
+	return os.Rename(tmp, filepath.Join(dir, BACKUP_MANIFEST_FILENAME))
+}
+
+// Read the manifest of the backup in the given directory.
+func LoadBackupManifest(dir string) (*BackupManifest, error) {
+	byts, err := ioutil.ReadFile(filepath.Join(dir, BACKUP_MANIFEST_FILENAME))
+	if err != nil {return nil, err}
+	man := &BackupManifest{}
+	if err = json.Unmarshal(byts, man); err != nil {return nil, err}
+	return man, nil
+}
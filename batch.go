@@ -0,0 +1,157 @@
+/*
+	Atomic multi-key write batches.
+
+	A WriteBatch collects puts and deletes, which are committed together.  The
+	log records are appended to the live log in a single write, between a
+	batch marker and a commit marker, and the log file is synced before the
+	master catalog and zapmap are updated.  Each marker is a log record with
+	an empty key of type LBTYPE_BATCH or LBTYPE_COMMIT, and the number of
+	records in the batch as its value.
+
+	On replay, the records of a batch are only applied once its commit marker
+	is reached, so a batch cut short by a crash is ignored, and recovery of
+	the live log truncates it.  Markers are never in a catalog, so they are
+	not zapped, but they are dropped by a merge.
+*/
+package logbase
+
+import (
+	"bytes"
+	"encoding/binary"
+)
+
+// A set of puts and deletes to be committed atomically.
+type WriteBatch struct {
+	lbase	*Logbase
+	lrecs	[]*LogRecord
+	keys	[]interface{}
+	vals	[][]byte // as put, before any compression
+	vtypes	[]LBTYPE
+	err		error // first bad write added, returned by Commit
+}
+
+// Start a new write batch.
+func (lbase *Logbase) NewWriteBatch() *WriteBatch {
+	return &WriteBatch{lbase: lbase}
+}
+
+// Number of writes in the batch.
+func (batch *WriteBatch) Len() int {return len(batch.lrecs)}
+
+// Add a put of the key-value pair to the batch.  A bad value type fails
+// the whole batch on commit.
+func (batch *WriteBatch) Put(key interface{}, vbyts []byte, vtype LBTYPE) *WriteBatch {
+	if err := CheckPutType(key, vtype); err != nil {
+		if batch.err == nil {batch.err = err}
+		return batch
+	}
+	lrec, err := batch.lbase.MakeValueRecord(key, vbyts, vtype, 0)
+	if err != nil {
+		if batch.err == nil {batch.err = err}
+		return batch
+	}
+	return batch.add(key, vbyts, vtype, lrec)
+}
+
+// Add a delete of the key to the batch.
+func (batch *WriteBatch) Delete(key interface{}) *WriteBatch {
+	return batch.add(key, nil, LBTYPE_NIL, MakeLogRecord(key, nil, LBTYPE_NIL, batch.lbase.debug))
+}
+
+// Add the log record for the write to the batch.
+func (batch *WriteBatch) add(key interface{}, vbyts []byte, vtype LBTYPE, lrec *LogRecord) *WriteBatch {
+	batch.lrecs = append(batch.lrecs, lrec)
+	batch.keys = append(batch.keys, key)
+	batch.vals = append(batch.vals, vbyts)
+	batch.vtypes = append(batch.vtypes, vtype)
+	return batch
+}
+
+// Write the batch to the live log and apply it to the catalogs and zapmap.
+// Either all of the writes take effect, or none do.  The batch is emptied
+// on success.
+func (batch *WriteBatch) Commit() error {
+	lbase := batch.lbase
+	if batch.err != nil {return batch.err}
+	if len(batch.lrecs) == 0 {return nil}
+	lbase.Lock()
+	defer lbase.Unlock()
+	if err := lbase.CheckLiveLog(); err != nil {return err}
+	lbase.debug.Basic("Committing batch of %d writes to logbase %s",
+		len(batch.lrecs), lbase.name)
+
+	// Delete the chunks of any streamed values being replaced
+	lrecs := batch.lrecs
+	seen := make(map[interface{}]bool)
+	for _, key := range batch.keys {
+		if seen[key] {continue}
+		seen[key] = true
+		ids, err := lbase.ChunksOf(key)
+		if err != nil {return err}
+		lrecs = append(lrecs, ChunkTombstones(ids, lbase)...)
+	}
+	irecs, err := lbase.StoreBatch(lrecs)
+	if err != nil {return err}
+
+	// The commit marker is on disk, so apply the writes
+	for i, lrec := range lrecs {
+		if lrec.vtype == LBTYPE_NIL {
+			lbase.ApplyTombstone(irecs[i], lbase.livelog.fnum)
+		} else {
+			lbase.ApplyPut(batch.keys[i], irecs[i], batch.vals[i], batch.vtypes[i])
+		}
+	}
+	batch.lrecs = nil
+	batch.keys = nil
+	batch.vals = nil
+	batch.vtypes = nil
+	return nil
+}
+
+// Append the log records to the live log in a single synced write, between
+// a batch marker and a commit marker, and return their index records, less
+// those of the markers.  The caller must hold the logbase lock and apply
+// the records.
+func (lbase *Logbase) StoreBatch(lrecs []*LogRecord) ([]*IndexRecord, error) {
+	n := LBUINT(len(lrecs))
+	all := []*LogRecord{MakeMarkerRecord(LBTYPE_BATCH, n)}
+	all = append(all, lrecs...)
+	all = append(all, MakeMarkerRecord(LBTYPE_COMMIT, n))
+	irecs, err := lbase.StoreRecords(all, true)
+	if err != nil {return nil, err}
+	return irecs[1:len(irecs) - 1], nil
+}
+
+// Make a batch or commit marker record for a batch of n records.
+func MakeMarkerRecord(ktype LBTYPE, n LBUINT) *LogRecord {
+	bfr := new(bytes.Buffer)
+	binary.Write(bfr, BIGEND, n)
+	lrec := NewLogRecord()
+	lrec.kbyts = []byte{}
+	lrec.ktype = ktype
+	lrec.ksz = LBUINT(LBTYPE_SIZE)
+	lrec.vbyts = bfr.Bytes()
+	lrec.vtype = LBTYPE_UINT64
+	lrec.vsz = LBUINT(bfr.Len() + LBTYPE_SIZE)
+	return lrec
+}
+
+// Is the index record a batch or commit marker?
+func (irec *IndexRecord) IsMarker() bool {
+	return irec.ktype == LBTYPE_BATCH || irec.ktype == LBTYPE_COMMIT
+}
+
+// Return the position in the given index records of the batch marker of a
+// trailing batch with no commit marker, or -1 if there is none.
+func UncommittedBatch(irecs []*IndexRecord) int {
+	start := -1
+	for i, irec := range irecs {
+		switch irec.ktype {
+		case LBTYPE_BATCH:
+			start = i
+		case LBTYPE_COMMIT:
+			start = -1
+		}
+	}
+	return start
+}
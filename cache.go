@@ -1,16 +1,18 @@
 /*
 	Defines and manages object caches.  Not only does an object cache
 	save resources but we can keep a single RWMutex associated with
-	each object.
+	each object.  Caches are safe for concurrent use.
 */
 package logbase
 
 import (
 	"fmt"
+	"sync"
 )
 
 type Cache struct {
 	objects	map[interface{}]interface{}
+	sync.RWMutex
 }
 
 // Init new file register.
@@ -21,21 +23,53 @@ func NewCache() *Cache {
 }
 
 func (cache *Cache) Put(key, obj interface{}) (interface{}, bool) {
-    old, exists := cache.objects[key]
+	cache.Lock()
+	defer cache.Unlock()
+	old, exists := cache.objects[key]
 	cache.objects[key] = obj
 	return old, exists
 }
 
 func (cache *Cache) Get(key interface{}) (interface{}, bool) {
-    obj, exists := cache.objects[key]
+	cache.RLock()
+	defer cache.RUnlock()
+	obj, exists := cache.objects[key]
 	return obj, exists
 }
 
+// Return the cached object for the key, or cache the one made by the given
+// function if there is none, so that only one object is ever cached per key.
+func (cache *Cache) GetOrMake(key interface{}, make func() interface{}) (interface{}, bool) {
+	cache.Lock()
+	defer cache.Unlock()
+	if obj, exists := cache.objects[key]; exists {return obj, true}
+	obj := make()
+	cache.objects[key] = obj
+	return obj, false
+}
+
+func (cache *Cache) Delete(key interface{}) {
+	cache.Lock()
+	defer cache.Unlock()
+	delete(cache.objects, key)
+	return
+}
+
+// Return a snapshot of the cached objects, for ranging over.
+func (cache *Cache) Values() []interface{} {
+	cache.RLock()
+	defer cache.RUnlock()
+	result := make([]interface{}, 0, len(cache.objects))
+	for _, obj := range cache.objects {
+		result = append(result, obj)
+	}
+	return result
+}
+
 func (cache *Cache) StringArray() []string {
 	var result []string
-	for k, _ := range cache.objects {
-		result = append(result, fmt.Sprintf("%v", cache.objects[k]))
+	for _, obj := range cache.Values() {
+		result = append(result, fmt.Sprintf("%v", obj))
 	}
 	return result
 }
-
@@ -38,15 +38,40 @@ type Catalog struct {
 	name		string
 	ismaster	bool // Is this the Master Catalog?
 	index		map[interface{}]CatalogRecord // The in-memory index
+	order		*OrderedKeys // The keys of the index, in order
 	file		*CatalogFile
 	sync.RWMutex
 	changed		bool // Has index changed since last save?
+	shared		bool // Is index shared with a snapshot, to be copied on write?
 	nextid		CATID_TYPE
+	idlock		sync.Mutex // guards nextid, apart from the catalog lock
 	update		bool // Update as logbase is changed?
 	autosave	bool // Automatically save to file?
+	checkpoint	*Checkpoint // Live log position when the catalog was saved
 	debug		*gubed.Logger
 }
 
+// The live log position at which a catalog was saved.  Log records at or
+// after this position are not reflected in the catalog file.
+type Checkpoint struct {
+	fnum		LBUINT // live log file number
+	pos			LBUINT // live log size
+	seq			uint64 // last record sequence number handed out
+}
+
+func (cp *Checkpoint) Fnum() LBUINT {return cp.fnum}
+func (cp *Checkpoint) Position() LBUINT {return cp.pos}
+func (cp *Checkpoint) Seq() uint64 {return cp.seq}
+
+func (cp *Checkpoint) Equals(other *Checkpoint) bool {
+	if cp == nil || other == nil {return cp == other}
+	return cp.fnum == other.fnum && cp.pos == other.pos
+}
+
+func (cp *Checkpoint) String() string {
+	return fmt.Sprintf("(fnum=%d pos=%d)", cp.fnum, cp.pos)
+}
+
 // Getters.
 
 func (cat *Catalog) Name() string {return cat.name}
@@ -54,9 +79,9 @@ func (cat *Catalog) IsMaster() bool {return cat.ismaster}
 func (cat *Catalog) Map() map[interface{}]CatalogRecord {return cat.index}
 func (cat *Catalog) File() *CatalogFile {return cat.file}
 func (cat *Catalog) HasChanged() bool {return cat.changed}
-func (cat *Catalog) NextId() CATID_TYPE {return cat.nextid}
 func (cat *Catalog) KeepUpdated() bool {return cat.update}
 func (cat *Catalog) AutoSave() bool {return cat.autosave}
+func (cat *Catalog) Checkpoint() *Checkpoint {return cat.checkpoint}
 
 func (cat *Catalog) Len() int {return len(cat.index)}
 
@@ -66,6 +91,7 @@ func MakeCatalog(name string, debug *gubed.Logger) *Catalog {
 		name:		name,
 		ismaster:	false,
 		index:		make(map[interface{}]CatalogRecord),
+		order:		NewOrderedKeys(),
 		update:		false,
 		autosave:	false,
 		debug:		debug,
@@ -77,6 +103,7 @@ func MakeMasterCatalog(debug *gubed.Logger) *Catalog {
 		name:		MASTER_CATALOG_NAME,
 		ismaster:	true,
 		index:		make(map[interface{}]CatalogRecord),
+		order:		NewOrderedKeys(),
 		update:		true,
 		autosave:	true,
 		debug:		debug,
@@ -138,21 +165,45 @@ func (cat *Catalog) Get(key interface{}) CatalogRecord {
 	return cr
 }
 
+// Hand out the index to be read, but never written, by a snapshot.  The
+// catalog copies its index before the next write.
+func (cat *Catalog) Share() map[interface{}]CatalogRecord {
+	cat.Lock()
+	defer cat.Unlock()
+	cat.shared = true
+	return cat.index
+}
+
+// Copy the index if it is shared, so that it can be written.  The caller
+// must hold the catalog lock.
+func (cat *Catalog) unshare() {
+	if !cat.shared {return}
+	index := make(map[interface{}]CatalogRecord, len(cat.index))
+	for key, cr := range cat.index {index[key] = cr}
+	cat.index = index
+	cat.shared = false
+	return
+}
+
 // Gateway for writing to catalog.
 func (cat *Catalog) Put(key interface{}, cr CatalogRecord) {
 	cat.Lock()
+	cat.unshare()
+	if _, present := cat.index[key]; !present {cat.order.Insert(key)}
 	cat.index[key] = cr
-	cat.Unlock()
 	cat.changed = true
+	cat.Unlock()
 	return
 }
 
 // Gateway for removing entry from catalog.
 func (cat *Catalog) Delete(key interface{}) {
 	cat.Lock()
+	cat.unshare()
 	delete(cat.index, key)
-	cat.Unlock()
+	cat.order.Delete(key)
 	cat.changed = true
+	cat.Unlock()
 	return
 }
 
@@ -323,24 +374,39 @@ func BytesToCatalogId(byts []byte, debug *gubed.Logger) (interface{}, error) {
 	return cid, err
 }
 
-// Catalog id counter.
+// Catalog id counter.  The counter has its own lock, since it is set while
+// loading with the catalog already locked.
+
+// Get the next CATID counter value.
+func (cat *Catalog) NextId() CATID_TYPE {
+	cat.idlock.Lock()
+	defer cat.idlock.Unlock()
+	return cat.nextid
+}
 
 // Reset the next CATID to the minimum value.
 func (cat *Catalog) ResetId() {
+	cat.idlock.Lock()
+	defer cat.idlock.Unlock()
 	cat.nextid = CATID_MIN
 	return
 }
 
 // Increment the CATID counter by one.
 func (cat *Catalog) IncNextId() CATID_TYPE {
+	cat.idlock.Lock()
+	defer cat.idlock.Unlock()
 	cat.nextid++
 	return cat.nextid
 }
 
-// Get and increment next CATID counter value.
+// Get and increment next CATID counter value, atomically so that no two
+// callers get the same CATID.
 func (cat *Catalog) PopNextId() CATID_TYPE {
-	n := cat.NextId()
-	cat.IncNextId()
+	cat.idlock.Lock()
+	defer cat.idlock.Unlock()
+	n := cat.nextid
+	cat.nextid++
 	return n
 }
 
@@ -354,7 +420,9 @@ func IsCATID(key interface{}) bool {
 // If the given key value is of the correct type, increment the CATID counter.
 func (cat *Catalog) SetNextId(key interface{}) {
 	if cid, isCATID := key.(CATID_TYPE); isCATID {
+		cat.idlock.Lock()
 		cat.nextid = cid + 1
+		cat.idlock.Unlock()
 	}
 	return
 }
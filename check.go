@@ -0,0 +1,540 @@
+/*
+	Consistency check and repair of a logbase.
+
+	Check cross-validates the files of a logbase with the logbase locked.
+	Each logfile is scanned, verifying the checksum of every record, and its
+	index file compared with the records found.  The scanned records are then
+	replayed into a scratch Master Catalog and zapmap, which every other
+	structure is checked against:
+
+	 - each key of the Master Catalog must point at the latest record for
+	   it, and no key with a live record may be missing;
+	 - the zapmap must schedule every stale record for zapping, once, with
+	   its right size, and no record that is live or not there at all;
+	 - each chunk of a streamed value must be listed by its manifest, and
+	   each chunk a manifest lists must be there;
+	 - each key in another catalog file must be in the Master Catalog, at
+	   the same value location; and
+	 - each user permission file must be readable and belong to a user.
+
+	With repair on, index files are rewritten from their logfiles, index
+	files without a logfile removed, the Master Catalog and zapmap replaced
+	by those rebuilt, unlisted chunks deleted, keys of other catalogs
+	dropped or re-pointed at the Master Catalog, and the permission files of
+	unknown users removed, before everything is saved.  Corrupt records,
+	missing chunks and unreadable permission files are reported but cannot
+	be repaired, the corrupt records simply being left out of the index.
+
+	A repair should not run while a value is being streamed in, as its
+	chunks are unlisted until its manifest is stored.
+*/
+package logbase
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// What a problem found by Check concerns.
+const (
+	CHECK_LOGFILE		string = "logfile"
+	CHECK_INDEX			string = "index"
+	CHECK_MASTER		string = "master"
+	CHECK_ZAPMAP		string = "zapmap"
+	CHECK_CHUNK			string = "chunk"
+	CHECK_CATALOG		string = "catalog"
+	CHECK_PERMISSION	string = "permission"
+)
+
+// An inconsistency found by Check.
+type CheckProblem struct {
+	kind		string // one of the CHECK_ constants
+	path		string // file concerned, relative to the logbase directory
+	key			interface{} // key concerned, if any
+	detail		string
+	repaired	bool
+}
+
+func (prob *CheckProblem) Kind() string {return prob.kind}
+func (prob *CheckProblem) Path() string {return prob.path}
+func (prob *CheckProblem) Key() interface{} {return prob.key}
+func (prob *CheckProblem) Detail() string {return prob.detail}
+func (prob *CheckProblem) Repaired() bool {return prob.repaired}
+
+func (prob *CheckProblem) String() string {
+	var where string = prob.path
+	if prob.key != nil {where = fmt.Sprintf("%s key %v", where, prob.key)}
+	var fixed string
+	if prob.repaired {fixed = " (repaired)"}
+	return fmt.Sprintf("%s %s: %s%s", prob.kind, where, prob.detail, fixed)
+}
+
+// Report of a consistency check.
+type CheckReport struct {
+	nlogfiles	int // number of logfiles scanned
+	nrecords	int // number of sound records in them
+	nkeys		int // number of live keys
+	nzaps		int // number of stale records
+	ncatalogs	int // number of other catalog files checked
+	nusers		int // number of user permission files checked
+	problems	[]*CheckProblem
+}
+
+func (rep *CheckReport) Problems() []*CheckProblem {return rep.problems}
+
+// Were no problems found?
+func (rep *CheckReport) OK() bool {return len(rep.problems) == 0}
+
+// The number of problems found but left unrepaired.
+func (rep *CheckReport) Unrepaired() (n int) {
+	for _, prob := range rep.problems {
+		if !prob.repaired {n++}
+	}
+	return
+}
+
+func (rep *CheckReport) String() string {
+	return fmt.Sprintf(
+		"(nlogfiles=%d nrecords=%d nkeys=%d nzaps=%d ncatalogs=%d nusers=%d " +
+		"nproblems=%d unrepaired=%d)",
+		rep.nlogfiles,
+		rep.nrecords,
+		rep.nkeys,
+		rep.nzaps,
+		rep.ncatalogs,
+		rep.nusers,
+		len(rep.problems),
+		rep.Unrepaired())
+}
+
+// State carried between the steps of a check.
+type checker struct {
+	lbase		*Logbase
+	scratch		*Logbase // replays the scanned records
+	repair		bool
+	rep			*CheckReport
+	fnums		[]LBUINT
+	scanned		map[LBUINT]*Index
+	records		map[recordAt]bool // fnum and rpos of each sound record
+	vposes		map[LBUINT]map[LBUINT]*RecordLocation // record by value position
+}
+
+// Check the logbase for consistency, repairing what can be if the given
+// switch is on.
+func (lbase *Logbase) Check(repair bool) (rep *CheckReport, err error) {
+	lbase.Lock()
+	defer lbase.Unlock()
+	if err = lbase.CheckLiveLog(); err != nil {return}
+	// Everything written must be on file to be scanned
+	err = lbase.debug.Error(lbase.livelog.CloseAppenders())
+	if err != nil {return}
+	lbase.debug.Basic("Checking logbase %q, repair %v", lbase.name, repair)
+	chk := &checker{
+		lbase:		lbase,
+		scratch:	MakeLogbase(lbase.abspath, lbase.debug),
+		repair:		repair,
+		rep:		&CheckReport{},
+		scanned:	make(map[LBUINT]*Index),
+		records:	make(map[recordAt]bool),
+		vposes:		make(map[LBUINT]map[LBUINT]*RecordLocation),
+	}
+	chk.scratch.config = lbase.config
+	chk.scratch.keyring = lbase.keyring
+	defer chk.scratch.UnmapAll()
+
+	for _, step := range []func() error{
+		chk.logfiles,
+		chk.master,
+		chk.zapmap,
+		chk.chunks,
+		chk.catalogs,
+		chk.permissions,
+	} {
+		if err = step(); err != nil {return}
+	}
+	if repair {
+		if err = lbase.save(); err != nil {return}
+	}
+	rep = chk.rep
+	lbase.debug.Advise("Checked logbase %q %s", lbase.name, rep)
+	return
+}
+
+// Record a problem.
+func (chk *checker) problem(kind, path string, key interface{}, repaired bool, format string, a ...interface{}) {
+	prob := &CheckProblem{
+		kind:		kind,
+		path:		path,
+		key:		key,
+		detail:		fmt.Sprintf(format, a...),
+		repaired:	repaired,
+	}
+	chk.lbase.debug.Advise("Check of logbase %q: %s", chk.lbase.name, prob)
+	chk.rep.problems = append(chk.rep.problems, prob)
+}
+
+// Scan each logfile and compare its index file with the records found, then
+// look for index files without a logfile.
+func (chk *checker) logfiles() (err error) {
+	lbase := chk.lbase
+	_, chk.fnums, err = lbase.GetLogfilePaths()
+	if err != nil {return}
+	have := make(map[LBUINT]bool)
+	for _, fnum := range chk.fnums {
+		have[fnum] = true
+		ipath := lbase.MakeIndexfileRelPath(fnum)
+		istat, staterr := os.Stat(filepath.Join(lbase.abspath, ipath))
+		lfile, err := chk.scratch.GetLogfile(fnum)
+		if err != nil {return err}
+		scanned, corrupt, err := lfile.Index()
+		if err != nil {return err}
+		chk.rep.nlogfiles++
+		chk.rep.nrecords += len(scanned.List)
+		chk.scanned[fnum] = scanned
+		chk.vposes[fnum] = make(map[LBUINT]*RecordLocation)
+		for _, irec := range scanned.List {
+			rloc := irec.ToRecordLocation(lfile)
+			chk.records[recordAt{fnum, rloc.rpos}] = true
+			chk.vposes[fnum][irec.vpos] = rloc
+		}
+		for _, cerr := range corrupt {
+			chk.problem(CHECK_LOGFILE, lbase.MakeLogfileRelPath(fnum), nil, false,
+				"corrupt record of %d bytes at position %d is left out of the index",
+				cerr.Size(), cerr.Position())
+		}
+
+		var detail string
+		switch {
+		case os.IsNotExist(staterr) || (staterr == nil && istat.Size() == 0):
+			if len(scanned.List) > 0 {detail = "index file is missing"}
+		case staterr != nil:
+			return staterr
+		default:
+			var loaded *Index
+			loaded, err = lfile.indexfile.Load()
+			if err != nil {
+				detail = fmt.Sprintf("index file is unreadable: %v", err)
+			} else {
+				detail = CompareIndexes(loaded, scanned)
+			}
+		}
+		if detail == "" {continue}
+		if chk.repair {
+			ifile := lbase.livelog.indexfile
+			if fnum != lbase.livelog.fnum {
+				var lf *Logfile
+				lf, err = lbase.GetLogfile(fnum)
+				if err != nil {return err}
+				ifile = lf.indexfile
+			}
+			err = lbase.debug.Error(ifile.Save(scanned))
+			if err != nil {return err}
+			if fnum == lbase.livelog.fnum {ifile.Index = scanned}
+		}
+		chk.problem(CHECK_INDEX, ipath, nil, chk.repair, "%s", detail)
+	}
+
+	entries, err := ioutil.ReadDir(lbase.abspath)
+	if err != nil {return}
+	for _, entry := range entries {
+		parts := strings.Split(entry.Name(), FILENAME_DELIMITER)
+		if len(parts) != 2 || parts[1] != lbase.config.INDEXFILE_NAME_EXTENSION {continue}
+		num, err := strconv.ParseUint(parts[0], 10, 32)
+		if err != nil || have[LBUINT(num)] {continue}
+		if chk.repair {
+			err = lbase.debug.Error(os.Remove(filepath.Join(lbase.abspath, entry.Name())))
+			if err != nil {return err}
+			lbase.FileCache().Delete(filepath.Join(lbase.abspath, entry.Name()))
+		}
+		chk.problem(CHECK_INDEX, entry.Name(), nil, chk.repair, "index file has no logfile")
+	}
+	return nil
+}
+
+// Describe the first difference between an index read from file and the
+// index of the logfile, or return "" if they are the same.
+func CompareIndexes(loaded, scanned *Index) string {
+	for i, irec := range scanned.List {
+		if i == len(loaded.List) {
+			return fmt.Sprintf("index file ends at record %d of %d", i, len(scanned.List))
+		}
+		if lrec := loaded.List[i]; string(lrec.Pack()) != string(irec.Pack()) {
+			return fmt.Sprintf("index file has %v for record %d, not %v", lrec, i, irec)
+		}
+	}
+	if len(loaded.List) > len(scanned.List) {
+		return fmt.Sprintf("index file has %d records, the logfile %d",
+			len(loaded.List), len(scanned.List))
+	}
+	return ""
+}
+
+// Replay the scanned records into the scratch logbase and compare the
+// Master Catalog with the one rebuilt.
+func (chk *checker) master() error {
+	lbase, scratch := chk.lbase, chk.scratch
+	for _, fnum := range chk.fnums {
+		if _, err := scratch.ReplayIndex(chk.scanned[fnum], fnum, nil); err != nil {return err}
+	}
+	want, got := scratch.mcat.index, lbase.mcat.index
+	chk.rep.nkeys = len(want)
+	var keys []interface{}
+	for key := range got {keys = append(keys, key)}
+	for key := range want {
+		if got[key] == nil {keys = append(keys, key)}
+	}
+	sort.Slice(keys, func(i, j int) bool {return CompareKeys(keys[i], keys[j]) < 0})
+
+	path := lbase.mcat.Filename()
+	var changed bool
+	for _, key := range keys {
+		var detail string
+		wcr, gcr := want[key], got[key]
+		switch {
+		case gcr == nil:
+			detail = fmt.Sprintf("key is missing, its latest record is at %v", wcr)
+		case wcr == nil:
+			detail = fmt.Sprintf("key has no live record, but points at %v", gcr)
+		case !gcr.ToValueLocation().Equals(wcr):
+			detail = fmt.Sprintf("key points at %v, not its latest record at %v", gcr, wcr)
+		case gcr.ToValueLocation().expiry != wcr.ToValueLocation().expiry:
+			detail = fmt.Sprintf("key expires at %d, not %d",
+				gcr.ToValueLocation().expiry, wcr.ToValueLocation().expiry)
+		default:
+			continue
+		}
+		if chk.repair {
+			if wcr == nil {
+				lbase.mcat.Delete(key)
+			} else {
+				lbase.mcat.Put(key, wcr)
+			}
+			changed = true
+		}
+		chk.problem(CHECK_MASTER, path, key, chk.repair, "%s", detail)
+	}
+	if changed {
+		lbase.mcat.idlock.Lock()
+		if next := scratch.mcat.NextId(); next > lbase.mcat.nextid {lbase.mcat.nextid = next}
+		lbase.mcat.idlock.Unlock()
+	}
+	return nil
+}
+
+// Compare the zapmap with the stale records found by the replay.
+func (chk *checker) zapmap() error {
+	lbase := chk.lbase
+	// The records the replay scheduled, and the live ones
+	want := make(map[recordAt]*ZapRecord)
+	for _, zrecs := range chk.scratch.zmap.zapmap {
+		for _, zrec := range zrecs {want[zrecKey(zrec)] = zrec}
+	}
+	chk.rep.nzaps = len(want)
+	live := make(map[recordAt]bool)
+	for _, cr := range chk.scratch.mcat.index {
+		vloc := cr.ToValueLocation()
+		if rloc := chk.vposes[vloc.fnum][vloc.vpos]; rloc != nil {
+			live[recordAt{vloc.fnum, rloc.rpos}] = true
+		}
+	}
+
+	var keys []interface{}
+	for key := range lbase.zmap.zapmap {keys = append(keys, key)}
+	sort.Slice(keys, func(i, j int) bool {return CompareKeys(keys[i], keys[j]) < 0})
+	seen := make(map[recordAt]bool)
+	var bad bool
+	for _, key := range keys {
+		for _, zrec := range lbase.zmap.zapmap[key] {
+			at := zrecKey(zrec)
+			var detail string
+			switch {
+			case seen[at]:
+				detail = fmt.Sprintf("record %v is scheduled twice", zrec)
+			case live[at]:
+				detail = fmt.Sprintf("live record %v is scheduled for zapping", zrec)
+			case !chk.records[at]:
+				detail = fmt.Sprintf("there is no record at %v", zrec)
+			case want[at] == nil:
+				detail = fmt.Sprintf("record %v is not stale", zrec)
+			case want[at].rsz != zrec.rsz:
+				detail = fmt.Sprintf("record %v has %d bytes, not %d", zrec, want[at].rsz, zrec.rsz)
+			}
+			seen[at] = true
+			if detail == "" {continue}
+			bad = true
+			chk.problem(CHECK_ZAPMAP, ZAPMAP_FILENAME, key, chk.repair, "%s", detail)
+		}
+	}
+	var missing []*ZapRecord
+	for at, zrec := range want {
+		if !seen[at] {missing = append(missing, zrec)}
+	}
+	sort.Slice(missing, func(i, j int) bool {
+		a, b := missing[i], missing[j]
+		return a.fnum < b.fnum || (a.fnum == b.fnum && a.rpos < b.rpos)
+	})
+	for _, zrec := range missing {
+		bad = true
+		chk.problem(CHECK_ZAPMAP, ZAPMAP_FILENAME, nil, chk.repair,
+			"stale record %v is not scheduled for zapping", zrec)
+	}
+	if bad && chk.repair {
+		lbase.zmap.Lock()
+		lbase.zmap.zapmap = chk.scratch.zmap.zapmap
+		lbase.zmap.Unlock()
+		lbase.zmap.changed = true
+	}
+	return nil
+}
+
+// A record, by its logfile and position.
+type recordAt struct {
+	fnum, rpos	LBUINT
+}
+
+// The record the zap record points at.
+func zrecKey(zrec *ZapRecord) recordAt {
+	return recordAt{zrec.fnum, zrec.rpos}
+}
+
+// Check that each chunk is listed by a manifest, and each listed chunk is
+// there.
+func (chk *checker) chunks() error {
+	scratch := chk.scratch
+	path := chk.lbase.mcat.Filename()
+	listed := make(map[CHUNKID_TYPE]bool)
+	var keys, chunks []interface{}
+	for key := range scratch.mcat.index {
+		if IsChunkId(key) {
+			chunks = append(chunks, key)
+		} else {
+			keys = append(keys, key)
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {return CompareKeys(keys[i], keys[j]) < 0})
+	sort.Slice(chunks, func(i, j int) bool {return CompareKeys(chunks[i], chunks[j]) < 0})
+	for _, key := range keys {
+		ids, err := scratch.ChunksOf(key)
+		if err != nil {return err}
+		for i, id := range ids {
+			listed[id] = true
+			if scratch.mcat.index[id] == nil {
+				chk.problem(CHECK_CHUNK, path, key, false,
+					"chunk %d of %d, with id %d, is missing", i + 1, len(ids), id)
+			}
+		}
+	}
+	for _, key := range chunks {
+		if listed[key.(CHUNKID_TYPE)] {continue}
+		if chk.repair {
+			if err := chk.lbase.del(key); err != nil {return err}
+		}
+		chk.problem(CHECK_CHUNK, path, key, chk.repair,
+			"chunk is not listed by any streamed value")
+	}
+	return nil
+}
+
+// Check the keys in each catalog file other than the Master Catalog against
+// the rebuilt Master Catalog.
+func (chk *checker) catalogs() error {
+	lbase := chk.lbase
+	names, err := lbase.GetCatalogNames()
+	if err != nil {return err}
+	sort.Strings(names)
+	for _, name := range names {
+		chk.rep.ncatalogs++
+		path := CATALOG_FILENAME_PREFIX + name
+		file, _, err := chk.scratch.GetFile(path)
+		if err != nil {return err}
+		var bad []interface{}
+		var details []string
+		f := func(rec *GenericRecord) error {
+			if rec.ksz == 0 || rec.ktype == LBTYPE_CHECKPOINT {return nil}
+			if _, vtype := rec.GetValueAndType(MASTER_RECORD, lbase.debug); vtype == LBTYPE_EXPIRY {
+				return nil
+			}
+			key, vloc := rec.ToValueLocation(lbase.debug)
+			wcr := chk.scratch.mcat.index[key]
+			switch {
+			case wcr == nil:
+				details = append(details, "key is not in the logbase")
+			case !vloc.Equals(wcr):
+				details = append(details, fmt.Sprintf(
+					"key points at %v, not its latest record at %v", vloc, wcr))
+			default:
+				return nil
+			}
+			bad = append(bad, key)
+			return nil
+		}
+		if perr := file.Process(f, MASTER_RECORD, false); perr != nil {
+			// Rewritten from the catalog in memory on repair
+			bad = append(bad, nil)
+			details = append(details, fmt.Sprintf("catalog file is unreadable: %v", perr))
+		}
+		if len(bad) == 0 {continue}
+		if chk.repair {
+			cat, err := lbase.GetCatalog(name)
+			if err != nil {return err}
+			for _, key := range bad {
+				if key == nil {continue}
+				if mcr := lbase.mcat.Get(key); mcr != nil {
+					cat.Put(key, mcr)
+				} else if cat.Get(key) != nil {
+					cat.Delete(key)
+				}
+			}
+			if err = lbase.debug.Error(cat.Save()); err != nil {return err}
+			cat.changed = false
+		}
+		for i, key := range bad {
+			chk.problem(CHECK_CATALOG, path, key, chk.repair, "%s", details[i])
+		}
+	}
+	return nil
+}
+
+// Check that each user permission file is readable and belongs to a user.
+func (chk *checker) permissions() error {
+	lbase := chk.lbase
+	if !Exists(lbase.UserPermissionDirPath()) {return nil}
+	usernames, err := lbase.GetUserPermissionPaths()
+	if err != nil {return err}
+	sort.Strings(usernames)
+	for _, name := range usernames {
+		if strings.HasPrefix(name, TMPFILE_PREFIX) {continue}
+		chk.rep.nusers++
+		path := lbase.UserPermissionRelPath(name)
+		if chk.scratch.mcat.index[UserPassKey(name)] == nil {
+			if chk.repair {
+				abspath := filepath.Join(lbase.abspath, path)
+				if err = lbase.debug.Error(os.Remove(abspath)); err != nil {return err}
+				lbase.FileCache().Delete(abspath)
+				delete(lbase.users.perm, name)
+			}
+			chk.problem(CHECK_PERMISSION, path, nil, chk.repair,
+				"permission file of %q, who is not a user", name)
+			continue
+		}
+		file, _, err := chk.scratch.GetFile(path)
+		if err != nil {return err}
+		if file.size == 0 {continue}
+		f := func(rec *GenericRecord) error {
+			if rec.ksz > 0 && len(rec.vbyts) == 0 {
+				return FmtErrDataMismatch("Permission record for %q has no value", string(rec.kbyts))
+			}
+			return nil
+		}
+		if perr := file.Process(f, PERMISSION_RECORD, false); perr != nil {
+			chk.problem(CHECK_PERMISSION, path, nil, false,
+				"permission file is unreadable: %v", perr)
+		}
+	}
+	return nil
+}
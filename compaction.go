@@ -0,0 +1,385 @@
+/*
+	Background compaction of sealed logfiles.
+
+	The Compactor is an optional worker per logbase.  Every
+	COMPACTION_INTERVAL_SECS it measures the stale fraction of each sealed
+	logfile from the Zapmap, and zaps those at or above COMPACTION_STALE_RATIO,
+	most stale first, passing over any pinned by a snapshot.  The live records
+	of each logfile are copied with the logbase unlocked and the logfile
+	pinned, sleeping between buffers to keep within
+	COMPACTION_MAX_BYTES_PER_SEC, and the copy is swapped in under the
+	logbase lock.  If a snapshot pins the logfile meanwhile, the copy is
+	dropped and the logfile left for a later pass.  It can be paused, resumed
+	and stopped, and its progress queried at any time.  While old encryption
+	keys are configured, each pass ends by rekeying the logbase (see
+	encrypt.go).
+*/
+package logbase
+
+import (
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	COMPACTION_BUFFER_SIZE LBUINT = 65536 // bytes
+)
+
+// Live and stale bytes in a logfile.
+type LogfileStats struct {
+	fnum	LBUINT
+	size	int // bytes
+	stale	int // bytes scheduled for zapping
+}
+
+func (st *LogfileStats) Fnum() LBUINT {return st.fnum}
+func (st *LogfileStats) Size() int {return st.size}
+func (st *LogfileStats) Stale() int {return st.stale}
+func (st *LogfileStats) Live() int {return st.size - st.stale}
+
+// Fraction of the logfile that is stale.
+func (st *LogfileStats) StaleRatio() float64 {
+	if st.size == 0 {return 0}
+	return float64(st.stale) / float64(st.size)
+}
+
+func (st *LogfileStats) String() string {
+	return fmt.Sprintf(
+		"(fnum=%d size=%d stale=%d)",
+		st.fnum,
+		st.size,
+		st.stale)
+}
+
+// Return the number of stale bytes in each logfile, according to the zapmap.
+func (zmap *Zapmap) StaleBytes() map[LBUINT]int {
+	result := make(map[LBUINT]int)
+	zmap.RLock()
+	for _, zrecs := range zmap.zapmap {
+		for _, zrec := range zrecs {
+			result[zrec.fnum] += int(zrec.rsz)
+		}
+	}
+	zmap.RUnlock()
+	return result
+}
+
+// Return the stats for every logfile, in logfile order.
+func (lbase *Logbase) LogfileStats() (stats []*LogfileStats, err error) {
+	fpaths, fnums, err := lbase.GetLogfilePaths()
+	if err != nil {return}
+	stale := lbase.zmap.StaleBytes()
+	for i, fnum := range fnums {
+		var stat os.FileInfo
+		stat, err = os.Stat(fpaths[i])
+		if err != nil {return}
+		stats = append(stats, &LogfileStats{
+			fnum:	fnum,
+			size:	int(stat.Size()),
+			stale:	stale[fnum],
+		})
+	}
+	return
+}
+
+// Return the stats of the sealed logfiles due for compaction, most stale
+// first.
+func (lbase *Logbase) CompactionCandidates() ([]*LogfileStats, error) {
+	lbase.RLock() // the live log can roll over under us
+	stats, err := lbase.LogfileStats()
+	live := lbase.livelog
+	lbase.RUnlock()
+	if err != nil {return nil, err}
+	var result []*LogfileStats
+	for _, st := range stats {
+		if live != nil && st.fnum >= live.fnum {continue}
+		if lbase.IsPinned(st.fnum) {continue}
+		if st.stale > 0 && st.StaleRatio() >= lbase.config.COMPACTION_STALE_RATIO {
+			result = append(result, st)
+		}
+	}
+	sort.SliceStable(result, func(i, j int) bool {
+		return result[i].StaleRatio() > result[j].StaleRatio()
+	})
+	return result, nil
+}
+
+// Snapshot of the state of a Compactor.
+type CompactionProgress struct {
+	running		bool
+	paused		bool
+	passes		int // number of passes started
+	current		LBUINT // logfile being compacted, or 0
+	pending		[]LBUINT // logfiles left in this pass
+	ncompacted	int // logfiles compacted so far
+	copied		int // bytes copied so far
+	reclaimed	int // bytes reclaimed so far
+	lasterr		error
+}
+
+func (prog *CompactionProgress) Running() bool {return prog.running}
+func (prog *CompactionProgress) Paused() bool {return prog.paused}
+func (prog *CompactionProgress) Passes() int {return prog.passes}
+func (prog *CompactionProgress) Current() LBUINT {return prog.current}
+func (prog *CompactionProgress) Pending() []LBUINT {return prog.pending}
+func (prog *CompactionProgress) Compacted() int {return prog.ncompacted}
+func (prog *CompactionProgress) Copied() int {return prog.copied}
+func (prog *CompactionProgress) Reclaimed() int {return prog.reclaimed}
+func (prog *CompactionProgress) LastError() error {return prog.lasterr}
+
+func (prog *CompactionProgress) String() string {
+	return fmt.Sprintf(
+		"(running=%v paused=%v passes=%d current=%d pending=%v " +
+		"compacted=%d copied=%d reclaimed=%d lasterr=%v)",
+		prog.running,
+		prog.paused,
+		prog.passes,
+		prog.current,
+		prog.pending,
+		prog.ncompacted,
+		prog.copied,
+		prog.reclaimed,
+		prog.lasterr)
+}
+
+// Background compaction worker.
+type Compactor struct {
+	lbase		*Logbase
+	progress	CompactionProgress
+	sync.Mutex	// guards progress and rekey
+	rekey		bool // values may be sealed under old keys
+	wake		chan bool
+	stop		chan bool
+	done		chan bool
+}
+
+// Start the background compactor for the logbase, if not already running.
+func (lbase *Logbase) StartCompactor() *Compactor {
+	if lbase.compactor != nil && lbase.compactor.Progress().running {
+		return lbase.compactor
+	}
+	comp := &Compactor{
+		lbase:	lbase,
+		rekey:	lbase.keyring.HasOldKeys(),
+		wake:	make(chan bool, 1),
+		stop:	make(chan bool),
+		done:	make(chan bool),
+	}
+	comp.progress.running = true
+	lbase.compactor = comp
+	go comp.run()
+	lbase.debug.Advise("Started compactor for logbase %q", lbase.name)
+	return comp
+}
+
+// Worker loop.
+func (comp *Compactor) run() {
+	defer close(comp.done)
+	interval := time.Duration(comp.lbase.config.COMPACTION_INTERVAL_SECS) * time.Second
+	if interval <= 0 {interval = time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-comp.stop:
+			return
+		case <-ticker.C:
+		case <-comp.wake:
+		}
+		if comp.Progress().paused {continue}
+		comp.lbase.debug.Error(comp.RunOnce())
+	}
+}
+
+// Make one compaction pass over the candidate logfiles.  Stops early if the
+// compactor is paused or stopped.
+func (comp *Compactor) RunOnce() error {
+	lbase := comp.lbase
+	cands, err := lbase.CompactionCandidates()
+	if err != nil {return comp.fail(err)}
+	comp.Lock()
+	comp.progress.passes++
+	comp.progress.pending = nil
+	for _, st := range cands {
+		comp.progress.pending = append(comp.progress.pending, st.fnum)
+	}
+	comp.Unlock()
+
+	for _, st := range cands {
+		if comp.halted() {break}
+		comp.Lock()
+		comp.progress.current = st.fnum
+		comp.progress.pending = comp.progress.pending[1:]
+		comp.Unlock()
+
+		copied, reclaimed, err := comp.compact(st.fnum)
+		comp.Lock()
+		comp.progress.current = 0
+		if err == nil && (copied > 0 || reclaimed > 0) {
+			comp.progress.ncompacted++
+			comp.progress.copied += copied
+			comp.progress.reclaimed += reclaimed
+		}
+		comp.Unlock()
+		if err != nil {return comp.fail(err)}
+	}
+	comp.Lock()
+	comp.progress.pending = nil
+	rekey := comp.rekey
+	comp.Unlock()
+	if rekey && !comp.halted() {return comp.rekeyAll()}
+	return nil
+}
+
+// Rekey the logbase, until a pass is not held back by a snapshot.
+func (comp *Compactor) rekeyAll() error {
+	lbase := comp.lbase
+	start := time.Now()
+	rep, err := lbase.Rekey()
+	if err != nil {return comp.fail(err)}
+	_, pinned := lbase.OldestPinned()
+	comp.Lock()
+	comp.progress.copied += rep.outsize
+	comp.progress.reclaimed += rep.Reclaimed()
+	if !pinned {comp.rekey = false}
+	comp.Unlock()
+	comp.throttle(rep.outsize, time.Since(start))
+	return nil
+}
+
+// Zap a single logfile, copying its live records at no more than the rate
+// limit with the logbase unlocked, then swapping the copy in under the lock.
+func (comp *Compactor) compact(fnum LBUINT) (copied, reclaimed int, err error) {
+	lbase := comp.lbase
+	lfile, plan, err := comp.plan(fnum)
+	if err != nil || plan == nil {return}
+	lbase.debug.Basic("Compacting logfile %s", lfile.abspath)
+	err = lfile.CopyUnzapped(plan, COMPACTION_BUFFER_SIZE, comp.pacer())
+
+	lbase.Lock()
+	defer lbase.Unlock()
+	lbase.Unpin([]LBUINT{fnum})
+	if err == nil && lbase.IsPinned(fnum) {
+		lbase.debug.Fine("Not zapping logfile %d, it was pinned by a snapshot", fnum)
+		lfile.tmp.Remove()
+		return
+	}
+	if err != nil {
+		lfile.tmp.Remove()
+		return
+	}
+	before := lfile.size
+	zl, err := lfile.SwapZapped(lbase.zmap, plan)
+	if err != nil {return}
+	lbase.RemapCatalogs(fnum, zl)
+	if err = lbase.save(); err != nil {return}
+	return lfile.size, before - lfile.size, nil
+}
+
+// Find the records to zap from the logfile under the logbase lock, and pin
+// it until the zap is done, so that it is neither zapped, merged nor
+// migrated meanwhile.  Returns a nil plan if there is nothing to zap.
+func (comp *Compactor) plan(fnum LBUINT) (lfile *Logfile, plan *ZapPlan, err error) {
+	lbase := comp.lbase
+	lbase.Lock()
+	defer lbase.Unlock()
+	if lbase.IsPinned(fnum) {return}
+	lfile, err = lbase.GetLogfile(fnum)
+	if err != nil {return}
+	hold, err := lbase.HeldTombstones(lfile)
+	if err != nil {return}
+	plan, err = lfile.PlanZap(lbase.zmap, hold)
+	if err != nil || plan == nil {return}
+	lbase.Pin([]LBUINT{fnum})
+	return
+}
+
+// Return a function to be called with the number of bytes copied after each
+// buffer, which sleeps whenever the copying gets ahead of the rate limit, or
+// nil if there is no limit.
+func (comp *Compactor) pacer() func(nbytes int) {
+	if comp.lbase.config.COMPACTION_MAX_BYTES_PER_SEC <= 0 {return nil}
+	start := time.Now()
+	var total int
+	return func(nbytes int) {
+		total += nbytes
+		comp.throttle(total, time.Since(start))
+	}
+}
+
+// Sleep for long enough that copying the given number of bytes, which took
+// the given time, keeps within the rate limit.  Returns early if stopped.
+func (comp *Compactor) throttle(nbytes int, took time.Duration) {
+	rate := comp.lbase.config.COMPACTION_MAX_BYTES_PER_SEC
+	if rate <= 0 || nbytes == 0 {return}
+	wait := time.Duration(float64(nbytes) / float64(rate) * float64(time.Second)) - took
+	if wait <= 0 {return}
+	select {
+	case <-comp.stop:
+	case <-time.After(wait):
+	}
+}
+
+// Should the current pass end now?
+func (comp *Compactor) halted() bool {
+	select {
+	case <-comp.stop:
+		return true
+	default:
+	}
+	return comp.Progress().paused
+}
+
+// Record an error and return it.
+func (comp *Compactor) fail(err error) error {
+	comp.Lock()
+	comp.progress.lasterr = err
+	comp.Unlock()
+	return err
+}
+
+// Stop compacting after the current logfile, until resumed.
+func (comp *Compactor) Pause() {
+	comp.Lock()
+	comp.progress.paused = true
+	comp.Unlock()
+	comp.lbase.debug.Basic("Paused compactor for logbase %q", comp.lbase.name)
+}
+
+// Resume compacting, starting a pass straight away.
+func (comp *Compactor) Resume() {
+	comp.Lock()
+	comp.progress.paused = false
+	comp.Unlock()
+	select {
+	case comp.wake <- true:
+	default: // a pass is already due
+	}
+	comp.lbase.debug.Basic("Resumed compactor for logbase %q", comp.lbase.name)
+}
+
+// Stop the worker, waiting for it to finish any logfile in progress.
+func (comp *Compactor) Stop() {
+	comp.Lock()
+	if !comp.progress.running {
+		comp.Unlock()
+		return
+	}
+	comp.progress.running = false
+	comp.Unlock()
+	close(comp.stop)
+	<-comp.done
+	comp.lbase.debug.Advise("Stopped compactor for logbase %q", comp.lbase.name)
+}
+
+// Return a snapshot of the compactor progress.
+func (comp *Compactor) Progress() *CompactionProgress {
+	comp.Lock()
+	prog := comp.progress
+	prog.pending = append([]LBUINT(nil), comp.progress.pending...)
+	comp.Unlock()
+	return &prog
+}
@@ -0,0 +1,73 @@
+/*
+	Transparent compression of values.
+
+	With COMPRESS_VALUES on, a value of at least COMPRESS_MIN_SIZE bytes is
+	deflated with compress/flate as it is stored, if that makes it smaller.
+	Its log record then has the value type LBTYPE_COMPRESSED, flagging the
+	value as compressed, followed by the LBTYPE of the value and the deflated
+	bytes.  A value put with a time-to-live is compressed before its expiry
+	is wrapped around it.  Values are inflated as they are read, so Get, the
+	value cache, snapshots, iterators and History only ever see the original
+	bytes, while value sizes in the index and catalogs are those stored.
+	Records keep their compression when moved by a zap, merge or migration,
+	and are read as they were written whatever the current setting.
+*/
+package logbase
+
+import (
+	"github.com/h00gs/gubed"
+	"bytes"
+	"compress/flate"
+	"io/ioutil"
+)
+
+// Return the value bytes deflated, with their type, to be stored with type
+// LBTYPE_COMPRESSED, if configured to and worthwhile, otherwise the value as
+// it is.
+func (lbase *Logbase) CompressValue(vbyts []byte, vtype LBTYPE) ([]byte, LBTYPE) {
+	if !lbase.config.COMPRESS_VALUES || len(vbyts) < lbase.config.COMPRESS_MIN_SIZE {
+		return vbyts, vtype
+	}
+	cbyts, err := CompressBytes(vbyts)
+	if lbase.debug.Error(err) != nil || len(cbyts) + LBTYPE_SIZE >= len(vbyts) {
+		return vbyts, vtype
+	}
+	return InjectType(cbyts, vtype), LBTYPE_COMPRESSED
+}
+
+// Deflate the bytes.
+func CompressBytes(byts []byte) ([]byte, error) {
+	bfr := new(bytes.Buffer)
+	wtr, err := flate.NewWriter(bfr, flate.DefaultCompression)
+	if err != nil {return nil, err}
+	_, err = wtr.Write(byts)
+	if err != nil {return nil, err}
+	err = wtr.Close()
+	if err != nil {return nil, err}
+	return bfr.Bytes(), nil
+}
+
+// Inflate a value of type LBTYPE_COMPRESSED, returning its bytes and type.
+// Other values are returned as they are.
+func DecompressValue(vbyts []byte, vtype LBTYPE, debug *gubed.Logger) ([]byte, LBTYPE, error) {
+	if vtype != LBTYPE_COMPRESSED {return vbyts, vtype, nil}
+	if len(vbyts) < LBTYPE_SIZE {
+		return nil, LBTYPE_NIL, debug.Error(FmtErrSliceTooSmall(vbyts, LBTYPE_SIZE))
+	}
+	cbyts, vtype := SnipValueType(vbyts, debug)
+	rdr := flate.NewReader(bytes.NewReader(cbyts))
+	defer rdr.Close()
+	val, err := ioutil.ReadAll(rdr)
+	if err != nil {return nil, LBTYPE_NIL, debug.Error(FmtErrDecompress(vtype, err))}
+	return val, vtype, nil
+}
+
+// Unpack a value as stored in its log record, returning its original bytes
+// and type, and its expiry time, or 0 if it never expires.
+func (lbase *Logbase) UnpackValue(vbyts []byte, vtype LBTYPE) ([]byte, LBTYPE, int64, error) {
+	vbyts, vtype, expiry := UnwrapValue(vbyts, vtype, lbase.debug)
+	vbyts, vtype, err := lbase.keyring.Open(vbyts, vtype, lbase.debug)
+	if err != nil {return nil, LBTYPE_NIL, expiry, err}
+	vbyts, vtype, err = DecompressValue(vbyts, vtype, lbase.debug)
+	return vbyts, vtype, expiry, err
+}
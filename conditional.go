@@ -0,0 +1,69 @@
+/*
+	Conditional writes, for writers that race on the same keys.
+
+	Each write checks the current master catalog record for the key against
+	the one the caller expects, and only goes ahead if they match, holding the
+	logbase lock across both the check and the append.  Records match if they
+	have the same value version, so a record read before its value was cached
+	or moved still matches, while an older value that happens to have been
+	stored at the same position after a zap does not.  A mismatch returns a
+	write conflict error, for which IsConflict is true.  An expired key counts
+	as absent.
+*/
+package logbase
+
+import (
+	"time"
+)
+
+// Put the key-value pair only if the key is not already in the logbase.
+func (lbase *Logbase) PutIfAbsent(key interface{}, vbyts []byte, vtype LBTYPE) (CatalogRecord, error) {
+	return lbase.PutIfMatch(key, nil, vbyts, vtype)
+}
+
+// Put the key-value pair only if the master catalog record for the key
+// matches the expected one, with nil meaning the key must be absent.
+func (lbase *Logbase) PutIfMatch(key interface{}, expected CatalogRecord, vbyts []byte, vtype LBTYPE) (CatalogRecord, error) {
+	lbase.Lock()
+	err := lbase.CheckLiveLog()
+	if err == nil {err = lbase.CheckMatch(key, expected)}
+	var mcr CatalogRecord
+	if err == nil {mcr, err = lbase.put(key, vbyts, vtype)}
+	seq := lbase.syncer.Last()
+	lbase.Unlock()
+	if err != nil {return nil, err}
+	return mcr, lbase.WaitDurable(seq)
+}
+
+// Delete the key only if its master catalog record matches the expected one.
+func (lbase *Logbase) DeleteIfMatch(key interface{}, expected CatalogRecord) error {
+	if expected == nil {return FmtErrBadArgs("Expected record for key %v must not be nil", key)}
+	lbase.Lock()
+	err := lbase.CheckLiveLog()
+	if err == nil {err = lbase.CheckMatch(key, expected)}
+	if err == nil {err = lbase.del(key)}
+	seq := lbase.syncer.Last()
+	lbase.Unlock()
+	if err != nil {return err}
+	return lbase.WaitDurable(seq)
+}
+
+// Return a write conflict error unless the master catalog record for the key
+// matches the expected one.  The caller must hold the logbase lock.
+func (lbase *Logbase) CheckMatch(key interface{}, expected CatalogRecord) error {
+	current := lbase.mcat.Get(key)
+	if current != nil && current.ToValueLocation().Expired(time.Now()) {
+		current = nil
+	}
+	if !RecordsMatch(current, expected) {
+		return FmtErrConflict(key, expected, current)
+	}
+	return nil
+}
+
+// Are the catalog records for the same version of a value?  Two nil records
+// match.
+func RecordsMatch(cr1, cr2 CatalogRecord) bool {
+	if cr1 == nil || cr2 == nil {return cr1 == nil && cr2 == nil}
+	return cr1.ToValueLocation().version == cr2.ToValueLocation().version
+}
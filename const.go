@@ -6,14 +6,17 @@ package logbase
 
 type LBTYPE		uint8 // Value type identifier
 type CATID_TYPE uint64 // Catalog record id key type
+type CHUNKID_TYPE uint64 // Streamed value chunk key type
 
 // Keep these consistent!
 const (
 	LBTYPE_SIZE		int = 1 // bytes
 	CATID_TYPE_SIZE	int = 8 // bytes
-	LBUINT_MAX      int64 = 4294967295
+	LBUINT_MAX      int64 = 9223372036854775807 // as converted from int
 	CRC_SIZE		LBUINT = 4
+	STAMP_SIZE		LBUINT = 16 // sequence number and timestamp, from format v3
 	VALOC_SIZE		LBUINT = LBUINT_SIZE_x3 + LBUINT(LBTYPE_SIZE)
+	ZAPLOC_SIZE		LBUINT = LBUINT_SIZE_x3 // no LBTYPE
 )
 
 const (
@@ -21,6 +24,8 @@ const (
 	CONFIG_FILENAME		string = "logbase.cfg"
 	MASTER_CATALOG_NAME string = "master"
 	ZAPMAP_FILENAME		string = ".zapmap"
+	QUARANTINE_FILENAME	string = ".quarantine"
+	KEYSALT_FILENAME	string = ".keysalt"
 	PERMISSIONS_DIR_NAME string = "users"
 )
 
@@ -31,6 +36,13 @@ const (
 	// Non-user space types (automated)
 	LBTYPE_NIL			LBTYPE = 0
 	LBTYPE_VALOC		LBTYPE = 10 // Location in log file of value bytes
+	LBTYPE_CHECKPOINT	LBTYPE = 11 // Master Catalog file checkpoint
+	LBTYPE_BATCH		LBTYPE = 12 // Log record marking the start of a batch
+	LBTYPE_COMMIT		LBTYPE = 13 // Log record marking a committed batch
+	LBTYPE_EXPIRY		LBTYPE = 14 // Value or record carrying an expiry time
+	LBTYPE_COMPRESSED	LBTYPE = 15 // Deflated value, after its own LBTYPE
+	LBTYPE_ENCRYPTED	LBTYPE = 16 // Sealed value, its LBTYPE included
+	LBTYPE_CHUNKED		LBTYPE = 17 // List of the chunks of a streamed value
 
 	// User space types
 	LBTYPE_UINT8		LBTYPE = 50
@@ -50,6 +62,7 @@ const (
 	LBTYPE_COMPLEX128	LBTYPE = 111
 
 	LBTYPE_CATID		LBTYPE = 121 // Catalog record id
+	LBTYPE_CHUNKID		LBTYPE = 122 // Streamed value chunk id
 
 	// Non-fixed size types
 	// Only types with underlying []byte type after here
@@ -14,6 +14,7 @@ import (
 	"fmt"
 	"sort"
 	"sync"
+	"sync/atomic"
 )
 
 var BIGEND binary.ByteOrder = binary.BigEndian
@@ -29,15 +30,25 @@ const (
 type FileDecodeConfig struct {
 	readDataValueSize	bool // Read a value size (GVS) after the key size (KS)?
 	snipValueType		bool // Snip LBTYPE value from the returned value bytes?
-	genericValueSize	LBUINT
+	genericValueUints	LBUINT // Number of LBUINTs in a fixed size value
+	genericValueBytes	LBUINT // Number of other bytes in a fixed size value
+	genericValueStamped	bool // Is a fixed size value followed by a stamp?
 }
 
 var FileDecodeConfigs = map[int]*FileDecodeConfig{
-	LOG_RECORD:			&FileDecodeConfig{true,		true,	0},
-	INDEX_RECORD:		&FileDecodeConfig{false,	false,	LBUINT_SIZE_x2},
-	MASTER_RECORD:		&FileDecodeConfig{false,	false,	ValueLocationBytes()},
-	ZAP_RECORD:			&FileDecodeConfig{true,		false,	0},
-	PERMISSION_RECORD:	&FileDecodeConfig{false,	false,	LBUINT(1)},
+	LOG_RECORD:			&FileDecodeConfig{true,		true,	0,	0,	false},
+	INDEX_RECORD:		&FileDecodeConfig{false,	false,	2,	0,	true},
+	MASTER_RECORD:		&FileDecodeConfig{false,	false,	3,	LBUINT(LBTYPE_SIZE),	false},
+	ZAP_RECORD:			&FileDecodeConfig{true,		false,	0,	0,	false},
+	PERMISSION_RECORD:	&FileDecodeConfig{false,	false,	0,	1,	false},
+}
+
+// Size of a fixed size value, given the number of bytes per LBUINT and per
+// stamp in the file.
+func (cfg *FileDecodeConfig) GenericValueSize(usz, ssz LBUINT) LBUINT {
+	size := cfg.genericValueUints * usz + cfg.genericValueBytes
+	if cfg.genericValueStamped {size += ssz}
+	return size
 }
 
 // Data containers.
@@ -87,6 +98,12 @@ type Rpos struct {
 	rpos    LBUINT
 }
 
+// When a record was written, both zero if not known.
+type Stamp struct {
+	seq		uint64 // logbase sequence number
+	ts		int64 // wall-clock time in Unix nanoseconds
+}
+
 // Provide a generic record file for "IO read infrastructure".
 type GenericRecord struct {
 	*Ksize  // typed key, including LBTYPE
@@ -96,6 +113,8 @@ type GenericRecord struct {
 	*Vdata  // type snipped only according to FileDecodeConfgs
 	*Vtype
 	*Vpos
+	usz		LBUINT // bytes per LBUINT in the file read from
+	ssz		LBUINT // bytes per stamp in the file read from
 }
 
 // Init a GenericRecord.
@@ -108,29 +127,37 @@ func NewGenericRecord() *GenericRecord {
 		Vdata: &Vdata{},
 		Vtype: &Vtype{},
 		Vpos: &Vpos{},
+		usz: LBUINT_SIZE,
+		ssz: STAMP_SIZE,
 	}
 }
 
 // Define a log file record.
 type LogRecord struct {
-	crc     LBUINT // cyclic redundancy check
+	crc     uint32 // cyclic redundancy check
+	usz		LBUINT // bytes used to store each size, by file format
+	ssz		LBUINT // bytes used to store the stamp, by file format
 	*Ksize  // typed key, including LBTYPE
 	*Vsize	// typed value, including LBTYPE
 	*Kdata
 	*Ktype
 	*Vdata  // does not include LBTYPE
 	*Vtype
+	*Stamp
 }
 
 // Init a LogRecord.
 func NewLogRecord() *LogRecord {
 	return &LogRecord{
+		usz:   LBUINT_SIZE,
+		ssz:   STAMP_SIZE,
 		Ksize: &Ksize{},
 		Vsize: &Vsize{},
 		Kdata: &Kdata{},
 		Ktype: &Ktype{},
 		Vdata: &Vdata{},
 		Vtype: &Vtype{},
+		Stamp: &Stamp{},
 	}
 }
 
@@ -139,6 +166,8 @@ type IndexRecord struct {
 	*IndexRecordHeader
 	*Kdata
 	*Ktype
+	*Stamp
+	expiry	int64 // Unix nanoseconds, 0 for none, kept in a marker record
 }
 
 // Init a IndexRecord.
@@ -147,6 +176,7 @@ func NewIndexRecord() *IndexRecord {
 		IndexRecordHeader: NewIndexRecordHeader(),
 		Kdata: &Kdata{},
 		Ktype: &Ktype{},
+		Stamp: &Stamp{},
 	}
 }
 
@@ -171,16 +201,25 @@ type ValueLocation struct {
 	fnum    LBUINT // log files indexed sequentially from 0
 	*Vsize	// typed value, that is including LBTYPE
 	*Vpos
+	version	uint64 // unique in this process, kept when the value moves
+	expiry	int64 // Unix nanoseconds, 0 for none
 }
 
+var valueVersion uint64 = 0 // last ValueLocation version handed out
+
 // Init a ValueLocation.
 func NewValueLocation() *ValueLocation {
 	return &ValueLocation{
 		Vsize: &Vsize{},
 		Vpos: &Vpos{},
+		version: atomic.AddUint64(&valueVersion, 1),
 	}
 }
 
+// The version of the value, which is new for each value stored, but kept
+// when the value is moved by a zap, merge or migration.
+func (vloc *ValueLocation) Version() uint64 {return vloc.version}
+
 // Define a data container.
 type Value struct {
 	vtype	LBTYPE
@@ -236,8 +275,6 @@ func NewUserPermissionRecord() *UserPermissionRecord {
 	}
 }
 
-func ValueLocationBytes() LBUINT {return VALOC_SIZE}
-
 // Logbase level.
 
 //  Index of all key-value pairs in a log file.
@@ -309,7 +346,7 @@ func (lbase *Logbase) UpdateZapmap(irec *IndexRecord, fnum LBUINT) (interface{},
 		vloc := old.ToValueLocation()
 		// Add to zapmap
 		zrec := NewZapRecord()
-		rloc := vloc.ToRecordLocation(irec.ksz)
+		rloc := lbase.RecordLocation(vloc, irec.ksz)
 		zrec.RecordLocation = rloc
 		lbase.zmap.PutRecord(key, zrec)
 	}
@@ -333,6 +370,9 @@ func (zmap *Zapmap) Get(key interface{}) []*ZapRecord {
 // Gateway for adding single record into to zapmap.
 func (zmap *Zapmap) PutRecord(key interface{}, zrec *ZapRecord) {
 	zrecs := zmap.Get(key)
+	for _, other := range zrecs {
+		if other.Equals(zrec) {return} // Already scheduled, e.g. on replay
+	}
 	zrecs = append(zrecs, zrec)
 	zmap.Put(key, zrecs)
 	return
@@ -400,7 +440,7 @@ func (up *UserPermissions) Delete(key interface{}) {
 // Returns the number of ValueLocationRecords in GenericRecord value,
 // unless a partial record is detected, which is fatal.
 func (rec *GenericRecord) LocationListLength() int {
-	vlocsize := ValueLocationBytes()
+	vlocsize := 3 * rec.usz
 	n := rec.vsz/vlocsize
 	rem := rec.vsz - n * vlocsize
 	if rem != 0 {FmtErrPartialLocationData(vlocsize, rec.vsz).Fatal()}
@@ -472,12 +512,22 @@ func (vloc *ValueLocation) FromIndexRecord(irec *IndexRecord, fnum LBUINT) {
 	vloc.fnum = fnum
 	vloc.vsz = irec.vsz
 	vloc.vpos = irec.vpos
+	vloc.expiry = irec.expiry
 	return
 }
 
+// Return the location of the entire logfile record for the index record.
+func (irec *IndexRecord) ToRecordLocation(lfile *Logfile) *RecordLocation {
+	vloc := NewValueLocation()
+	vloc.FromIndexRecord(irec, lfile.fnum)
+	return vloc.ToRecordLocation(irec.ksz, lfile.UintSize(), lfile.StampSize())
+}
+
+// Point the zap record at the record for the value location, which must be in
+// a logfile of the current format, such as the live log.
 func (zrec *ZapRecord) FromValueLocation(ksz LBUINT, vloc *ValueLocation) {
 	zrec.fnum = vloc.fnum
-	rloc := vloc.ToRecordLocation(ksz)
+	rloc := vloc.ToRecordLocation(ksz, LBUINT_SIZE, STAMP_SIZE)
 	zrec.rsz = rloc.rsz
 	zrec.rpos = rloc.rpos
 	return
@@ -494,8 +544,10 @@ func (vloc *ValueLocation) ToValue(vbyts []byte, vtype LBTYPE) *Value {
 // Map GenericRecord to a new LogRecord.
 func (rec *GenericRecord) ToLogRecord(debug *gubed.Logger) *LogRecord {
 	lrec := NewLogRecord()
+	lrec.usz = rec.usz
+	lrec.ssz = rec.ssz
 	lrec.ksz = rec.ksz
-	lrec.vsz = rec.vsz - CRC_SIZE
+	lrec.vsz = rec.vsz - CRC_SIZE - rec.ssz
 	lrec.kbyts = rec.kbyts
 	lrec.ktype = rec.ktype
 	lrec.vtype = rec.vtype
@@ -504,6 +556,29 @@ func (rec *GenericRecord) ToLogRecord(debug *gubed.Logger) *LogRecord {
 	// Note that the generic vsz includes the LBTYPE prefix
 	lrec.vbyts = make([]byte, int(lrec.vsz) - LBTYPE_SIZE) // must have fixed size
 	debug.DecodeError(binary.Read(bfr, BIGEND, &lrec.vbyts))
+	if rec.ssz > 0 {debug.DecodeError(ReadStamp(bfr, lrec.Stamp))}
+	debug.DecodeError(binary.Read(bfr, BIGEND, &lrec.crc))
+	return lrec
+}
+
+// Decode a whole log record, as stored with the given number of bytes per
+// LBUINT and per stamp.  If the stored sizes do not fit the bytes, only the
+// sizes are filled in, and the record will not verify.
+func BytesToLogRecord(byts []byte, usz, ssz LBUINT, debug *gubed.Logger) *LogRecord {
+	lrec := NewLogRecord()
+	lrec.usz = usz
+	lrec.ssz = ssz
+	if LBUINT(len(byts)) < 2 * usz {return lrec}
+	bfr := bytes.NewBuffer(byts)
+	var gvsz LBUINT
+	debug.DecodeError(ReadLBUINT(bfr, usz, &lrec.ksz))
+	debug.DecodeError(ReadLBUINT(bfr, usz, &gvsz))
+	if gvsz >= CRC_SIZE + ssz {lrec.vsz = gvsz - CRC_SIZE - ssz}
+	tsz := LBUINT(LBTYPE_SIZE)
+	if lrec.ksz < tsz || lrec.vsz < tsz || LBUINT(bfr.Len()) != lrec.ksz + gvsz {return lrec}
+	lrec.kbyts, lrec.ktype = SnipKeyType(bfr.Next(int(lrec.ksz)), debug)
+	lrec.vbyts, lrec.vtype = SnipValueType(bfr.Next(int(lrec.vsz)), debug)
+	if ssz > 0 {debug.DecodeError(ReadStamp(bfr, lrec.Stamp))}
 	debug.DecodeError(binary.Read(bfr, BIGEND, &lrec.crc))
 	return lrec
 }
@@ -516,8 +591,9 @@ func (rec *GenericRecord) ToIndexRecord(debug *gubed.Logger) *IndexRecord {
 	irec.ktype = rec.ktype
 	// Unpack
 	bfr := bufio.NewReader(bytes.NewBuffer(rec.vbyts))
-	debug.DecodeError(binary.Read(bfr, BIGEND, &irec.vsz))
-	debug.DecodeError(binary.Read(bfr, BIGEND, &irec.vpos))
+	debug.DecodeError(ReadLBUINT(bfr, rec.usz, &irec.vsz))
+	debug.DecodeError(ReadLBUINT(bfr, rec.usz, &irec.vpos))
+	if rec.ssz > 0 {debug.DecodeError(ReadStamp(bfr, irec.Stamp))}
 	return irec
 }
 
@@ -528,6 +604,10 @@ func (lrec *LogRecord) ToIndexRecord(debug *gubed.Logger) *IndexRecord {
 	irec.vsz = lrec.vsz
 	irec.kbyts = lrec.kbyts
 	irec.ktype = lrec.ktype
+	*irec.Stamp = *lrec.Stamp
+	if lrec.vtype == LBTYPE_EXPIRY {
+		_, _, irec.expiry = UnwrapValue(lrec.vbyts, lrec.vtype, debug)
+	}
 	return irec
 }
 
@@ -539,12 +619,26 @@ func (rec *GenericRecord) ToValueLocation(debug *gubed.Logger) (interface{}, *Va
 	vloc := NewValueLocation()
 	// Unpack
 	bfr := bufio.NewReader(bytes.NewBuffer(vbyts))
-	debug.DecodeError(binary.Read(bfr, BIGEND, &vloc.fnum))
-	debug.DecodeError(binary.Read(bfr, BIGEND, &vloc.vsz))
-	debug.DecodeError(binary.Read(bfr, BIGEND, &vloc.vpos))
+	debug.DecodeError(ReadLBUINT(bfr, rec.usz, &vloc.fnum))
+	debug.DecodeError(ReadLBUINT(bfr, rec.usz, &vloc.vsz))
+	debug.DecodeError(ReadLBUINT(bfr, rec.usz, &vloc.vpos))
 	return key, vloc
 }
 
+// Map GenericRecord to a new Checkpoint.
+func (rec *GenericRecord) ToCheckpoint(debug *gubed.Logger) *Checkpoint {
+	vbyts, _ := rec.GetValueAndType(MASTER_RECORD, debug)
+	cp := &Checkpoint{}
+	var seq LBUINT
+	// Unpack
+	bfr := bufio.NewReader(bytes.NewBuffer(vbyts))
+	debug.DecodeError(ReadLBUINT(bfr, rec.usz, &cp.fnum))
+	debug.DecodeError(ReadLBUINT(bfr, rec.usz, &seq)) // 0 before format v3
+	debug.DecodeError(ReadLBUINT(bfr, rec.usz, &cp.pos))
+	cp.seq = uint64(seq)
+	return cp
+}
+
 // Map GenericRecord to a new ZapRecord list.
 func (rec *GenericRecord) ToZapRecordList(debug *gubed.Logger) (interface{}, []*ZapRecord) {
 	key, err := MakeKey(rec.kbyts, rec.ktype, debug)
@@ -554,9 +648,9 @@ func (rec *GenericRecord) ToZapRecordList(debug *gubed.Logger) (interface{}, []*
 	var zrecs = make([]*ZapRecord, n)
 	for i := 0; i < n; i++ {
 		zrecs[i] = NewZapRecord()
-	    debug.DecodeError(binary.Read(bfr, BIGEND, &zrecs[i].fnum))
-	    debug.DecodeError(binary.Read(bfr, BIGEND, &zrecs[i].rsz))
-	    debug.DecodeError(binary.Read(bfr, BIGEND, &zrecs[i].rpos))
+	    debug.DecodeError(ReadLBUINT(bfr, rec.usz, &zrecs[i].fnum))
+	    debug.DecodeError(ReadLBUINT(bfr, rec.usz, &zrecs[i].rsz))
+	    debug.DecodeError(ReadLBUINT(bfr, rec.usz, &zrecs[i].rpos))
 	}
 	return key, zrecs
 }
@@ -613,25 +707,27 @@ func (rec *GenericRecord) String() string {
 // Return string representation of a GenericRecord for debugging.
 func (lrec *LogRecord) String() string {
 	return fmt.Sprintf(
-		"(ksz=%d vsz=%d key=%q ktype=%d val=%q vtype=%d crc=%d)",
+		"(ksz=%d vsz=%d key=%q ktype=%d val=%q vtype=%d seq=%d crc=%d)",
 		lrec.ksz,
 		lrec.vsz,
 		string(lrec.kbyts),
 		lrec.ktype,
 		string(lrec.vbyts),
 		lrec.vtype,
+		lrec.seq,
 		lrec.crc)
 }
 
 // Return string representation of an IndexRecord.
 func (irec *IndexRecord) String() string {
 	return fmt.Sprintf(
-		"(ksz=%d vpos=%d vsz=%d key=%q ktype=%d)",
+		"(ksz=%d vpos=%d vsz=%d key=%q ktype=%d seq=%d)",
 		irec.ksz,
 		irec.vpos,
 		irec.vsz,
 		string(irec.kbyts),
-		irec.ktype)
+		irec.ktype,
+		irec.seq)
 }
 
 // Return string representation of a ValueLocation.
@@ -700,8 +796,10 @@ func (vloc *ValueLocation) Logfile(lbase *Logbase) (*Logfile, error) {
 func (vloc *ValueLocation) ReadVal(lbase *Logbase) (val []byte, vtype LBTYPE, err error) {
 	lfile, err := vloc.Logfile(lbase)
 	if err != nil {return}
-	vbyts, err := lfile.ReadVal(vloc.vpos, vloc.vsz)
+	vbyts, err := lbase.ReadLogfileVal(lfile, vloc.vpos, vloc.vsz)
+	if err != nil {return}
 	val, vtype = SnipValueType(vbyts, lbase.debug)
+	val, vtype, _, err = lbase.UnpackValue(val, vtype)
 	return
 }
 
@@ -727,26 +825,52 @@ func MakeLogRecord(key interface{}, val []byte, vtype LBTYPE, debug *gubed.Logge
 
 // Return a byte slice with a log record packed ready for file writing.
 func (lrec *LogRecord) Pack() []byte {
+	bfr := bytes.NewBuffer(lrec.packWithoutChecksum())
+	// Calculate the checksum
+	lrec.crc = crc32.ChecksumIEEE(bfr.Bytes())
+	binary.Write(bfr, BIGEND, lrec.crc)
+	return bfr.Bytes()
+}
+
+// Return a byte slice with all of the log record other than the checksum.
+func (lrec *LogRecord) packWithoutChecksum() []byte {
 	bfr := new(bytes.Buffer)
-	binary.Write(bfr, BIGEND, lrec.ksz)
-	binary.Write(bfr, BIGEND, lrec.vsz + CRC_SIZE)
+	WriteLBUINT(bfr, lrec.usz, lrec.ksz)
+	WriteLBUINT(bfr, lrec.usz, lrec.vsz + lrec.ssz + CRC_SIZE)
 	bfr.Write(InjectType(lrec.kbyts, lrec.ktype))
 	bfr.Write(InjectType(lrec.vbyts, lrec.vtype))
-
-	// Calculate the checksum
-	lrec.crc = LBUINT(crc32.ChecksumIEEE(bfr.Bytes()))
-	binary.Write(bfr, BIGEND, lrec.crc)
+	if lrec.ssz > 0 {WriteStamp(bfr, lrec.Stamp)}
 	return bfr.Bytes()
 }
 
+// Calculate the checksum of the log record, without changing the stored crc.
+func (lrec *LogRecord) Checksum() uint32 {
+	return crc32.ChecksumIEEE(lrec.packWithoutChecksum())
+}
+
+// Does the stored crc match the record data?
+func (lrec *LogRecord) Verify() bool {
+	return lrec.crc == lrec.Checksum()
+}
+
 // Return a byte slice with a log file index record packed ready for file
 // writing.
 func (irec *IndexRecord) Pack() []byte {
 	bfr := new(bytes.Buffer)
+	if irec.expiry != 0 {
+		// Marker carrying the expiry
+		binary.Write(bfr, BIGEND, LBUINT(LBTYPE_SIZE) + EXPIRY_SIZE)
+		binary.Write(bfr, BIGEND, LBTYPE_EXPIRY)
+		binary.Write(bfr, BIGEND, irec.expiry)
+		binary.Write(bfr, BIGEND, LBUINT(0))
+		binary.Write(bfr, BIGEND, irec.vpos)
+		WriteStamp(bfr, &Stamp{})
+	}
 	binary.Write(bfr, BIGEND, irec.ksz)
 	bfr.Write(InjectType(irec.kbyts, irec.ktype))
 	binary.Write(bfr, BIGEND, irec.vsz)
 	binary.Write(bfr, BIGEND, irec.vpos)
+	WriteStamp(bfr, irec.Stamp)
 	return bfr.Bytes()
 }
 
@@ -755,7 +879,7 @@ func PackZapRecord(key interface{}, zrecs []*ZapRecord, debug *gubed.Logger) []b
 	bfr := new(bytes.Buffer)
 	kbyts := InjectKeyType(key, debug)
 	ksz := AsLBUINT(len(kbyts))
-	vsz := AsLBUINT(len(zrecs)) * ValueLocationBytes()
+	vsz := AsLBUINT(len(zrecs)) * ZAPLOC_SIZE
 	binary.Write(bfr, BIGEND, ksz)
 	binary.Write(bfr, BIGEND, vsz)
 	bfr.Write(kbyts)
@@ -776,6 +900,27 @@ func (vloc *ValueLocation) Pack(key interface{}, debug *gubed.Logger) []byte {
 	binary.Write(bfr, BIGEND, vloc.fnum)
 	binary.Write(bfr, BIGEND, vloc.vsz)
 	binary.Write(bfr, BIGEND, vloc.vpos)
+	if vloc.expiry != 0 {
+		// A second record for the key carries the expiry
+		bfr.Write(byts)
+		binary.Write(bfr, BIGEND, LBTYPE_EXPIRY)
+		binary.Write(bfr, BIGEND, LBUINT(vloc.expiry))
+		binary.Write(bfr, BIGEND, LBUINT(0))
+		binary.Write(bfr, BIGEND, LBUINT(0))
+	}
+	return bfr.Bytes()
+}
+
+// Return a byte slice with a Checkpoint packed as a master record with an
+// empty key, ready for file writing.
+func (cp *Checkpoint) Pack() []byte {
+	bfr := new(bytes.Buffer)
+	binary.Write(bfr, BIGEND, AsLBUINT(LBTYPE_SIZE))
+	binary.Write(bfr, BIGEND, LBTYPE_CHECKPOINT)
+	binary.Write(bfr, BIGEND, LBTYPE_VALOC)
+	binary.Write(bfr, BIGEND, cp.fnum)
+	binary.Write(bfr, BIGEND, LBUINT(cp.seq))
+	binary.Write(bfr, BIGEND, cp.pos)
 	return bfr.Bytes()
 }
 
@@ -825,16 +970,27 @@ func ParamSize(param interface{}) LBUINT {
 }
 
 // ValueLocations do not explicitely hold the start position and length
-// of an entire logfile record, just the value, but along with the key we have
-// enough to figure this out.
-func (vloc *ValueLocation) ToRecordLocation(ksz LBUINT) *RecordLocation {
+// of an entire logfile record, just the value, but along with the key and the
+// number of bytes per LBUINT and per stamp in the logfile we have enough to
+// figure this out.
+func (vloc *ValueLocation) ToRecordLocation(ksz, usz, ssz LBUINT) *RecordLocation {
 	rloc := NewRecordLocation()
 	rloc.fnum = vloc.fnum
-	rloc.rsz = LBUINT_SIZE_x2 + ksz + vloc.vsz + CRC_SIZE
-	rloc.rpos = vloc.vpos - ksz - LBUINT_SIZE_x2
+	rloc.rsz = 2 * usz + ksz + vloc.vsz + ssz + CRC_SIZE
+	rloc.rpos = vloc.vpos - ksz - 2 * usz
 	return rloc
 }
 
+// Return the location of the entire logfile record for the value location,
+// allowing for the format of the logfile.
+func (lbase *Logbase) RecordLocation(vloc *ValueLocation, ksz LBUINT) *RecordLocation {
+	usz, ssz := LBUINT_SIZE, STAMP_SIZE
+	if lfile, err := vloc.Logfile(lbase); err == nil {
+		usz, ssz = lfile.UintSize(), lfile.StampSize()
+	}
+	return vloc.ToRecordLocation(ksz, usz, ssz)
+}
+
 // Zapping.
 
 // LBUINT division.
@@ -873,6 +1029,58 @@ func InvertSequence(zpos, zsz []LBUINT, size int) (pos, sz []LBUINT) {
 	return
 }
 
+// The positions and sizes of the records zapped from a logfile, used to map
+// positions in the original file to positions in the zapped file.
+type Zaplists struct {
+	rpos	[]LBUINT // sorted record positions
+	rsz		[]LBUINT // record sizes
+	cum		[]LBUINT // cumulative sizes up to and including each record
+}
+
+// Init a Zaplists from sorted record positions and sizes.
+func NewZaplists(rpos, rsz []LBUINT) *Zaplists {
+	zl := &Zaplists{rpos: rpos, rsz: rsz, cum: make([]LBUINT, len(rsz))}
+	var sum LBUINT = 0
+	for i, sz := range rsz {
+		sum += sz
+		zl.cum[i] = sum
+	}
+	return zl
+}
+
+// Number of bytes zapped.
+func (zl *Zaplists) Size() LBUINT {
+	if len(zl.cum) == 0 {return 0}
+	return zl.cum[len(zl.cum) - 1]
+}
+
+// Return the position in the zapped file corresponding to the given position
+// in the original file, and whether the position lies within a zapped record.
+// A position within a zapped record maps to the position of the gap it left.
+func (zl *Zaplists) Shift(pos LBUINT) (LBUINT, bool) {
+	// Find the first zapped record that ends after pos
+	i := sort.Search(len(zl.rpos), func(i int) bool {
+		return zl.rpos[i] + zl.rsz[i] > pos
+	})
+	var shift LBUINT = 0
+	if i > 0 {shift = zl.cum[i-1]}
+	if i < len(zl.rpos) && zl.rpos[i] <= pos {return zl.rpos[i] - shift, true}
+	return pos - shift, false
+}
+
+// Return a new index for the zapped file, leaving out zapped records.
+func (zl *Zaplists) RemapIndex(lfindex *Index) *Index {
+	result := new(Index)
+	for _, irec := range lfindex.List {
+		vpos, zapped := zl.Shift(irec.vpos)
+		if zapped {continue}
+		newirec := *irec
+		newirec.vpos = vpos
+		result.List = append(result.List, &newirec)
+	}
+	return result
+}
+
 // Remove adjacent duplicates from the given slice.
 func RemoveAdjacentDuplicates(a []LBUINT) (b []LBUINT) {
 	var idups []int
@@ -920,6 +1128,32 @@ func (zmap *Zapmap) Find(fnum LBUINT) (rpos, rsz []LBUINT, err error) {
 	return
 }
 
+// Delete the zapmap records of the given logfile that were zapped, and
+// shift the rest to their positions in the zapped file.
+func (zmap *Zapmap) PurgeZapped(fnum LBUINT, zl *Zaplists, debug *gubed.Logger) {
+	debug.Basic("Purge zapmap of zapped logfile %d entries", fnum)
+	for key, zrecs := range zmap.zapmap {
+		var newzrecs []*ZapRecord
+		for _, zrec := range zrecs {
+			if zrec.fnum == fnum {
+				rpos, zapped := zl.Shift(zrec.rpos)
+				if zapped {
+					debug.Fine("Deleting %q%s from zapmap", key, zrec.String())
+					continue
+				}
+				zrec.rpos = rpos
+			}
+			newzrecs = append(newzrecs, zrec)
+		}
+		if len(newzrecs) == 0 {
+			zmap.Delete(key)
+		} else {
+			zmap.Put(key, newzrecs)
+		}
+	}
+	return
+}
+
 // Delete all zapmap records associated with the given logfile number.
 func (zmap *Zapmap) Purge(fnum LBUINT, debug *gubed.Logger) {
 	debug.Basic("Purge zapmap of logfile %d entries", fnum)
@@ -41,6 +41,21 @@ const (
 	NODE_TYPE_SEPARATOR string = ":"
 )
 
+// Sizes within a node value.  These are independent of the file format, and
+// stay at 32 bits so that nodes written under format v1 still decode.
+type NODESIZE uint32
+
+const NODESIZE_MAX int64 = 4294967295
+
+// Convert the size, returning an error rather than exiting if it does not
+// fit.
+func AsNODESIZE(num int) (NODESIZE, error) {
+	if num < 0 || int64(num) > NODESIZE_MAX {
+		return 0, FmtErrOutsideRange(num, NODESIZE_MAX)
+	}
+	return NODESIZE(num), nil
+}
+
 type NodeConfig struct {
 	namespace	string
 }
@@ -114,7 +129,7 @@ func (node *Node) ReadCheckType(bfr *bytes.Buffer, reqtyp LBTYPE, nilok bool, de
 }
 
 func (node *Node) ReadSizedBytes(bfr *bytes.Buffer) (byts []byte, err error) {
-	var size LBUINT
+	var size NODESIZE
 	err = node.debug.DecodeError(binary.Read(bfr, BIGEND, &size))
     if err != nil {return}
 	byts = make([]byte, int(size))
@@ -141,22 +156,23 @@ func (node *Node) ReadCATIDSet(bfr *bytes.Buffer) (err error) {
 }
 
 // Return a byte slice with a Node packed ready for file writing.
-func (node *Node) Pack() []byte {
+func (node *Node) Pack() ([]byte, error) {
 	bfr := new(bytes.Buffer)
 	// Write CATID
 	binary.Write(bfr, BIGEND, LBTYPE_CATID)
 	binary.Write(bfr, BIGEND, node.Id())
 	// Write  Catalog string key
 	binary.Write(bfr, BIGEND, LBTYPE_CATKEY)
-	ksz := AsLBUINT(len(node.Name()))
+	ksz, err := AsNODESIZE(len(node.Name()))
+	if err != nil {return nil, err}
 	binary.Write(bfr, BIGEND, ksz)
 	bfr.Write([]byte(node.Name()))
 	// Write field map
 	if node.HasFields() > 0 {
 		binary.Write(bfr, BIGEND, LBTYPE_MAP)
-		byts := node.FieldMap.ToBytes(node.debug)
-		binary.Write(bfr, BIGEND, AsLBUINT(len(byts)))
-		bfr.Write(byts)
+		byts, err := node.FieldMap.ToBytes(node.debug)
+		if err != nil {return nil, err}
+		if err = WriteSized(bfr, byts); err != nil {return nil, err}
 	} else {
 		binary.Write(bfr, BIGEND, LBTYPE_NIL)
 	}
@@ -164,12 +180,20 @@ func (node *Node) Pack() []byte {
 	if node.HasParents() > 0 {
 		binary.Write(bfr, BIGEND, LBTYPE_CATID_SET)
 		byts := node.parents.ToBytes(node.debug)
-		binary.Write(bfr, BIGEND, AsLBUINT(len(byts)))
-		bfr.Write(byts)
+		if err = WriteSized(bfr, byts); err != nil {return nil, err}
 	} else {
 		binary.Write(bfr, BIGEND, LBTYPE_NIL)
 	}
-	return bfr.Bytes()
+	return bfr.Bytes(), nil
+}
+
+// Write the bytes to the buffer, preceded by their size.
+func WriteSized(bfr *bytes.Buffer, byts []byte) error {
+	sz, err := AsNODESIZE(len(byts))
+	if err != nil {return err}
+	binary.Write(bfr, BIGEND, sz)
+	bfr.Write(byts)
+	return nil
 }
 
 // Unpack Node bytes.
@@ -243,7 +267,7 @@ func NormaliseNodeName(name string, ntype LBTYPE) string {
 func (lbase *Logbase) NewNode(name string, ntype LBTYPE, create bool) (node *Node, exists bool, err error) {
 	// Check cache
 	normname := NormaliseNodeName(name, ntype)
-	obj, present := lbase.NodeCache().objects[normname]
+	obj, present := lbase.NodeCache().Get(normname)
 	if present {return obj.(*Node), true, nil}
 
 	vbyts, vtype, mcr_name, err := lbase.Get(normname)
@@ -283,21 +307,29 @@ func (lbase *Logbase) NewNode(name string, ntype LBTYPE, create bool) (node *Nod
 		node.mcr_name = mcr_name
 		node.FromBytes(bytes.NewBuffer(vbyts))
 	}
-	// Add to cache
-	lbase.NodeCache().objects[normname] = node
+	// Add to cache, unless another caller got there first
+	obj, present = lbase.NodeCache().GetOrMake(normname,
+		func() interface{} {return node})
+	if present {return obj.(*Node), true, nil}
 	return
 }
 
 // Save two records, the first maps the node CATID to its complete binary
 // representation, the second maps the name string to the parents set.
+// The node and its name to CATID mapping are written in a single batch, so
+// that neither can be left without the other.
 func (node *Node) Save(lbase *Logbase) error {
 	lbase.debug.Basic("Saving %q to logbase %s", node.Name(), lbase.Name())
-	mcr_id, err := lbase.Put(node.CATID().id, node.Pack(), LBTYPE_KIND)
-	node.mcr_id = mcr_id
+	vbyts, err := node.Pack()
+	if node.debug.Error(err) != nil {return err}
+	batch := lbase.NewWriteBatch()
+	batch.Put(node.CATID().id, vbyts, LBTYPE_KIND)
+	batch.Put(node.Name(), node.CATID().ToBytes(node.debug), LBTYPE_CATID)
+	err = batch.Commit()
 	if node.debug.Error(err) != nil {return err}
-	mcr_name, err := lbase.Put(node.Name(), node.CATID().ToBytes(node.debug), LBTYPE_CATID)
-	node.mcr_name = mcr_name
-	return node.debug.Error(err)
+	node.mcr_id = lbase.mcat.Get(node.CATID().id)
+	node.mcr_name = lbase.mcat.Get(node.Name())
+	return nil
 }
 
 func (node *Node) String() string {
@@ -402,24 +434,22 @@ func (node *Node) SetFieldWithType(label string, val interface{}, vtype LBTYPE)
 	return node
 }
 
-func (fmap *FieldMap) ToBytes(debug *gubed.Logger) []byte {
+func (fmap *FieldMap) ToBytes(debug *gubed.Logger) ([]byte, error) {
 	bfr := new(bytes.Buffer)
-	var vsz LBUINT
-	var lbyts []byte
 	for label, field := range fmap.fields {
-		lbyts = []byte(label)
-		binary.Write(bfr, BIGEND, AsLBUINT(len(lbyts))) // label size
-		bfr.Write(lbyts) // label
-		vsz = AsLBUINT(len(field.vbyts)) + LBUINT(LBTYPE_SIZE)
+		err := WriteSized(bfr, []byte(label)) // label size, label
+		if err != nil {return nil, err}
+		vsz, err := AsNODESIZE(len(field.vbyts) + LBTYPE_SIZE)
+		if err != nil {return nil, err}
 		binary.Write(bfr, BIGEND, vsz) // value size, including LBTYPE
 		binary.Write(bfr, BIGEND, field.vtype) // LBTYPE
 		bfr.Write(field.vbyts) // value
 	}
-	return bfr.Bytes()
+	return bfr.Bytes(), nil
 }
 
 func (fmap *FieldMap) FromBytes(bfr *bytes.Buffer, debug *gubed.Logger) (err error) {
-	var size LBUINT
+	var size NODESIZE
 	var label string
 	var vtype LBTYPE
 	var bits []byte
@@ -484,16 +514,14 @@ func (lbase *Logbase) FindOfKind(name string, ntype LBTYPE) []*Node {
 			FmtErrKeyNotFound(NormaliseNodeName(name, LBTYPE_KIND)))
 		return nil
 	}
-	var basename string
-	var typ LBTYPE
-	for key, _ := range lbase.mcat.index {
-        basename, typ = GetNodeNameType(key)
-		if typ == ntype {
-			node, _, err := lbase.NewNode(basename, ntype, true)
-			lbase.debug.Error(err)
-			if err == nil && node.Parents().Contains(kind.CATID()) {
-				result = append(result, node)
-			}
+	// Node keys of the type are those under its namespace prefix
+	prefix := NodeConfigs[ntype].namespace + NODE_TYPE_SEPARATOR
+	for _, key := range lbase.Iterator().Prefix(prefix).Keys() {
+		basename := strings.TrimPrefix(key.(string), prefix)
+		node, _, err := lbase.NewNode(basename, ntype, true)
+		lbase.debug.Error(err)
+		if err == nil && node.Parents().Contains(kind.CATID()) {
+			result = append(result, node)
 		}
 	}
 	return result
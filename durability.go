@@ -0,0 +1,167 @@
+/*
+	Durability of writes to the log files.
+
+	The DURABILITY setting chooses between speed and safety:
+
+	"always"	Each Put or Delete returns only once its record has been
+				synced to disk.  Writers waiting at the same time share a
+				single sync (group commit), so the cost of a sync is spread
+				across concurrent writers.
+	"interval"	The log files are synced every SYNC_INTERVAL_MS in the
+				background, so at most that much acknowledged data can be lost.
+	"os"		Syncing is left to the operating system.
+
+	Write batches always sync their commit marker, whatever the setting.
+*/
+package logbase
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	DURABILITY_ALWAYS	string = "always"
+	DURABILITY_INTERVAL	string = "interval"
+	DURABILITY_OS		string = "os"
+)
+
+// Tracks writes to the log files, and syncs them on demand.
+type Syncer struct {
+	lbase		*Logbase
+	sync.Mutex
+	synced		*sync.Cond // signalled at the end of each sync
+	written		uint64 // number of writes so far
+	durable		uint64 // number of writes known to be on disk
+	syncing		bool // is a sync in progress?
+	dirty		map[*File]bool // files written since the last sync
+	nsyncs		int // number of syncs made
+	stop		chan bool
+	done		chan bool
+}
+
+// Init a Syncer.
+func NewSyncer(lbase *Logbase) *Syncer {
+	syncer := &Syncer{
+		lbase:	lbase,
+		dirty:	make(map[*File]bool),
+	}
+	syncer.synced = sync.NewCond(&syncer.Mutex)
+	return syncer
+}
+
+// Number of syncs made so far.
+func (syncer *Syncer) Syncs() int {
+	syncer.Lock()
+	defer syncer.Unlock()
+	return syncer.nsyncs
+}
+
+// Record a write to the file, returning its sequence number.
+func (syncer *Syncer) Written(file *File) uint64 {
+	syncer.Lock()
+	defer syncer.Unlock()
+	syncer.written++
+	syncer.dirty[file] = true
+	return syncer.written
+}
+
+// Sequence number of the last write.
+func (syncer *Syncer) Last() uint64 {
+	syncer.Lock()
+	defer syncer.Unlock()
+	return syncer.written
+}
+
+// Wait until the write with the given sequence number is on disk, syncing
+// if no other writer is already doing so.  A sync covers every write made
+// before it started.
+func (syncer *Syncer) WaitFor(seq uint64) error {
+	syncer.Lock()
+	defer syncer.Unlock()
+	for syncer.durable < seq {
+		if syncer.syncing {
+			syncer.synced.Wait()
+			continue
+		}
+		if err := syncer.flush(); err != nil {return err}
+	}
+	return nil
+}
+
+// Sync everything written so far.
+func (syncer *Syncer) SyncNow() error {
+	return syncer.WaitFor(syncer.Last())
+}
+
+// Sync the dirty files.  Called with the syncer locked, which is released
+// during the sync itself so that more writes can queue up behind it.
+func (syncer *Syncer) flush() (err error) {
+	syncer.syncing = true
+	target := syncer.written
+	files := syncer.dirty
+	syncer.dirty = make(map[*File]bool)
+	syncer.Unlock()
+	for file := range files {
+		if ferr := file.Sync(); ferr != nil && err == nil {err = ferr}
+	}
+	syncer.Lock()
+	if err == nil {
+		syncer.durable = target
+	} else {
+		for file := range files {syncer.dirty[file] = true}
+	}
+	syncer.nsyncs++
+	syncer.syncing = false
+	syncer.synced.Broadcast()
+	return syncer.lbase.debug.Error(err)
+}
+
+// Start syncing in the background at the given interval.
+func (syncer *Syncer) Start(interval time.Duration) {
+	if syncer.stop != nil {return}
+	syncer.stop = make(chan bool)
+	syncer.done = make(chan bool)
+	go func() {
+		defer close(syncer.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-syncer.stop:
+				return
+			case <-ticker.C:
+				syncer.SyncNow()
+			}
+		}
+	}()
+}
+
+// Stop any background syncing, then sync everything written so far.
+func (syncer *Syncer) Stop() error {
+	if syncer.stop != nil {
+		close(syncer.stop)
+		<-syncer.done
+		syncer.stop = nil
+	}
+	return syncer.SyncNow()
+}
+
+func (syncer *Syncer) String() string {
+	syncer.Lock()
+	defer syncer.Unlock()
+	return fmt.Sprintf(
+		"(written=%d durable=%d nsyncs=%d)",
+		syncer.written,
+		syncer.durable,
+		syncer.nsyncs)
+}
+
+// Wait until the last write is durable, if the configuration requires it.
+// Called by writers after releasing the logbase lock, so that writers can
+// share a sync.
+func (lbase *Logbase) WaitDurable(seq uint64) error {
+	if lbase.config.DURABILITY != DURABILITY_ALWAYS {return nil}
+	return lbase.syncer.WaitFor(seq)
+}
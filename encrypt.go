@@ -0,0 +1,273 @@
+/*
+	Encryption of values at rest.
+
+	With ENCRYPTION_PASSPHRASE or ENCRYPTION_KEYFILE set, each value is sealed
+	with AES-256-GCM as it is stored.  The key is derived from the passphrase,
+	or from the contents of the key file, with PBKDF2-HMAC-SHA256 and a random
+	salt kept in the .keysalt file of the logbase.  The log record then has the
+	value type LBTYPE_ENCRYPTED, followed by the id of the key, a random nonce
+	and the sealed LBTYPE and bytes of the value, ending with the GCM tag,
+	which is verified as the value is read.  A value is compressed before it
+	is sealed, and a time-to-live is wrapped around the sealed value, since
+	the expiry is also held in the index.  Keys, tombstones, index, catalog
+	and zapmap files are stored in the clear.
+
+	To rotate keys, set the new passphrase or key file and list the old ones
+	under ENCRYPTION_OLD_PASSPHRASES or ENCRYPTION_OLD_KEYFILES, so that
+	values sealed with them can still be read.  Rekey seals the live log and
+	merges all sealed logfiles, and a merge writes every value it copies
+	under the current key, or in the clear if encryption has been turned off.
+	The compactor runs Rekey while old keys are listed, until a pass finds no
+	logfile pinned by a snapshot.  Once done, the old keys can be dropped.
+*/
+package logbase
+
+import (
+	"github.com/h00gs/gubed"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+)
+
+const (
+	ENCRYPTION_KEY_SIZE		int = 32 // AES-256
+	ENCRYPTION_KEYID_SIZE	int = 8
+	ENCRYPTION_NONCE_SIZE	int = 12
+	ENCRYPTION_SALT_SIZE	int = 16
+	ENCRYPTION_KDF_ROUNDS	int = 65536
+)
+
+// A key for sealing values, with its id.
+type cryptKey struct {
+	id		uint64 // from the start of the SHA-256 of the key
+	aead	cipher.AEAD
+}
+
+// The keys of a logbase, the current one for sealing values, and any old
+// ones still needed to open them.
+type Keyring struct {
+	current		*cryptKey // nil if values are stored in the clear
+	keys		map[uint64]*cryptKey // by id, the current key included
+}
+
+// Derive the keys set in the configuration, making the salt file if it is
+// missing.  Returns nil if no keys are set.
+func (lbase *Logbase) LoadKeyring() (ring *Keyring, err error) {
+	cfg := lbase.config
+	if cfg.ENCRYPTION_PASSPHRASE != "" && cfg.ENCRYPTION_KEYFILE != "" {
+		return nil, FmtErrBadArgs(
+			"Set either ENCRYPTION_PASSPHRASE or ENCRYPTION_KEYFILE for " +
+			"logbase %q, not both", lbase.name)
+	}
+	var secret []byte
+	if cfg.ENCRYPTION_PASSPHRASE != "" {
+		secret = []byte(cfg.ENCRYPTION_PASSPHRASE)
+	} else if cfg.ENCRYPTION_KEYFILE != "" {
+		secret, err = lbase.ReadKeyfile(cfg.ENCRYPTION_KEYFILE)
+		if err != nil {return}
+	}
+	var olds [][]byte
+	for _, pass := range cfg.ENCRYPTION_OLD_PASSPHRASES {
+		olds = append(olds, []byte(pass))
+	}
+	for _, kpath := range cfg.ENCRYPTION_OLD_KEYFILES {
+		var old []byte
+		old, err = lbase.ReadKeyfile(kpath)
+		if err != nil {return}
+		olds = append(olds, old)
+	}
+	if secret == nil && len(olds) == 0 {return nil, nil}
+
+	salt, err := lbase.KeySalt(secret != nil)
+	if err != nil {return}
+	ring = &Keyring{keys: make(map[uint64]*cryptKey)}
+	if secret != nil {
+		ring.current, err = MakeCryptKey(secret, salt)
+		if err != nil {return nil, err}
+		ring.keys[ring.current.id] = ring.current
+	}
+	for _, old := range olds {
+		var ckey *cryptKey
+		ckey, err = MakeCryptKey(old, salt)
+		if err != nil {return nil, err}
+		if ring.keys[ckey.id] == nil {ring.keys[ckey.id] = ckey}
+	}
+	lbase.debug.Advise("Loaded %d encryption keys for logbase %q", len(ring.keys), lbase.name)
+	return
+}
+
+// Read the secret from a key file, whose path is relative to the logbase
+// directory unless absolute.
+func (lbase *Logbase) ReadKeyfile(kpath string) ([]byte, error) {
+	if !filepath.IsAbs(kpath) {kpath = filepath.Join(lbase.abspath, kpath)}
+	secret, err := ioutil.ReadFile(kpath)
+	if err != nil {return nil, lbase.debug.Error(err)}
+	if len(secret) == 0 {
+		return nil, FmtErrEncryptionKey("Key file %q is empty", kpath)
+	}
+	return secret, nil
+}
+
+// Return the salt for deriving keys, making it first if it is missing and
+// makeit is true.
+func (lbase *Logbase) KeySalt(makeit bool) ([]byte, error) {
+	spath := filepath.Join(lbase.abspath, KEYSALT_FILENAME)
+	salt, err := ioutil.ReadFile(spath)
+	if os.IsNotExist(err) && makeit {
+		salt = make([]byte, ENCRYPTION_SALT_SIZE)
+		if _, err = rand.Read(salt); err != nil {return nil, err}
+		err = ioutil.WriteFile(spath, salt, 0600)
+		if lbase.debug.Error(err) != nil {return nil, err}
+		lbase.debug.Advise("Made new key salt file %s", spath)
+		return salt, nil
+	}
+	if os.IsNotExist(err) {
+		return nil, FmtErrEncryptionKey(
+			"Key salt file %q is missing, so old keys cannot be derived", spath)
+	}
+	if err != nil {return nil, lbase.debug.Error(err)}
+	if len(salt) != ENCRYPTION_SALT_SIZE {
+		return nil, FmtErrEncryptionKey(
+			"Key salt file %q holds %d bytes rather than %d",
+			spath, len(salt), ENCRYPTION_SALT_SIZE)
+	}
+	return salt, nil
+}
+
+// Derive a key from the secret and salt.
+func MakeCryptKey(secret, salt []byte) (*cryptKey, error) {
+	key := DeriveKey(secret, salt, ENCRYPTION_KDF_ROUNDS, ENCRYPTION_KEY_SIZE)
+	block, err := aes.NewCipher(key)
+	if err != nil {return nil, err}
+	aead, err := cipher.NewGCMWithNonceSize(block, ENCRYPTION_NONCE_SIZE)
+	if err != nil {return nil, err}
+	sum := sha256.Sum256(key)
+	return &cryptKey{id: BIGEND.Uint64(sum[:ENCRYPTION_KEYID_SIZE]), aead: aead}, nil
+}
+
+// PBKDF2 with HMAC-SHA256, as in RFC 8018.
+func DeriveKey(secret, salt []byte, rounds, size int) []byte {
+	prf := hmac.New(sha256.New, secret)
+	var key []byte
+	ibyts := make([]byte, 4)
+	for block := uint32(1); len(key) < size; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		binary.BigEndian.PutUint32(ibyts, block)
+		prf.Write(ibyts)
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for n := 1; n < rounds; n++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for i := range t {t[i] ^= u[i]}
+		}
+		key = append(key, t...)
+	}
+	return key[:size]
+}
+
+// Is the keyring sealing values?
+func (ring *Keyring) Encrypting() bool {return ring != nil && ring.current != nil}
+
+// Number of bytes sealing adds to a value.
+func (ring *Keyring) Overhead() int {
+	if !ring.Encrypting() {return 0}
+	return ENCRYPTION_KEYID_SIZE + ENCRYPTION_NONCE_SIZE + LBTYPE_SIZE +
+		ring.current.aead.Overhead()
+}
+
+// Does the keyring hold keys other than the current one?
+func (ring *Keyring) HasOldKeys() bool {
+	if ring == nil {return false}
+	if ring.current == nil {return len(ring.keys) > 0}
+	return len(ring.keys) > 1
+}
+
+// Return the value bytes sealed, with their type, under the current key, to
+// be stored with type LBTYPE_ENCRYPTED.  Values are returned as they are if
+// there is no current key.
+func (ring *Keyring) Seal(vbyts []byte, vtype LBTYPE) ([]byte, LBTYPE, error) {
+	if !ring.Encrypting() {return vbyts, vtype, nil}
+	hsz := ENCRYPTION_KEYID_SIZE + ENCRYPTION_NONCE_SIZE
+	head := make([]byte, hsz, hsz + LBTYPE_SIZE + len(vbyts) + ring.current.aead.Overhead())
+	BIGEND.PutUint64(head, ring.current.id)
+	nonce := head[ENCRYPTION_KEYID_SIZE:]
+	if _, err := rand.Read(nonce); err != nil {return nil, LBTYPE_NIL, err}
+	return ring.current.aead.Seal(head, nonce, InjectType(vbyts, vtype), nil), LBTYPE_ENCRYPTED, nil
+}
+
+// Open a value of type LBTYPE_ENCRYPTED, verifying its tag, and return its
+// bytes and type.  Other values are returned as they are.
+func (ring *Keyring) Open(vbyts []byte, vtype LBTYPE, debug *gubed.Logger) ([]byte, LBTYPE, error) {
+	if vtype != LBTYPE_ENCRYPTED {return vbyts, vtype, nil}
+	hsz := ENCRYPTION_KEYID_SIZE + ENCRYPTION_NONCE_SIZE
+	if len(vbyts) < hsz + LBTYPE_SIZE {
+		return nil, LBTYPE_NIL, debug.Error(FmtErrSliceTooSmall(vbyts, hsz + LBTYPE_SIZE))
+	}
+	id := BIGEND.Uint64(vbyts)
+	var ckey *cryptKey
+	if ring != nil {ckey = ring.keys[id]}
+	if ckey == nil {
+		return nil, LBTYPE_NIL, debug.Error(FmtErrEncryptionKey(
+			"No encryption key with id %016x is configured to open the value", id))
+	}
+	nonce := vbyts[ENCRYPTION_KEYID_SIZE:hsz]
+	plain, err := ckey.aead.Open(nil, nonce, vbyts[hsz:], nil)
+	if err != nil {return nil, LBTYPE_NIL, debug.Error(FmtErrDecrypt(id, err))}
+	if len(plain) < LBTYPE_SIZE {
+		return nil, LBTYPE_NIL, debug.Error(FmtErrSliceTooSmall(plain, LBTYPE_SIZE))
+	}
+	val, vtype := SnipValueType(plain, debug)
+	return val, vtype, nil
+}
+
+// Is a value stored as the keyring would seal it now, under the current
+// key, or in the clear if there is none?
+func (ring *Keyring) IsSealed(vbyts []byte, vtype LBTYPE) bool {
+	if !ring.Encrypting() {return vtype != LBTYPE_ENCRYPTED}
+	return vtype == LBTYPE_ENCRYPTED &&
+		len(vbyts) >= ENCRYPTION_KEYID_SIZE &&
+		BIGEND.Uint64(vbyts) == ring.current.id
+}
+
+// Return the log record with its value sealed under the current key, or in
+// the clear if there is none, unless it already is.  The record keeps its
+// key, stamp and any expiry.
+func (lbase *Logbase) Reseal(lrec *LogRecord) (*LogRecord, error) {
+	vbyts, vtype, expiry := UnwrapValue(lrec.vbyts, lrec.vtype, lbase.debug)
+	if lbase.keyring.IsSealed(vbyts, vtype) {return lrec, nil}
+	vbyts, vtype, err := lbase.keyring.Open(vbyts, vtype, lbase.debug)
+	if err != nil {return nil, err}
+	vbyts, vtype, err = lbase.keyring.Seal(vbyts, vtype)
+	if err != nil {return nil, err}
+	if expiry != 0 {
+		vbyts, vtype = WrapExpiry(vbyts, vtype, expiry), LBTYPE_EXPIRY
+	}
+	out := NewLogRecord()
+	out.ksz, out.kbyts, out.ktype = lrec.ksz, lrec.kbyts, lrec.ktype
+	out.vsz = AsLBUINT(len(vbyts) + LBTYPE_SIZE)
+	out.vbyts, out.vtype = vbyts, vtype
+	*out.Stamp = *lrec.Stamp
+	return out, nil
+}
+
+// Rewrite every value held under an old key, or sealed when encryption has
+// been turned off, by sealing the live log and merging every sealed logfile.
+// Logfiles pinned by a snapshot, and any after them, are left as they are.
+func (lbase *Logbase) Rekey() (*MergeReport, error) {
+	lbase.Lock()
+	err := lbase.CheckLiveLog()
+	if err == nil && lbase.livelog.size > 0 {err = lbase.NewLiveLog()}
+	lbase.Unlock()
+	if err != nil {return nil, err}
+	lbase.debug.Basic("Rekeying logbase %q", lbase.name)
+	return lbase.Merge()
+}
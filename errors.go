@@ -129,6 +129,24 @@ func errKeyExists(msg string, jump int) *AppError {
 	return makeAppError(jump).Describe(msg, "key_exists")
 }
 
+// Write conflict.
+
+func FmtErrConflict(key interface{}, expected, actual CatalogRecord) *AppError {
+	return errConflict(fmt.Sprintf(
+		"Conditional write to key %v expected %v but found %v.",
+		key, expected, actual), 1)
+}
+
+func errConflict(msg string, jump int) *AppError {
+	return makeAppError(jump).Describe(msg, "write_conflict")
+}
+
+// Is the error a failed conditional write?
+func IsConflict(err error) bool {
+	aerr, ok := err.(*AppError)
+	return ok && aerr.tag == "write_conflict"
+}
+
 // Value not found.
 
 func FmtErrValNotFound(valstr string) *AppError {
@@ -162,6 +180,51 @@ func errFileNotFound(msg string, jump int) *AppError {
 	return makeAppError(jump).Describe(msg, "file_not_found")
 }
 
+func FmtErrFileMode(path string, flags, current int) *AppError {
+	return makeAppError(1).Describe(fmt.Sprintf(
+		"File %q cannot be opened with flags %#x while it is open " +
+		"with flags %#x.", path, flags, current), "file_mode")
+}
+
+func FmtErrFilePinned(path string) *AppError {
+	return makeAppError(1).Describe(fmt.Sprintf(
+		"File %q is pinned by a snapshot and cannot be rewritten.",
+		path), "file_pinned")
+}
+
+func FmtErrSnapshotReleased() *AppError {
+	return makeAppError(1).Describe(
+		"The snapshot has been released.", "snapshot_released")
+}
+
+// Streamed values.
+
+func FmtErrChunkMissing(key interface{}, i int, id CHUNKID_TYPE) *AppError {
+	return makeAppError(1).Describe(fmt.Sprintf(
+		"Chunk %d (id %d) of the streamed value of key %v is missing or corrupt",
+		i, id, key), "chunk_missing")
+}
+
+func FmtErrReaderClosed() *AppError {
+	return makeAppError(1).Describe(
+		"The value reader has been closed.", "reader_closed")
+}
+
+// Backups.
+
+func FmtErrBackupCorrupt(dir, relpath, msg string) *AppError {
+	return makeAppError(1).Describe(fmt.Sprintf(
+		"File %q in the backup in %q does not match its manifest: %s",
+		relpath, dir, msg), "backup_corrupt")
+}
+
+// Export and import.
+
+func FmtErrBadImport(n int, msg string) *AppError {
+	return makeAppError(1).Describe(fmt.Sprintf(
+		"Could not import key %d: %s", n, msg), "bad_import")
+}
+
 // Bad argument.
 
 func FmtErrBadArgs(msg string, a ...interface{}) *AppError {
@@ -182,6 +245,34 @@ func errBadType(msg string, jump int) *AppError {
 	return makeAppError(jump).Describe(msg, "bad_type")
 }
 
+// Old file format.
+
+func FmtErrOldFormat(path string, version uint8) *AppError {
+	return makeAppError(1).Describe(fmt.Sprintf(
+		"File %q is in format v%d, which can be read but not written. " +
+		"Migrate the logbase to format v%d first.",
+		path, version, FORMAT_CURRENT), "old_format")
+}
+
+// Compression.
+
+func FmtErrDecompress(vtype LBTYPE, in error) *AppError {
+	return makeAppError(1).Describe(fmt.Sprintf(
+		"Could not decompress value of type %d: %s", vtype, in), "decompress")
+}
+
+// Encryption.
+
+func FmtErrEncryptionKey(msg string, a ...interface{}) *AppError {
+	return makeAppError(1).Describe(fmt.Sprintf(msg, a...), "encryption_key")
+}
+
+func FmtErrDecrypt(keyid uint64, in error) *AppError {
+	return makeAppError(1).Describe(fmt.Sprintf(
+		"Could not decrypt value sealed with key %016x, it has been altered " +
+		"or the key is wrong: %s", keyid, in), "decrypt")
+}
+
 // Unexpected data size.
 
 func FmtErrSliceTooSmall(slice []byte, size int) *AppError {
@@ -226,6 +317,42 @@ func errDataSize(msg string, jump int) *AppError {
 	return makeAppError(jump).Describe(msg, "unexpected_data_size")
 }
 
+// Corrupt data.
+
+// A log record whose checksum does not match its data.
+type CorruptRecordError struct {
+	*AppError
+	path	string // logfile path
+	fnum	LBUINT // logfile number
+	rpos	LBUINT // record position
+	rsz		LBUINT // record size
+	ksz		LBUINT // key size
+	crc		uint32 // checksum stored in the record
+	calc	uint32 // checksum calculated from the record data
+}
+
+func (err *CorruptRecordError) Path() string {return err.path}
+func (err *CorruptRecordError) Fnum() LBUINT {return err.fnum}
+func (err *CorruptRecordError) Position() LBUINT {return err.rpos}
+func (err *CorruptRecordError) Size() LBUINT {return err.rsz}
+
+func FmtErrCorruptRecord(path string, fnum LBUINT, rloc *RecordLocation, lrec *LogRecord) *CorruptRecordError {
+	calc := lrec.Checksum()
+	return &CorruptRecordError{
+		AppError: makeAppError(0).Describe(fmt.Sprintf(
+			"The record of %d bytes at position %d in file %q is corrupt, " +
+			"checksum is %d but the data gives %d.",
+			rloc.rsz, rloc.rpos, path, lrec.crc, calc), "corrupt_record"),
+		path:	path,
+		fnum:	fnum,
+		rpos:	rloc.rpos,
+		rsz:	rloc.rsz,
+		ksz:	lrec.ksz,
+		crc:	lrec.crc,
+		calc:	calc,
+	}
+}
+
 // User problems.
 
 func FmtErrUser(msg string, a ...interface{}) *AppError {
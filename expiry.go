@@ -0,0 +1,180 @@
+/*
+	Per-key time-to-live.
+
+	PutWithTTL stores a value with an expiry time, wrapped in its log record
+	(see fileops.go), and the expiry is carried by the index record, the value
+	location and the Master Catalog file.  Once the expiry time has passed, Get
+	treats the key as absent, and conditional writes count it as absent, but
+	its record is left in place until the key is deleted.
+
+	The Reaper is an optional worker per logbase which, every
+	EXPIRY_REAP_INTERVAL_SECS, scans the Master Catalog for expired keys and
+	deletes each one that has not been put again since, so that its value and
+	tombstone are scheduled for zapping in the usual way.  The logbase lock is
+	held for each deletion in turn.
+*/
+package logbase
+
+import (
+	"github.com/h00gs/gubed"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	EXPIRY_SIZE LBUINT = 8 // bytes
+)
+
+// Put the key-value pair, to expire after the given time-to-live.
+func (lbase *Logbase) PutWithTTL(key interface{}, vbyts []byte, vtype LBTYPE, ttl time.Duration) (CatalogRecord, error) {
+	if ttl <= 0 {
+		return nil, FmtErrBadArgs("Time-to-live %v for key %v must be positive", ttl, key)
+	}
+	lbase.debug.Basic("Putting %v into logbase %s for %v", key, lbase.name, ttl)
+	lbase.Lock()
+	mcr, err := lbase.putExpiring(key, vbyts, vtype, time.Now().Add(ttl).UnixNano())
+	seq := lbase.syncer.Last()
+	lbase.Unlock()
+	if err != nil {return nil, err}
+	return mcr, lbase.WaitDurable(seq)
+}
+
+// The expiry time of the value in Unix nanoseconds, or 0 if it never expires.
+func (vloc *ValueLocation) Expiry() int64 {return vloc.expiry}
+
+// Has the value expired by the given time?
+func (vloc *ValueLocation) Expired(now time.Time) bool {
+	return vloc.expiry != 0 && now.UnixNano() >= vloc.expiry
+}
+
+// Return the value bytes wrapped with their type and expiry time, to be
+// stored with type LBTYPE_EXPIRY.
+func WrapExpiry(vbyts []byte, vtype LBTYPE, expiry int64) []byte {
+	bfr := new(bytes.Buffer)
+	binary.Write(bfr, BIGEND, expiry)
+	bfr.Write(InjectType(vbyts, vtype))
+	return bfr.Bytes()
+}
+
+// Unwrap the value bytes and type, and the expiry time, of a value of type
+// LBTYPE_EXPIRY.  Other values are returned as they are, with no expiry.
+func UnwrapValue(vbyts []byte, vtype LBTYPE, debug *gubed.Logger) ([]byte, LBTYPE, int64) {
+	if vtype != LBTYPE_EXPIRY {return vbyts, vtype, 0}
+	if len(vbyts) < int(EXPIRY_SIZE) + LBTYPE_SIZE {
+		debug.Error(FmtErrSliceTooSmall(vbyts, int(EXPIRY_SIZE) + LBTYPE_SIZE))
+		return nil, LBTYPE_NIL, 0
+	}
+	val, vtype := SnipValueType(vbyts[EXPIRY_SIZE:], debug)
+	return val, vtype, BytesToExpiry(vbyts)
+}
+
+// Read an expiry time from the start of the bytes.
+func BytesToExpiry(byts []byte) (expiry int64) {
+	if len(byts) >= int(EXPIRY_SIZE) {
+		expiry = int64(BIGEND.Uint64(byts[:EXPIRY_SIZE]))
+	}
+	return
+}
+
+// Reaping.
+
+// Background worker deleting expired keys.
+type Reaper struct {
+	lbase		*Logbase
+	sync.Mutex	// guards the counts
+	passes		int // number of passes made
+	nreaped		int // number of keys deleted so far
+	lasterr		error
+	stop		chan bool
+	done		chan bool
+}
+
+// Start the background reaper for the logbase, if not already running.
+func (lbase *Logbase) StartReaper() *Reaper {
+	if lbase.reaper != nil {return lbase.reaper}
+	reaper := &Reaper{
+		lbase:	lbase,
+		stop:	make(chan bool),
+		done:	make(chan bool),
+	}
+	lbase.reaper = reaper
+	go reaper.run()
+	lbase.debug.Advise("Started reaper for logbase %q", lbase.name)
+	return reaper
+}
+
+// Worker loop.
+func (reaper *Reaper) run() {
+	defer close(reaper.done)
+	interval := time.Duration(reaper.lbase.config.EXPIRY_REAP_INTERVAL_SECS) * time.Second
+	if interval <= 0 {interval = time.Second}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-reaper.stop:
+			return
+		case <-ticker.C:
+		}
+		n, err := reaper.lbase.ReapExpired()
+		reaper.lbase.debug.Error(err)
+		reaper.Lock()
+		reaper.passes++
+		reaper.nreaped += n
+		if err != nil {reaper.lasterr = err}
+		reaper.Unlock()
+	}
+}
+
+// Delete every expired key in the logbase, returning the number deleted.
+// A key put again since it was found to have expired is left alone.
+func (lbase *Logbase) ReapExpired() (n int, err error) {
+	now := time.Now()
+	expired := make(map[interface{}]uint64) // key -> version
+	lbase.mcat.RLock()
+	for key, mcr := range lbase.mcat.index {
+		if vloc := mcr.ToValueLocation(); vloc.Expired(now) {
+			expired[key] = vloc.version
+		}
+	}
+	lbase.mcat.RUnlock()
+	for key, version := range expired {
+		lbase.Lock()
+		mcr := lbase.mcat.Get(key)
+		if mcr != nil && mcr.ToValueLocation().version == version {
+			err = lbase.del(key)
+			if err == nil {n++}
+		}
+		seq := lbase.syncer.Last()
+		lbase.Unlock()
+		if err != nil {return}
+		if err = lbase.WaitDurable(seq); err != nil {return}
+	}
+	if n > 0 {lbase.debug.Basic("Reaped %d expired keys from logbase %q", n, lbase.name)}
+	return
+}
+
+// Stop the worker, waiting for any pass in progress to finish.
+func (reaper *Reaper) Stop() {
+	lbase := reaper.lbase
+	if lbase.reaper != reaper {return}
+	close(reaper.stop)
+	<-reaper.done
+	lbase.reaper = nil
+	lbase.debug.Advise("Stopped reaper for logbase %q", lbase.name)
+}
+
+// Number of passes made and keys deleted so far, and the last error.
+func (reaper *Reaper) Stats() (passes, nreaped int, lasterr error) {
+	reaper.Lock()
+	defer reaper.Unlock()
+	return reaper.passes, reaper.nreaped, reaper.lasterr
+}
+
+func (reaper *Reaper) String() string {
+	passes, nreaped, lasterr := reaper.Stats()
+	return fmt.Sprintf("(passes=%d nreaped=%d lasterr=%v)", passes, nreaped, lasterr)
+}
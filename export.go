@@ -0,0 +1,347 @@
+/*
+	Export and import of a whole logbase as newline delimited JSON.
+
+	Export writes a snapshot of the logbase, one JSON object per key, in key
+	order, such as
+
+		{"key":"colour","ktype":171,"vtype":171,"value":"green"}
+
+	where ktype and vtype are the LBTYPEs of the key and value.  Numbers,
+	CATIDs included, are JSON numbers, except NaN and the infinities, which
+	are the strings "NaN", "+Inf" and "-Inf".  A complex number is an object
+	with "real" and "imag" numbers, a CATID set is an array of CATIDs, and a
+	Kind or Doc node is an object with its "id", "name", "fields" and
+	"parents", each field having its own "vtype" and "value".  Strings are
+	JSON strings and a nil value is null, while bytes, and values of any type
+	with no rendering of its own, are base64.  A streamed value is exported
+	whole.  A key with a time-to-live carries its "expiry" as an RFC 3339
+	time, and ExportWithLocations adds the "location" of its record, as its
+	logfile number, value position and value size.
+
+	Import reads such objects back, putting each key in turn, streamed with
+	PutReader if its value is larger than STREAM_CHUNK_SIZE and it has no
+	expiry.  Keys that have since expired are skipped, and locations are
+	ignored.  Import stops at the first bad object, with the keys before it
+	already put.
+*/
+package logbase
+
+import (
+	"github.com/h00gs/gubed"
+	"bytes"
+	"encoding/json"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// A key and its value, as exported.
+type ExportRecord struct {
+	Key			json.RawMessage	`json:"key"`
+	Ktype		LBTYPE			`json:"ktype"`
+	Vtype		LBTYPE			`json:"vtype"`
+	Value		json.RawMessage	`json:"value"`
+	Expiry		*time.Time		`json:"expiry,omitempty"`
+	Location	*ExportLocation	`json:"location,omitempty"`
+}
+
+// Where the value of an exported key is stored.
+type ExportLocation struct {
+	Fnum		LBUINT	`json:"fnum"`
+	Vpos		LBUINT	`json:"vpos"`
+	Vsz			LBUINT	`json:"vsz"`
+}
+
+// A Kind or Doc node, as exported.
+type ExportNode struct {
+	Id			CATID_TYPE				`json:"id"`
+	Name		string					`json:"name"`
+	Fields		map[string]*ExportField	`json:"fields"`
+	Parents		[]CATID_TYPE			`json:"parents"`
+}
+
+// A node field, as exported.
+type ExportField struct {
+	Vtype		LBTYPE			`json:"vtype"`
+	Value		json.RawMessage	`json:"value"`
+}
+
+// A complex number, as exported.
+type ExportComplex struct {
+	Real		json.RawMessage	`json:"real"`
+	Imag		json.RawMessage	`json:"imag"`
+}
+
+// Export.
+
+// Write every key of the logbase, with its value, to the writer, returning
+// the number of keys written.
+func (lbase *Logbase) Export(wtr io.Writer) (int, error) {
+	return lbase.export(wtr, false)
+}
+
+// Export, including the location of the record of each value.
+func (lbase *Logbase) ExportWithLocations(wtr io.Writer) (int, error) {
+	return lbase.export(wtr, true)
+}
+
+func (lbase *Logbase) export(wtr io.Writer, locate bool) (n int, err error) {
+	snap := lbase.Snapshot()
+	defer snap.Release()
+	keys := snap.Keys()
+	sort.Slice(keys, func(i, j int) bool {return CompareKeys(keys[i], keys[j]) < 0})
+	lbase.debug.Basic("Exporting %d keys from logbase %q", len(keys), lbase.name)
+	enc := json.NewEncoder(wtr)
+	for _, key := range keys {
+		vbyts, vtype, err := snap.Get(key)
+		if err != nil {return n, err}
+		if vbyts == nil && vtype == LBTYPE_NIL {continue} // expired
+		xrec := &ExportRecord{
+			Ktype:	KeyTypeOf(key),
+			Vtype:	vtype,
+		}
+		xrec.Key, err = MarshalValue(KeyToBytes(key), xrec.Ktype)
+		if err != nil {return n, err}
+		xrec.Value, err = MarshalValue(vbyts, vtype)
+		if err != nil {return n, err}
+		vloc := snap.Record(key).ToValueLocation()
+		if vloc.expiry != 0 {
+			expiry := time.Unix(0, vloc.expiry).UTC()
+			xrec.Expiry = &expiry
+		}
+		if locate {
+			xrec.Location = &ExportLocation{
+				Fnum:	vloc.fnum,
+				Vpos:	vloc.vpos,
+				Vsz:	vloc.vsz,
+			}
+		}
+		if err = enc.Encode(xrec); err != nil {return n, err}
+		n++
+	}
+	lbase.debug.Advise("Exported %d keys from logbase %q", n, lbase.name)
+	return n, nil
+}
+
+// Render the value bytes of the given type as JSON.
+func MarshalValue(vbyts []byte, vtype LBTYPE) (json.RawMessage, error) {
+	if vtype == LBTYPE_NIL {return json.RawMessage("null"), nil}
+	if vtype == LBTYPE_BYTES {return json.Marshal(vbyts)}
+	val, err := MakeTypeFromBytes(vbyts, vtype)
+	if err != nil {return nil, err}
+	switch v := val.(type) {
+	case float32, float64:
+		return marshalFloat(v)
+	case complex64:
+		return marshalComplex(real(v), imag(v))
+	case complex128:
+		return marshalComplex(real(v), imag(v))
+	case *CatalogIdSet:
+		ids := make([]CATID_TYPE, len(v.set))
+		for i, cid := range v.set {ids[i] = cid.id}
+		return json.Marshal(ids)
+	case *Node:
+		xnode := &ExportNode{
+			Id:			v.Id(),
+			Name:		v.Name(),
+			Fields:		make(map[string]*ExportField),
+			Parents:	make([]CATID_TYPE, len(v.parents.set)),
+		}
+		for label, field := range v.Fields() {
+			fval, err := MarshalValue(field.vbyts, field.vtype)
+			if err != nil {return nil, err}
+			xnode.Fields[label] = &ExportField{Vtype: field.vtype, Value: fval}
+		}
+		for i, cid := range v.parents.set {xnode.Parents[i] = cid.id}
+		return json.Marshal(xnode)
+	}
+	return json.Marshal(val) // []byte as base64 for types with no rendering
+}
+
+// Render the float32 or float64 as a JSON number, or as a string if it is
+// NaN or infinite.
+func marshalFloat(v interface{}) (json.RawMessage, error) {
+	var f float64
+	switch x := v.(type) {
+	case float32:
+		f = float64(x)
+	case float64:
+		f = x
+	}
+	switch {
+	case math.IsNaN(f):
+		return json.Marshal("NaN")
+	case math.IsInf(f, 1):
+		return json.Marshal("+Inf")
+	case math.IsInf(f, -1):
+		return json.Marshal("-Inf")
+	}
+	return json.Marshal(v)
+}
+
+// Render a complex number from its real and imaginary parts, both float32
+// or both float64.
+func marshalComplex(re, im interface{}) (json.RawMessage, error) {
+	var err error
+	xc := &ExportComplex{}
+	if xc.Real, err = marshalFloat(re); err != nil {return nil, err}
+	if xc.Imag, err = marshalFloat(im); err != nil {return nil, err}
+	return json.Marshal(xc)
+}
+
+// Import.
+
+// Put every key in the exported keys read from the reader, returning the
+// number of keys put.
+func (lbase *Logbase) Import(rdr io.Reader) (n int, err error) {
+	lbase.debug.Basic("Importing keys into logbase %q", lbase.name)
+	dec := json.NewDecoder(rdr)
+	for i := 1; ; i++ {
+		xrec := &ExportRecord{}
+		err = dec.Decode(xrec)
+		if err == io.EOF {break}
+		if err != nil {return n, FmtErrBadImport(i, err.Error())}
+		put, err := lbase.importRecord(xrec)
+		if err != nil {return n, FmtErrBadImport(i, err.Error())}
+		if put {n++}
+	}
+	lbase.debug.Advise("Imported %d keys into logbase %q", n, lbase.name)
+	return n, nil
+}
+
+// Put the key of the exported record, returning whether it was put, rather
+// than skipped as expired.
+func (lbase *Logbase) importRecord(xrec *ExportRecord) (bool, error) {
+	if !IsAllowableKey(xrec.Ktype) {
+		return false, FmtErrBadType("Bad key type: %d", xrec.Ktype)
+	}
+	kbyts, err := UnmarshalValue(xrec.Key, xrec.Ktype, lbase.debug)
+	if err != nil {return false, err}
+	key, err := MakeKey(kbyts, xrec.Ktype, lbase.debug)
+	if err != nil {return false, err}
+	vbyts, err := UnmarshalValue(xrec.Value, xrec.Vtype, lbase.debug)
+	if err != nil {return false, err}
+
+	var expiry int64
+	if xrec.Expiry != nil {
+		if !xrec.Expiry.After(time.Now()) {return false, nil}
+		expiry = xrec.Expiry.UnixNano()
+	}
+	if expiry == 0 && len(vbyts) > lbase.ChunkSize() {
+		_, err = lbase.PutReader(key, bytes.NewReader(vbyts), xrec.Vtype)
+		return err == nil, err
+	}
+	lbase.Lock()
+	_, err = lbase.putExpiring(key, vbyts, xrec.Vtype, expiry)
+	seq := lbase.syncer.Last()
+	lbase.Unlock()
+	if err != nil {return false, err}
+	return true, lbase.WaitDurable(seq)
+}
+
+// Return the bytes of the value of the given type rendered as JSON by
+// MarshalValue.
+func UnmarshalValue(raw json.RawMessage, vtype LBTYPE, debug *gubed.Logger) ([]byte, error) {
+	var val interface{}
+	var err error
+	switch vtype {
+	case LBTYPE_NIL:
+		return nil, nil
+	case LBTYPE_UINT8:
+		var v uint8
+		err = json.Unmarshal(raw, &v)
+		val = v
+	case LBTYPE_UINT16:
+		var v uint16
+		err = json.Unmarshal(raw, &v)
+		val = v
+	case LBTYPE_UINT32:
+		var v uint32
+		err = json.Unmarshal(raw, &v)
+		val = v
+	case LBTYPE_UINT64:
+		var v uint64
+		err = json.Unmarshal(raw, &v)
+		val = v
+	case LBTYPE_INT8:
+		var v int8
+		err = json.Unmarshal(raw, &v)
+		val = v
+	case LBTYPE_INT16:
+		var v int16
+		err = json.Unmarshal(raw, &v)
+		val = v
+	case LBTYPE_INT32:
+		var v int32
+		err = json.Unmarshal(raw, &v)
+		val = v
+	case LBTYPE_INT64:
+		var v int64
+		err = json.Unmarshal(raw, &v)
+		val = v
+	case LBTYPE_CATID:
+		var v CATID_TYPE
+		err = json.Unmarshal(raw, &v)
+		val = v
+	case LBTYPE_CHUNKID:
+		var v CHUNKID_TYPE
+		err = json.Unmarshal(raw, &v)
+		val = v
+	case LBTYPE_FLOAT32:
+		var f float64
+		f, err = unmarshalFloat(raw, 32)
+		val = float32(f)
+	case LBTYPE_FLOAT64:
+		val, err = unmarshalFloat(raw, 64)
+	case LBTYPE_COMPLEX64, LBTYPE_COMPLEX128:
+		xc := &ExportComplex{}
+		if err = json.Unmarshal(raw, xc); err != nil {return nil, err}
+		bits := 64
+		if vtype == LBTYPE_COMPLEX64 {bits = 32}
+		re, err := unmarshalFloat(xc.Real, bits)
+		if err != nil {return nil, err}
+		im, err := unmarshalFloat(xc.Imag, bits)
+		if err != nil {return nil, err}
+		val = complex(re, im)
+		if vtype == LBTYPE_COMPLEX64 {val = complex(float32(re), float32(im))}
+	case LBTYPE_STRING, LBTYPE_LOCATION, LBTYPE_CATKEY:
+		var s string
+		if err = json.Unmarshal(raw, &s); err != nil {return nil, err}
+		return []byte(s), nil
+	case LBTYPE_CATID_SET:
+		var ids []CATID_TYPE
+		if err = json.Unmarshal(raw, &ids); err != nil {return nil, err}
+		cidset := NewCatalogIdSet()
+		for _, id := range ids {cidset.Add(NewCatalogId(id))}
+		return cidset.ToBytes(debug), nil
+	case LBTYPE_KIND, LBTYPE_DOC:
+		xnode := &ExportNode{}
+		if err = json.Unmarshal(raw, xnode); err != nil {return nil, err}
+		node := MakeNode(xnode.Name, vtype, debug)
+		node.SetId(xnode.Id)
+		for label, xfield := range xnode.Fields {
+			fbyts, err := UnmarshalValue(xfield.Value, xfield.Vtype, debug)
+			if err != nil {return nil, err}
+			node.fields[label] = MakeField(fbyts, xfield.Vtype)
+		}
+		for _, id := range xnode.Parents {node.parents.Add(NewCatalogId(id))}
+		return node.Pack()
+	default:
+		var byts []byte
+		err = json.Unmarshal(raw, &byts)
+		return byts, err
+	}
+	if err != nil {return nil, err}
+	return ToBytes(val, vtype, debug)
+}
+
+// Read a float of the given bit size rendered by marshalFloat.
+func unmarshalFloat(raw json.RawMessage, bits int) (float64, error) {
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		s = string(raw) // a number
+	}
+	return strconv.ParseFloat(s, bits)
+}
@@ -14,6 +14,8 @@
 	F       File number
 	P		Permission
 	C       Checksum
+	SQ      Sequence number
+	TS      Timestamp
 	RS      (Entire) Record size
 	RP      (Entire) Record position
 
@@ -25,20 +27,24 @@
 	+------+------+------+------+------+------+------+------+
 
 	LOGFILE RECORD (LOG_RECORD)
-	+------+------+------+------+------+------+------+------+
-	|      |      |             |                    :      |
-	|  KS  |  GVS |      K      |          V         :  C   |
-	|      |      |             |                    :      |
-	+------+------+------+------+------+------+------+------+
-			                    |<----------- GV ---------->|
+	+------+------+------+------+------+------+------+------+------+
+	|      |      |             |             :      :      :      |
+	|  KS  |  GVS |      K      |      V      :  SQ  :  TS  :  C   |
+	|      |      |             |             :      :      :      |
+	+------+------+------+------+------+------+------+------+------+
+			                    |<-------------- GV -------------->|
 
 	LOGFILE INDEX FILE RECORD (INDEX_RECORD)
-	+------+------+------+------+------+
-	|      |             |      |      |
-	|  KS  |      K      |  VS  |  VP  |     No GVS
-	|      |             |      |      |
-	+------+------+------+------+------+
-			             |<---- GV --->|
+	+------+------+------+------+------+------+------+
+	|      |             |      |      |      |      |
+	|  KS  |      K      |  VS  |  VP  |  SQ  |  TS  |  No GVS
+	|      |             |      |      |      |      |
+	+------+------+------+------+------+------+------+
+			             |<---------- GV ----------->|
+
+	The stamp of a record, SQ and TS, is the sequence number and the
+	wall-clock time in Unix nanoseconds at which it was written, 8 bytes each,
+	and is absent from files before format v3.
 
 	MASTER CATALOG FILE RECORD (MASTER_RECORD)
 	+------+------+------+------+------+------+
@@ -48,6 +54,30 @@
 	+------+------+------+------+------+------+
 			             |<------- GV ------->|
 
+	The Master Catalog file begins with a checkpoint record in the same format,
+	with an empty key of type LBTYPE_CHECKPOINT, F and VP giving the live log
+	file number and size when the file was saved, and VS the last sequence
+	number handed out by then.
+
+	A value put with a time-to-live is stored in the log record with type
+	LBTYPE_EXPIRY, as the expiry time in Unix nanoseconds (8 bytes), then the
+	LBTYPE and bytes of the value.  Its index record is preceded by a marker
+	with the expiry time as a key of type LBTYPE_EXPIRY, VS 0 and the VP of
+	the value, and in the Master Catalog file its record is followed by one
+	for the same key with a GV of type LBTYPE_EXPIRY and the expiry time as F.
+
+	A compressed value is stored with type LBTYPE_COMPRESSED, as the LBTYPE
+	of the value then its deflated bytes, inside any expiry wrapping.
+
+	An encrypted value is stored with type LBTYPE_ENCRYPTED, as the id of its
+	key (8 bytes), the GCM nonce (12 bytes), then the LBTYPE and bytes of the
+	value, after any compression, sealed with AES-256-GCM and followed by the
+	16 byte tag, inside any expiry wrapping.
+
+	A streamed value is stored with type LBTYPE_CHUNKED, as its length (8
+	bytes) and LBTYPE, then the CHUNKID_TYPE key (8 bytes) of each record
+	holding a chunk of it, in order.
+
 	ZAPMAP FILE RECORD (ZAP_RECORD)
 	+------+------+------+------+------+------+------+------+------+------+
 	|      |      |             |      :      :      |      :      :      |
@@ -64,6 +94,10 @@
 	+------+------+------+------+
 			             |<-GV->| = 1 byte
 
+	Each file starts with a format header, followed by its records (see
+	format.go).  Sizes, positions and file numbers are 8 bytes, or 4 bytes in
+	format v1 files.
+
 */
 package logbase
 
@@ -315,10 +349,30 @@ func (lbase *Logbase) GetUserPermissionPaths() (usernames []string, err error) {
 
 // Save the master catalog, zapmap and user permission files for the logbase.  Only
 // save each if there has been a change.
-func (lbase *Logbase) Save() (err error) {
-	for _, obj := range lbase.catcache.objects {
+func (lbase *Logbase) Save() error {
+	lbase.Lock()
+	defer lbase.Unlock()
+	return lbase.save()
+}
+
+// Save, for a caller holding the logbase lock.
+func (lbase *Logbase) save() (err error) {
+	if lbase.livelog != nil {
+		// The checkpoint must not lie beyond what has been written out
+		err = lbase.debug.Error(lbase.livelog.Flush())
+		if err != nil {return}
+	}
+	for _, obj := range lbase.catcache.Values() {
 		cat := obj.(*Catalog)
 		if cat.autosave && cat.changed {
+			if cat.ismaster && lbase.livelog != nil {
+				// Records from here on must be replayed at the next Init
+				cat.checkpoint = &Checkpoint{
+					fnum:	lbase.livelog.fnum,
+					pos:	AsLBUINT(lbase.livelog.size),
+					seq:	lbase.seq,
+				}
+			}
 			err = lbase.debug.Error(cat.Save())
 			if err != nil {return}
 			cat.changed = false
@@ -344,12 +398,19 @@ func (lbase *Logbase) Save() (err error) {
 }
 
 // Read the log file (given by the index) and build an associated index file.
+// Corrupt records are left out of the index, and handled according to the
+// configured corruption policy.
 func (lbase *Logbase) RefreshIndexfile(fnum LBUINT) (lfindex *Index, err error) {
 	var lfile *Logfile
 	lfile, err = lbase.GetLogfile(fnum)
 	if err != nil {return}
-	lfindex, err = lfile.Index()
+	var corrupt []*CorruptRecordError
+	lfindex, corrupt, err = lfile.Index()
 	if err != nil {return}
+	for _, cerr := range corrupt {
+		err = lbase.HandleCorruption(cerr, nil)
+		if err != nil {return}
+	}
 	err = lfile.indexfile.Save(lfindex)
 	return
 }
@@ -363,6 +424,18 @@ func (lbase *Logbase) ReadIndexfile(fnum LBUINT) (lfindex *Index, err error) {
 	return
 }
 
+// Is the index record for a tombstone, marking the deletion of its key?  A
+// tombstone value is a lone LBTYPE_NIL, which the index file does not
+// record, so the log file must be checked for any single byte value.
+func (lbase *Logbase) IsTombstone(irec *IndexRecord, fnum LBUINT) (bool, error) {
+	if irec.vsz != LBUINT(LBTYPE_SIZE) {return false, nil}
+	lfile, err := lbase.GetLogfile(fnum)
+	if err != nil {return false, err}
+	vbyts, err := lfile.ReadVal(irec.vpos, irec.vsz)
+	if err != nil {return false, err}
+	return GetType(vbyts, lbase.debug) == LBTYPE_NIL, nil
+}
+
 // File name related functions.
 
 func MakeLogfileName(fnum LBUINT, ext string) string {
@@ -385,18 +458,30 @@ func MakeIndexfileName(fnum LBUINT, ext string) string {
 
 func (lfile *Logfile) GetIndexfile() *Indexfile {return lfile.indexfile}
 
-// Index the given log file.
-func (lfile *Logfile) Index() (*Index, error) {
+// Index the given log file, verifying the checksum of each record.  Corrupt
+// records are returned separately rather than indexed.
+func (lfile *Logfile) Index() (*Index, []*CorruptRecordError, error) {
 	index := new(Index)
+	var corrupt []*CorruptRecordError
 	f := func(rec *GenericRecord) error {
 		if rec.ksz > 0 {
-			irec := rec.ToLogRecord(lfile.debug).ToIndexRecord(lfile.debug)
+			lrec := rec.ToLogRecord(lfile.debug)
+			irec := lrec.ToIndexRecord(lfile.debug)
+			irec.vpos = rec.vpos
+			if !lrec.Verify() {
+				vloc := NewValueLocation()
+				vloc.FromIndexRecord(irec, lfile.fnum)
+				rloc := vloc.ToRecordLocation(irec.ksz, lfile.UintSize(), lfile.StampSize())
+				corrupt = append(corrupt,
+					FmtErrCorruptRecord(lfile.abspath, lfile.fnum, rloc, lrec))
+				return nil
+			}
 			index.List = append(index.List, irec)
 		}
 		return nil
 	}
 	err := lfile.Process(f, LOG_RECORD, true)
-	return index, err
+	return index, corrupt, err
 }
 
 // Read log file into a LogRecord slice.
@@ -417,28 +502,63 @@ func (lfile *Logfile) Load() ([]*LogRecord, error) {
 // both in-memory and on file.  Does not update the master catalog or
 // zapmap.
 func (lfile *Logfile) StoreData(lrec *LogRecord) (irec *IndexRecord, err error) {
-	lfile.Open(CREATE | WRITE_ONLY | APPEND)
-	defer lfile.Close()
-	pos, _ := lfile.JumpFromEnd(0)
-	var nwrite int
-	nwrite, err = lfile.LockedWriteAt(lrec.Pack(), pos)
-	lfile.size += nwrite
+	irecs, err := lfile.StoreRecords([]*LogRecord{lrec}, false)
 	if err != nil {return}
-
-	// Create a new file index record
-	irec = lrec.ToIndexRecord(lfile.debug)
-	hsz := LBUINT(ParamSize(lrec.ksz) + ParamSize(lrec.vsz))
-	irec.vpos = pos + hsz + irec.ksz
+	return irecs[0], nil
+}
+
+// Append the records to the log file in a single write, optionally syncing
+// the log file to disk, then append their index records to the index, both
+// in-memory and on file.  The writes go through the append handles of the
+// files, so may be buffered unless synced.  On failure, both files are cut
+// back to where they were.  Does not update the master catalog or zapmap.
+func (lfile *Logfile) StoreRecords(lrecs []*LogRecord, sync bool) (irecs []*IndexRecord, err error) {
+	for _, file := range []*File{lfile.File, lfile.indexfile.File} {
+		if !file.IsCurrent() {return nil, FmtErrOldFormat(file.abspath, file.version)}
+	}
+	logsize, indexsize := lfile.size, lfile.indexfile.size
+	nlisted := len(lfile.indexfile.List)
+	defer func() {
+		if err == nil {return}
+		irecs = nil
+		lfile.indexfile.List = lfile.indexfile.List[:nlisted]
+		lfile.debug.Error(lfile.indexfile.Unappend(indexsize))
+		lfile.debug.Error(lfile.Unappend(logsize))
+	}()
+	if lfile.size == 0 {
+		err = lfile.AppendHeader(FILEKIND_LOG)
+		if err != nil {return}
+	}
+	pos := AsLBUINT(lfile.size)
+	bfr := new(bytes.Buffer)
+	for _, lrec := range lrecs {
+		// Records read from old files are upgraded
+		lrec.usz, lrec.ssz = LBUINT_SIZE, STAMP_SIZE
+		// Create a new file index record
+		irec := lrec.ToIndexRecord(lfile.debug)
+		hsz := LBUINT(ParamSize(lrec.ksz) + ParamSize(lrec.vsz))
+		irec.vpos = pos.Plus(bfr.Len()) + hsz + irec.ksz
+		irecs = append(irecs, irec)
+		bfr.Write(lrec.Pack())
+	}
+	_, err = lfile.Append(bfr.Bytes())
+	if err != nil {return nil, err}
+	if sync {
+		err = lfile.Sync()
+		if err != nil {return nil, err}
+	}
 
 	// Update the in-memory file index
-	lfile.indexfile.List = append(lfile.indexfile.List, irec)
-
-	// Write the index record to the index file
-	lfile.indexfile.Open(CREATE | WRITE_ONLY | APPEND)
-	defer lfile.indexfile.Close()
-	pos, _ = lfile.indexfile.JumpFromEnd(0)
-	nwrite, err = lfile.indexfile.LockedWriteAt(irec.Pack(), pos)
-	lfile.indexfile.size += nwrite
+	lfile.indexfile.List = append(lfile.indexfile.List, irecs...)
+
+	// Append the index records to the index file
+	if lfile.indexfile.size == 0 {
+		err = lfile.indexfile.AppendHeader(FILEKIND_INDEX)
+		if err != nil {return}
+	}
+	bfr.Reset()
+	for _, irec := range irecs {bfr.Write(irec.Pack())}
+	_, err = lfile.indexfile.Append(bfr.Bytes())
 	return
 }
 
@@ -450,33 +570,70 @@ func (lfile *Logfile) ReadVal(vpos, vsz LBUINT) ([]byte, error) {
 }
 
 // Zap stale values from the logfile, by copying the file to a tmp file while
-// ignoring stale records as defined by the given Zapmap.
-func (lfile *Logfile) Zap(zmap *Zapmap, bfrsz LBUINT) error {
+// ignoring stale records as defined by the given Zapmap, apart from those at
+// the positions to hold.  The index file is rewritten to match.  Returns the
+// zapped records, or nil if the file was not changed, so that the caller can
+// remap any value locations in the file.
+func (lfile *Logfile) Zap(zmap *Zapmap, bfrsz LBUINT, hold map[LBUINT]bool) (zl *Zaplists, err error) {
+	plan, err := lfile.PlanZap(zmap, hold)
+	if err != nil || plan == nil {return}
+	if err = lfile.CopyUnzapped(plan, bfrsz, nil); err != nil {return}
+	return lfile.SwapZapped(zmap, plan)
+}
+
+// The stale records to be zapped from a logfile, with its index as it was
+// when they were found.
+type ZapPlan struct {
+	rpos		[]LBUINT // sorted record positions
+	rsz			[]LBUINT // record sizes
+	lfindex		*Index
+	size		LBUINT // bytes copied to the tmp twin
+}
+
+// Find the stale records to zap from the logfile, apart from those at the
+// positions to hold, and read its index.  Returns nil if there are none.
+func (lfile *Logfile) PlanZap(zmap *Zapmap, hold map[LBUINT]bool) (plan *ZapPlan, err error) {
 	lfile.debug.Fine("Zapping %s", lfile.abspath)
 	// Extract all zaprecords for this file and build a map between the logfile
 	// record positions -> record size.
-	rpos, rsz, err := zmap.Find(lfile.fnum)
-	if err != nil {return err}
-	if len(rpos) == 0 {
+	allrpos, allrsz, err := zmap.Find(lfile.fnum)
+	if err != nil {return}
+	plan = &ZapPlan{}
+	for i, pos := range allrpos {
+		if hold[pos] {continue}
+		plan.rpos = append(plan.rpos, pos)
+		plan.rsz = append(plan.rsz, allrsz[i])
+	}
+	if len(plan.rpos) == 0 {
 		lfile.debug.Fine(" Nothing to zap")
-		return nil
+		return nil, nil
+	}
+	lfile.debug.SuperFine(" zaplists: rpos = %v rsz = %v", plan.rpos, plan.rsz)
+	last := len(plan.rpos) - 1
+	if pos := int(plan.rpos[last] + plan.rsz[last]); pos > lfile.size {
+		return nil, FmtErrPositionExceedsFileSize(lfile.abspath, pos, lfile.size)
 	}
-	lfile.debug.SuperFine(" zaplists: rpos = %v rsz = %v", rpos, rsz)
 
-	// Create temporary file.
-	err = lfile.tmp.Open(CREATE | WRITE_ONLY | APPEND)
-	if lfile.debug.Error(err) != nil {return err}
+	// Read the index before the logfile changes
+	plan.lfindex, err = lfile.indexfile.Load()
+	if lfile.debug.Error(err) != nil {return nil, err}
+	return
+}
 
-	lfile.Open(READ_ONLY)
-	last := len(rpos) - 1
-	pos := int(rpos[last] + rsz[last])
-	if pos > lfile.size {
-		return FmtErrPositionExceedsFileSize(lfile.abspath, pos, lfile.size)
-	}
+// Copy the records of the logfile that the plan does not zap to its tmp
+// twin.  If pace is not nil, it is called with the number of bytes copied
+// after each buffer, so that the caller can limit the rate.  The logfile is
+// only read, so its records stay readable meanwhile.
+func (lfile *Logfile) CopyUnzapped(plan *ZapPlan, bfrsz LBUINT, pace func(nbytes int)) (err error) {
+	err = lfile.tmp.Open(CREATE | WRITE_ONLY | TRUNCATE)
+	if lfile.debug.Error(err) != nil {return}
+	defer lfile.tmp.Close()
+	if err = lfile.Open(READ_ONLY); err != nil {return}
+	defer lfile.Close()
 	lfile.debug.SuperFine(" file size = %d", lfile.size)
 
 	// Invert the zap lists to make position and size of chunks to preserve
-	cpos, csz := InvertSequence(rpos, rsz, lfile.size)
+	cpos, csz := InvertSequence(plan.rpos, plan.rsz, lfile.size)
 	lfile.debug.SuperFine(" preserve: cpos = %v csz = %v", cpos, csz)
 
 	// Transpose logfile (with gaps) to tmp file
@@ -491,8 +648,6 @@ func (lfile *Logfile) Zap(zmap *Zapmap, bfrsz LBUINT) error {
 	var j LBUINT
 	var nr int
 
-	lfile.RLock() // other reads ok while we transpose to tmp file
-
 	for i := 0; i < len(cpos); i++ {
 		// First, we need to determine the chunk that needs to be read
 		kr = cpos[i]
@@ -509,8 +664,10 @@ func (lfile *Logfile) Zap(zmap *Zapmap, bfrsz LBUINT) error {
 				bfr = make([]byte, rem)
 				size = rem
 			}
-			// Read
+			// Read, letting other reads through
+			lfile.RLock()
 			nr, err = lfile.gofile.ReadAt(bfr, int64(kr))
+			lfile.RUnlock()
 			bfr = bfr[0:nr]
 			lfile.debug.SuperFine(
 				" read = %s err = %v",
@@ -533,23 +690,33 @@ func (lfile *Logfile) Zap(zmap *Zapmap, bfrsz LBUINT) error {
 					size, kw, lfile.tmp.abspath), err)
 			}
 			kw = kw + size
+			if pace != nil {pace(len(bfr))}
 		}
 	}
+	plan.size = kw
+	return nil
+}
 
-	lfile.RUnlock()
-	lfile.Close()
-	lfile.tmp.Close()
-
-	if kw > 0 {
-	    err = lfile.ReplaceWithTmpTwin()
-		if lfile.debug.Error(err) != nil {return err}
-		zmap.Purge(lfile.fnum, lfile.debug)
-	} else {
-		err = lfile.tmp.Remove()
-		if lfile.debug.Error(err) != nil {return err}
-	}
+// Swap the zapped copy of the logfile in for it, with its remapped index,
+// and purge the zapped records from the zapmap.  Returns the zapped records.
+func (lfile *Logfile) SwapZapped(zmap *Zapmap, plan *ZapPlan) (zl *Zaplists, err error) {
+	// Write the remapped index to its tmp twin first, so that the two files
+	// can be swapped in together.  If every record was stale, both end up
+	// empty.
+	zl = NewZaplists(plan.rpos, plan.rsz)
+	lfindex := zl.RemapIndex(plan.lfindex)
+	err = lfile.indexfile.writeTo(lfile.indexfile.tmp, lfindex)
+	if lfile.debug.Error(err) != nil {return nil, err}
+	err = lfile.ReplaceWithTmpTwin()
+	if lfile.debug.Error(err) != nil {return nil, err}
+	lfile.size = int(plan.size)
+	err = lfile.indexfile.ReplaceWithTmpTwin()
+	if lfile.debug.Error(err) != nil {return nil, err}
+	lfile.indexfile.Touch()
+	lfile.indexfile.Index = lfindex
+	zmap.PurgeZapped(lfile.fnum, zl, lfile.debug)
 
-	return nil
+	return
 }
 
 // Log file index file methods.
@@ -557,9 +724,15 @@ func (lfile *Logfile) Zap(zmap *Zapmap, bfrsz LBUINT) error {
 // Read the index file.
 func (ifile *Indexfile) Load() (lfindex *Index, err error) {
 	lfindex = new(Index)
+	var expiry int64 // from a marker, for the next record
 	f := func(rec *GenericRecord) error {
 		if rec.ksz > 0 {
 			irec := rec.ToIndexRecord(ifile.debug)
+			if irec.ktype == LBTYPE_EXPIRY {
+				expiry = BytesToExpiry(irec.kbyts)
+				return nil
+			}
+			irec.expiry, expiry = expiry, 0
 			lfindex.List = append(lfindex.List, irec)
 		}
 		return nil
@@ -568,13 +741,23 @@ func (ifile *Indexfile) Load() (lfindex *Index, err error) {
 	return
 }
 
-// Write index file.
+// Write index file, replacing any existing content.  It is written to the
+// tmp twin first and renamed over the file, so that a hard link to the old
+// file, as made by a backup, is left as it was.
+func (ifile *Indexfile) Save(lfindex *Index) (err error) {
+	if err = ifile.writeTo(ifile.tmp, lfindex); err != nil {return}
+	return ifile.ReplaceWithTmpTwin()
+}
+
+// Write the index to the given file, replacing any existing content.
 // Builds a single (possibly large) []byte in RAM for a single write to file.
-func (ifile *Indexfile) Save(lfindex *Index) error {
-	ifile.Open(CREATE | WRITE_ONLY | APPEND)
-	defer ifile.Close()
-	_, err := ifile.LockedWriteAt(lfindex.ToBytes(), 0)
-	return err
+func (ifile *Indexfile) writeTo(file *File, lfindex *Index) (err error) {
+	if err = file.Open(CREATE | WRITE_ONLY | TRUNCATE); err != nil {return}
+	defer file.Close()
+	if err = file.WriteHeader(FILEKIND_INDEX); err != nil {return}
+	nw, err := file.LockedWriteAt(lfindex.ToBytes(), FORMAT_HEADER_SIZE)
+	file.size += nw
+	return
 }
 
 // Zapmap file methods.
@@ -602,9 +785,11 @@ func (zmap *Zapmap) Save() (err error) {
 	if zmap.Len() == 0 {
 		zmap.debug.Basic("Attempt to save zapmap but it is empty")
 	}
-	zmap.file.tmp.Open(CREATE | WRITE_ONLY)
+	zmap.file.tmp.Open(CREATE | WRITE_ONLY | TRUNCATE)
+	err = zmap.file.tmp.WriteHeader(FILEKIND_ZAPMAP)
+	if err != nil {return}
 	var nw int
-	var pos LBUINT = 0
+	var pos LBUINT = FORMAT_HEADER_SIZE
 	zmap.RLock()
 	for key, zrecs := range zmap.zapmap {
 		nw, err = zmap.file.tmp.LockedWriteAt(PackZapRecord(key, zrecs, zmap.debug), pos)
@@ -630,17 +815,37 @@ func (cat *Catalog) Load(lbase *Logbase) (err error) {
 	defer cat.file.Close()
 	if cat.file.size == 0 {return}
 	cat.Lock()
+	cat.unshare()
+	cat.checkpoint = nil
 	f := func(rec *GenericRecord) error {
+		if rec.ktype == LBTYPE_CHECKPOINT {
+			if cat.ismaster {cat.checkpoint = rec.ToCheckpoint(cat.debug)}
+			return nil
+		}
 		if rec.ksz > 0 {
+			if _, vtype := rec.GetValueAndType(MASTER_RECORD, cat.debug); vtype == LBTYPE_EXPIRY {
+				// Expiry of the value location just loaded, which other
+				// catalogs share
+				key, evloc := rec.ToValueLocation(cat.debug)
+				if mcr := cat.index[key]; cat.ismaster && mcr != nil {
+					mcr.ToValueLocation().expiry = int64(evloc.fnum)
+				}
+				return nil
+			}
 			key, vloc := rec.ToValueLocation(cat.debug)
 			if cat.ismaster {
 				cat.index[key] = vloc // Don't need to use gateway because cat is fresh
+				cat.order.Insert(key)
 				cat.SetNextId(key) // Increment the counter if key is of right type
 			} else {
 				mcr := lbase.mcat.Get(key)
                 if mcr == nil {
-					// The key must be in the Master Catalog...
-					cat.debug.Error(FmtErrUnknownCatalogKey(key, cat.Name()))
+					// The key must be in the Master Catalog, otherwise it
+					// has been deleted since the catalog was last saved
+					cat.debug.Fine(
+						"Dropping key %v from catalog %q, it is not in the " +
+						"Master Catalog", key, cat.Name())
+					cat.changed = true
 				} else {
                     // ...and the ValueLocations must match
 					oldvloc := mcr.ToValueLocation()
@@ -652,6 +857,7 @@ func (cat *Catalog) Load(lbase *Logbase) (err error) {
 					} else {
 						// Everything checks out, use the existing pointer
 						cat.index[key] = oldvloc
+						cat.order.Insert(key)
 					}
 				}
 			}
@@ -670,11 +876,30 @@ func (cat *Catalog) Save() (err error) {
 	if cat.Len() == 0 {
 		cat.debug.Basic("Attempt to save catalog %q but it is empty", cat)
 	}
-	cat.file.tmp.Open(CREATE | WRITE_ONLY)
+	if err = cat.file.tmp.Open(CREATE | WRITE_ONLY | TRUNCATE); err != nil {return}
+	cat.RLock()
+	defer cat.RUnlock()
+	if err = cat.writeTo(cat.file.tmp); err != nil {
+		cat.file.tmp.Close()
+		return
+	}
+	cat.file.tmp.Close()
+	return cat.file.ReplaceWithTmpTwin()
+}
+
+// Write the checkpoint and value locations of the catalog to the given open
+// file, for a caller holding the catalog lock for reading.
+func (cat *Catalog) writeTo(file *File) (err error) {
+	err = file.WriteHeader(FILEKIND_CATALOG)
+	if err != nil {return}
 	var nw int
-	var pos LBUINT = 0
+	var pos LBUINT = FORMAT_HEADER_SIZE
 	var vloc *ValueLocation
-	cat.RLock()
+	if cat.checkpoint != nil {
+		nw, err = file.LockedWriteAt(cat.checkpoint.Pack(), pos)
+		if err != nil {return}
+		pos = pos.Plus(nw)
+	}
 	for key, cr := range cat.index {
 		switch r := cr.(type) {
 		case *ValueLocation:
@@ -682,13 +907,10 @@ func (cat *Catalog) Save() (err error) {
 		case *Value:
 			vloc = r.ValueLocation
 		}
-		nw, err = cat.file.tmp.LockedWriteAt(vloc.Pack(key, cat.debug), pos)
+		nw, err = file.LockedWriteAt(vloc.Pack(key, cat.debug), pos)
 		if err != nil {return}
 		pos = pos.Plus(nw)
 	}
-	cat.file.tmp.Close()
-	err = cat.file.ReplaceWithTmpTwin()
-	cat.RUnlock()
 	return
 }
 
@@ -714,9 +936,11 @@ func (up *UserPermissions) Load() (err error) {
 
 // Write user permission file.
 func (up *UserPermissions) Save() (err error) {
-	up.file.tmp.Open(CREATE | WRITE_ONLY)
+	up.file.tmp.Open(CREATE | WRITE_ONLY | TRUNCATE)
+	err = up.file.tmp.WriteHeader(FILEKIND_PERMISSION)
+	if err != nil {return}
 	var nw int
-	var pos LBUINT = 0
+	var pos LBUINT = FORMAT_HEADER_SIZE
 	up.RLock()
 	for key, upr := range up.index {
 		nw, err = up.file.tmp.LockedWriteAt(
@@ -15,6 +15,7 @@ import (
 	//"bufio"
 	"encoding/binary"
 	"sync"
+	"sync/atomic"
 	"fmt"
 )
 
@@ -23,10 +24,10 @@ const (
 	TMPFILE_PREFIX      string = ".tmp."
 )
 
-type LBUINT uint32 // Unsigned Logbase integer type used on file
+type LBUINT uint64 // Unsigned Logbase integer type used on file
 
 const (
-	LBUINT_SIZE		LBUINT = 4 // bytes 
+	LBUINT_SIZE		LBUINT = 8 // bytes, from format v2
 	LBUINT_SIZE_x2  LBUINT = 2 * LBUINT_SIZE
 	LBUINT_SIZE_x3  LBUINT = 3 * LBUINT_SIZE
 	LBUINT_SIZE_x4  LBUINT = 4 * LBUINT_SIZE
@@ -39,6 +40,7 @@ const (
 	WRITE_ONLY			int = os.O_WRONLY
 	READ_WRITE			int = os.O_RDWR
 	CREATE				int = os.O_CREATE
+	TRUNCATE			int = os.O_TRUNC
 )
 
 const (
@@ -46,7 +48,7 @@ const (
 	LOCK_WHILE_READING = iota
 )
 
-var fileCounter int = 0 // for debugging only
+var fileCounter int64 = 0 // for debugging only
 
 // Wrap an os file with a current pointer.
 type File struct {
@@ -56,8 +58,16 @@ type File struct {
 	sync.RWMutex
 	debug   *gubed.Logger
 	isOpen  bool // its ok to have multiple opens of same gofile
+	opens	int // number of opens not yet closed
+	flags	int // flags of the current gofile
+	openlock sync.Mutex // guards the open state
 	size    int // size in bytes
 	tmp		*File // temporary "twin" file
+	version	uint8 // format version, 0 if empty
+	kind	uint8 // kind of file given in the header
+	appender Appender // persistent append handle, when writing
+	mapping	[]byte // read-only memory map of the file, if mapped
+	maplock	sync.Mutex // guards the mapping
 }
 
 func NewFile() *File {
@@ -77,28 +87,37 @@ func Exists(abspath string) bool {
 // and ensure proper initialisation.
 func (lbase *Logbase) GetFile(relpath string) (*File, bool, error) {
 	fpath := path.Join(lbase.abspath, relpath)
-	// Check cache
-	obj, present := lbase.FileCache().objects[fpath]
-	if present {return obj.(*File), true, nil}
-
-	// Create file and its tmp twin
-	file := lbase.MakeFile(fpath)
-	// The tmp twin
-	file.tmp = lbase.MakeFile(file.TmpTwinPath())
-
-	err := file.Touch()
+	// Check cache, or create the file and its tmp twin.  The file is touched
+	// before it is cached, so no other caller sees it before its size and
+	// version are set.
+	var err error
+	obj, present := lbase.FileCache().GetOrMake(fpath, func() interface{} {
+		file := lbase.NewCachelessFile(fpath)
+		// The tmp twin
+		file.tmp = lbase.NewCachelessFile(file.TmpTwinPath())
+		err = file.Touch()
+		return file
+	})
+	file := obj.(*File)
+	if present {return file, true, nil}
+	lbase.FileCache().Put(file.tmp.abspath, file.tmp)
 	return file, false, err
 }
 
 // Construct a new file.
 func (lbase *Logbase) MakeFile(path string) (file *File) {
+	file = lbase.NewCachelessFile(path)
+	// Add to cache
+	lbase.FileCache().Put(file.abspath, file)
+	return file
+}
+
+// Construct a new file without adding it to the file cache.
+func (lbase *Logbase) NewCachelessFile(path string) (file *File) {
 	file = NewFile()
-	file.id = fileCounter
-	fileCounter++
+	file.id = int(atomic.AddInt64(&fileCounter, 1) - 1)
 	file.abspath = path
 	file.debug = lbase.debug
-	// Add to cache
-	lbase.FileCache().objects[file.abspath] = file
 	return file
 }
 
@@ -106,25 +125,43 @@ func OpenFile(abspath string, flags int) (*os.File, error) {
 	return os.OpenFile(abspath, flags, DEFAULT_FILEMODE)
 }
 
-// A tailored file opener for full create/append/rw.
+// A tailored file opener for full create/append/rw.  Anything buffered for
+// appending is written out first.  The file size is tracked rather than
+// read from the file system, so is only reset here on truncation.  Opens
+// are counted, so that concurrent readers share the one gofile, which is
+// only closed by the last Close.  While the file is open, it cannot be
+// opened again with different flags.
 func (file *File) Open(flags int) (err error) {
+	err = file.Flush()
+	if err != nil {return}
+	file.openlock.Lock()
+	defer file.openlock.Unlock()
+	if file.opens > 0 {
+		if flags != file.flags {
+			return FmtErrFileMode(file.abspath, flags, file.flags)
+		}
+		file.opens++
+		return
+	}
 	var gfile *os.File
 	gfile, err = OpenFile(file.abspath, flags)
 	if err == nil {
 		file.gofile = gfile
+		file.flags = flags
 		file.isOpen = true
-		info, err2 := os.Stat(file.abspath)
-		if err2 != nil {
-			err = err2
-			return
-		}
-		file.size = int(info.Size())
+		file.opens++
+		if flags & TRUNCATE != 0 {file.size = 0}
 	}
 	return
 }
 
-// Close file for IO.
+// Close file for IO, once every open of it has been closed.
 func (file *File) Close() (err error) {
+	file.openlock.Lock()
+	defer file.openlock.Unlock()
+	if file.opens == 0 {return os.ErrClosed}
+	file.opens--
+	if file.opens > 0 {return}
 	err = file.gofile.Close()
 	if err == nil {file.isOpen = false}
 	return
@@ -132,6 +169,8 @@ func (file *File) Close() (err error) {
 
 // Delete file.
 func (file *File) Remove() (err error) {
+	file.CloseAppender()
+	file.Unmap()
 	return os.Remove(file.abspath)
 }
 
@@ -164,7 +203,19 @@ func (file *File) Touch() error {
 	} else {
 		file.size = int(info.Size())
 	}
-	return nil
+	return file.ReadHeader()
+}
+
+// Cut the file back to the given size.
+func (file *File) Truncate(size LBUINT) (err error) {
+	file.CloseAppender()
+	file.Unmap()
+	file.Lock()
+	err = os.Truncate(file.abspath, int64(size))
+	if err == nil {file.size = int(size)}
+	file.Unlock()
+	if err == nil {err = file.ReadHeader()}
+	return
 }
 
 // Returns the current file position.
@@ -236,11 +287,13 @@ func (file *File) TmpTwinPath() string {
 
 // Replace the file with its temporary twin.
 func (file *File) ReplaceWithTmpTwin() (err error) {
+	if err = file.tmp.CloseAppender(); err != nil {return}
 	file.Lock()
 	if err = file.Remove(); file.debug.Error(err) != nil {return}
 	err = os.Rename(file.tmp.abspath, file.abspath)
 	file.debug.Error(err)
 	file.Unlock()
+	if err == nil {err = file.Touch()}
 	return
 }
 
@@ -253,13 +306,14 @@ func (file *File) Process(process Processor, rectype int, needDataVal bool) (err
 	file.Open(READ_ONLY)
 	defer file.Close()
 	var rec *GenericRecord
-	var pos LBUINT = 0
+	var pos LBUINT = file.HeaderSize()
 	var err2 error
 	for {
 		rec, pos, err = file.ReadRecord(pos, rectype, needDataVal)
 		file.debug.Fine("Process generic rec = %v pos = %v err = %v", rec, pos, err)
+		if err != nil {break} // don't process a partial record
 		err2 = process(rec)
-		if err != nil || err2 != nil {break}
+		if err2 != nil {break}
 	}
 	if err == io.EOF {err = nil}
 	if err == nil && err2 != nil {err = err2}
@@ -269,9 +323,11 @@ func (file *File) Process(process Processor, rectype int, needDataVal bool) (err
 // Read a record from the gofile, including the value depending on readDataVal.
 func (file *File) ReadRecord(pos LBUINT, rectype int, readDataVal bool) (rec *GenericRecord, newpos LBUINT, err error) {
 	rec = NewGenericRecord()
+	rec.usz = file.UintSize()
+	rec.ssz = file.StampSize()
 	// Key size
-	size := LBUINT(ParamSize(rec.ksz))
-	err = file.ReadIntoParam(pos, size, &rec.ksz, "keysize") // implicitely moves position
+	size := rec.usz
+	rec.ksz, err = file.ReadLBUINT(pos, "keysize") // implicitely moves position
 	if err != nil {return}
 
 	pos += size
@@ -281,9 +337,8 @@ func (file *File) ReadRecord(pos LBUINT, rectype int, readDataVal bool) (rec *Ge
 	var readvsz = FileDecodeConfigs[rectype].readDataValueSize
 
 	if readvsz {
-		size := LBUINT(ParamSize(rec.vsz))
 		// Generic value size
-	    err = file.ReadIntoParam(pos, size, &rec.vsz, "generic valsize")
+	    rec.vsz, err = file.ReadLBUINT(pos, "generic valsize")
 		if err != nil {return}
 		pos += size
 		file.Goto(pos)
@@ -305,7 +360,7 @@ func (file *File) ReadRecord(pos LBUINT, rectype int, readDataVal bool) (rec *Ge
 	if readvsz {
 		if readDataVal {valsize = rec.vsz} // otherwise, valsize = 0
 	} else {
-		valsize = FileDecodeConfigs[rectype].genericValueSize
+		valsize = FileDecodeConfigs[rectype].GenericValueSize(rec.usz, rec.ssz)
 	}
 
 	if valsize > 0 {
@@ -0,0 +1,163 @@
+/*
+	Versioning of the on-disk format.
+
+	Format v1 files have no header, and store sizes and positions as 32 bit
+	unsigned integers, limiting files and values to 4 GB.  From format v2,
+	every logfile, index, catalog, zapmap and user permission file begins with
+	a header, and sizes and positions are stored as 64 bit unsigned integers.
+	From format v3, each log and index record carries a stamp, the sequence
+	number and wall-clock time of its writing (see history.go).
+
+	FORMAT HEADER (v2 onwards)
+	+------+------+------+------+------+------+------+------+
+	|             |      |      |             |
+	|    MAGIC    |  FV  |  FK  |  reserved   |  8 bytes
+	|             |      |      |             |
+	+------+------+------+------+------+------+------+------+
+
+	Positions in a file are counted from the start of the file, including the
+	header.  Files in older formats can still be read, but are never written
+	to, except by Migrate which rewrites every old file of a logbase in the
+	current format.
+*/
+package logbase
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+)
+
+const (
+	FORMAT_V1			uint8 = 1
+	FORMAT_V2			uint8 = 2
+	FORMAT_V3			uint8 = 3
+	FORMAT_CURRENT		uint8 = FORMAT_V3
+	FORMAT_MAGIC		string = "\x89LBF"
+	FORMAT_HEADER_SIZE	LBUINT = 8 // bytes
+	LBUINT_SIZE_V1		LBUINT = 4 // bytes
+)
+
+// The kind of file, recorded in the header.
+const (
+	FILEKIND_LOG		uint8 = 1
+	FILEKIND_INDEX		uint8 = 2
+	FILEKIND_CATALOG	uint8 = 3
+	FILEKIND_ZAPMAP		uint8 = 4
+	FILEKIND_PERMISSION	uint8 = 5
+)
+
+// Return a format header for the current format.
+func MakeFormatHeader(kind uint8) []byte {
+	hdr := make([]byte, FORMAT_HEADER_SIZE)
+	copy(hdr, FORMAT_MAGIC)
+	hdr[len(FORMAT_MAGIC)] = FORMAT_CURRENT
+	hdr[len(FORMAT_MAGIC) + 1] = kind
+	return hdr
+}
+
+// Work out the format version of the file from its header.  An empty file
+// has no version yet.
+func (file *File) ReadHeader() error {
+	file.version = 0
+	if file.size == 0 {return nil}
+	file.version = FORMAT_V1
+	if file.size < int(FORMAT_HEADER_SIZE) {return nil}
+	gofile, err := OpenFile(file.abspath, READ_ONLY)
+	if err != nil {return err}
+	defer gofile.Close()
+	hdr := make([]byte, FORMAT_HEADER_SIZE)
+	_, err = gofile.ReadAt(hdr, 0)
+	if err != nil {return err}
+	if string(hdr[:len(FORMAT_MAGIC)]) == FORMAT_MAGIC {
+		file.version = hdr[len(FORMAT_MAGIC)]
+		file.kind = hdr[len(FORMAT_MAGIC) + 1]
+	}
+	return nil
+}
+
+// Write a current format header at the start of the file, which must be open
+// for writing.
+func (file *File) WriteHeader(kind uint8) error {
+	nw, err := file.LockedWriteAt(MakeFormatHeader(kind), 0)
+	if err != nil {return err}
+	if nw > file.size {file.size = nw}
+	file.version = FORMAT_CURRENT
+	file.kind = kind
+	return nil
+}
+
+// Append a current format header to the empty file, through its append
+// handle.
+func (file *File) AppendHeader(kind uint8) error {
+	_, err := file.Append(MakeFormatHeader(kind))
+	if err != nil {return err}
+	file.version = FORMAT_CURRENT
+	file.kind = kind
+	return nil
+}
+
+// Format version of the file, or 0 if it is empty.
+func (file *File) Version() uint8 {return file.version}
+
+// Is the file in the current format, or empty?
+func (file *File) IsCurrent() bool {
+	return file.version == 0 || file.version == FORMAT_CURRENT
+}
+
+// Size of the header, where records start.
+func (file *File) HeaderSize() LBUINT {
+	if file.version >= FORMAT_V2 {return FORMAT_HEADER_SIZE}
+	return 0
+}
+
+// Number of bytes used to store an LBUINT in the file.
+func (file *File) UintSize() LBUINT {
+	if file.version == FORMAT_V1 {return LBUINT_SIZE_V1}
+	return LBUINT_SIZE
+}
+
+// Number of bytes used to store the stamp of a log or index record in the
+// file, 0 before format v3.
+func (file *File) StampSize() LBUINT {
+	if file.version == FORMAT_V1 || file.version == FORMAT_V2 {return 0}
+	return STAMP_SIZE
+}
+
+// Read an LBUINT stored in the given number of bytes.
+func ReadLBUINT(rdr io.Reader, usz LBUINT, num *LBUINT) error {
+	if usz == LBUINT_SIZE_V1 {
+		var num32 uint32
+		err := binary.Read(rdr, BIGEND, &num32)
+		*num = LBUINT(num32)
+		return err
+	}
+	return binary.Read(rdr, BIGEND, num)
+}
+
+// Write an LBUINT in the given number of bytes.
+func WriteLBUINT(wtr io.Writer, usz LBUINT, num LBUINT) error {
+	if usz == LBUINT_SIZE_V1 {return binary.Write(wtr, BIGEND, uint32(num))}
+	return binary.Write(wtr, BIGEND, num)
+}
+
+// Read an LBUINT from the file at the given position, which must be open.
+func (file *File) ReadLBUINT(pos LBUINT, desc string) (num LBUINT, err error) {
+	usz := file.UintSize()
+	byts, err := file.LockedReadAt(pos, usz, desc)
+	if err != nil {return}
+	err = file.debug.Error(ReadLBUINT(bytes.NewBuffer(byts), usz, &num))
+	return
+}
+
+// Does the logbase contain any files in an old format?
+func (lbase *Logbase) NeedsMigration() (bool, error) {
+	paths, err := lbase.FormattedFilePaths()
+	if err != nil {return false, err}
+	for _, fpath := range paths {
+		file, _, err := lbase.GetFile(fpath)
+		if err != nil {return false, err}
+		if !file.IsCurrent() {return true, nil}
+	}
+	return false, nil
+}
@@ -0,0 +1,155 @@
+/*
+	Sequence numbers, timestamps and the history of a key.
+
+	From format v3, every log and index record carries a stamp, the sequence
+	number and wall-clock time at which it was appended to the live log.
+	Sequence numbers go up by one for each record, tombstones and batch
+	markers included, and carry on after a reopen from the Master Catalog
+	checkpoint and the records replayed after it.  A record moved by a zap,
+	merge or migration keeps its stamp.  Records written before format v3
+	have an empty stamp, so count as older than any other.
+
+	The stale values of a key stay in their logfiles, listed in the zapmap,
+	until they are zapped.  History reads them back along with the current
+	value, and GetAsOf picks out the value as of a sequence number or time,
+	for as long as the versions it needs have not been zapped or merged away.
+*/
+package logbase
+
+import (
+	"encoding/binary"
+	"io"
+	"sort"
+	"time"
+)
+
+// A value of a key, or its deletion, read back from its log record.
+type KeyVersion struct {
+	*Stamp
+	vbyts		[]byte
+	vtype		LBTYPE
+	expiry		int64 // Unix nanoseconds, 0 for none
+	fnum		LBUINT // where the record lies, to order unstamped versions
+	rpos		LBUINT
+}
+
+// Getters.
+
+func (kv *KeyVersion) Seq() uint64 {return kv.seq}
+func (kv *KeyVersion) Value() ([]byte, LBTYPE) {return kv.vbyts, kv.vtype}
+func (kv *KeyVersion) Expiry() int64 {return kv.expiry}
+
+// The time the version was written, or the zero time if not known.
+func (kv *KeyVersion) Time() time.Time {
+	if kv.ts == 0 {return time.Time{}}
+	return time.Unix(0, kv.ts)
+}
+
+// Is the version a tombstone, marking the deletion of the key?
+func (kv *KeyVersion) Deleted() bool {return kv.vtype == LBTYPE_NIL}
+
+// Had the value expired by the given time?
+func (kv *KeyVersion) Expired(now time.Time) bool {
+	return kv.expiry != 0 && now.UnixNano() >= kv.expiry
+}
+
+// Read a stamp, as stored in a log or index record.
+func ReadStamp(rdr io.Reader, stamp *Stamp) error {
+	err := binary.Read(rdr, BIGEND, &stamp.seq)
+	if err != nil {return err}
+	return binary.Read(rdr, BIGEND, &stamp.ts)
+}
+
+// Write a stamp, as stored in a log or index record.
+func WriteStamp(wtr io.Writer, stamp *Stamp) error {
+	err := binary.Write(wtr, BIGEND, stamp.seq)
+	if err != nil {return err}
+	return binary.Write(wtr, BIGEND, stamp.ts)
+}
+
+// The last sequence number handed out to a record.
+func (lbase *Logbase) LastSeq() uint64 {
+	lbase.RLock()
+	defer lbase.RUnlock()
+	return lbase.seq
+}
+
+// Return the versions of the key still held in the logbase, oldest first,
+// ending with the current value, or with the tombstone if the key has been
+// deleted.  Returns none if the key is unknown or its versions have all been
+// zapped.
+func (lbase *Logbase) History(key interface{}) (versions []*KeyVersion, err error) {
+	lbase.RLock() // don't let the values move while we read them
+	defer lbase.RUnlock()
+	ksz := AsLBUINT(len(KeyToBytes(key)) + LBTYPE_SIZE)
+	var rlocs []*RecordLocation
+	for _, zrec := range lbase.zmap.Get(key) {
+		rlocs = append(rlocs, zrec.RecordLocation)
+	}
+	if mcr := lbase.mcat.Get(key); mcr != nil {
+		rlocs = append(rlocs, lbase.RecordLocation(mcr.ToValueLocation(), ksz))
+	}
+	for _, rloc := range rlocs {
+		var kv *KeyVersion
+		kv, err = lbase.readVersion(rloc, ksz)
+		if err != nil {return nil, err}
+		if kv != nil {versions = append(versions, kv)}
+	}
+	sort.Slice(versions, func(i, j int) bool {
+		a, b := versions[i], versions[j]
+		if a.seq != b.seq {return a.seq < b.seq}
+		if a.fnum != b.fnum {return a.fnum < b.fnum}
+		return a.rpos < b.rpos
+	})
+	return
+}
+
+// Read a version of a key from its log record, verifying its checksum.
+// Returns nil if the record is corrupt and the corruption policy is not to
+// fail.
+func (lbase *Logbase) readVersion(rloc *RecordLocation, ksz LBUINT) (*KeyVersion, error) {
+	lfile, err := lbase.GetLogfile(rloc.fnum)
+	if err != nil {return nil, err}
+	lrec, err := lbase.ReadLogfileRecord(lfile, rloc)
+	if err != nil {return nil, err}
+	if !lrec.Verify() || lrec.ksz != ksz {
+		return nil, lbase.HandleCorruption(
+			FmtErrCorruptRecord(lfile.abspath, lfile.fnum, rloc, lrec), nil)
+	}
+	kv := &KeyVersion{Stamp: lrec.Stamp, fnum: rloc.fnum, rpos: rloc.rpos}
+	kv.vbyts, kv.vtype, kv.expiry, err = lbase.UnpackValue(lrec.vbyts, lrec.vtype)
+	if err != nil {return nil, err}
+	return kv, nil
+}
+
+// Retrieve the value the key had as of the given sequence number (a uint64)
+// or time (a time.Time), that is the value of its last version up to then.
+// Returns nil if the key was absent, deleted or expired at that point, or if
+// the versions from then have since been zapped.
+func (lbase *Logbase) GetAsOf(key interface{}, asof interface{}) (vbyts []byte, vtype LBTYPE, err error) {
+	var at func(kv *KeyVersion) bool
+	var when time.Time
+	switch asof := asof.(type) {
+	case uint64:
+		at = func(kv *KeyVersion) bool {return kv.seq <= asof}
+	case time.Time:
+		when = asof
+		at = func(kv *KeyVersion) bool {return kv.ts <= asof.UnixNano()}
+	default:
+		err = FmtErrBadArgs(
+			"Point %v for key %v must be a sequence number (uint64) or a " +
+			"time.Time, not %T", asof, key, asof)
+		return
+	}
+	versions, err := lbase.History(key)
+	if err != nil {return}
+	var found *KeyVersion
+	for _, kv := range versions {
+		if at(kv) {found = kv}
+	}
+	if found == nil || found.Deleted() || (!when.IsZero() && found.Expired(when)) {
+		return nil, LBTYPE_NIL, nil
+	}
+	vbyts, vtype = found.Value()
+	return
+}
@@ -0,0 +1,274 @@
+/*
+	Checksum verification of log records, and the handling of corrupt data.
+
+	Every log record ends with a crc of the rest of the record.  Records are
+	verified when a logfile is indexed (e.g. Refresh(true)), and a configurable
+	fraction of uncached reads are also verified.  What happens to a corrupt
+	record depends on the CORRUPTION_POLICY in the logbase configuration:
+
+	fail		return a CorruptRecordError to the caller
+	skip		treat the record as absent, and report it
+	quarantine	as for skip, but also copy the raw record bytes to the
+				quarantine file, and drop the key from the catalogs
+*/
+package logbase
+
+import (
+	"math/rand"
+	"fmt"
+)
+
+const (
+	CORRUPTION_FAIL			string = "fail"
+	CORRUPTION_SKIP			string = "skip"
+	CORRUPTION_QUARANTINE	string = "quarantine"
+)
+
+// Return all corrupt records found since the logbase was made.
+func (lbase *Logbase) Corruptions() []*CorruptRecordError {
+	lbase.corruptlock.Lock()
+	defer lbase.corruptlock.Unlock()
+	return append([]*CorruptRecordError(nil), lbase.corrupt...)
+}
+
+// Should this read be verified, according to CRC_READ_SAMPLE_RATE?
+func (lbase *Logbase) SampleRead() bool {
+	rate := lbase.config.CRC_READ_SAMPLE_RATE
+	if rate <= 0 {return false}
+	if rate >= 1 {return true}
+	return rand.Float64() < rate
+}
+
+// Read the value for the given key and location, verifying the checksum of
+// the entire log record.
+func (lbase *Logbase) ReadVerifiedVal(key interface{}, vloc *ValueLocation) (val []byte, vtype LBTYPE, err error) {
+	lfile, err := vloc.Logfile(lbase)
+	if err != nil {return}
+	lrec, err := lbase.ReadVerifiedRecord(lfile, key, vloc)
+	if err != nil || lrec == nil {return}
+	val, vtype, _, err = lbase.UnpackValue(lrec.vbyts, lrec.vtype)
+	return
+}
+
+// Read the log record for the given key and location, verifying its checksum.
+// Returns a nil record if it is corrupt and the corruption policy is not to
+// fail.
+func (lbase *Logbase) ReadVerifiedRecord(lfile *Logfile, key interface{}, vloc *ValueLocation) (*LogRecord, error) {
+	ksz := AsLBUINT(len(KeyToBytes(key)) + LBTYPE_SIZE)
+	rloc := vloc.ToRecordLocation(ksz, lfile.UintSize(), lfile.StampSize())
+	lrec, err := lbase.ReadLogfileRecord(lfile, rloc)
+	if err != nil {return nil, err}
+	if !lrec.Verify() || lrec.ksz != ksz || lrec.vsz != vloc.vsz {
+		err = lbase.HandleCorruption(
+			FmtErrCorruptRecord(lfile.abspath, lfile.fnum, rloc, lrec), key)
+		return nil, err
+	}
+	return lrec, nil
+}
+
+// Read the log record starting at the given position.
+func (lfile *Logfile) ReadLogRecord(rpos LBUINT) (*LogRecord, error) {
+	lfile.Open(READ_ONLY)
+	defer lfile.Close()
+	rec, _, err := lfile.ReadRecord(rpos, LOG_RECORD, true)
+	if err != nil {return nil, err}
+	return rec.ToLogRecord(lfile.debug), nil
+}
+
+// Apply the configured corruption policy to the given corrupt record.  The
+// key may be nil if it cannot be trusted.  Returns an error only when the
+// policy is to fail.
+func (lbase *Logbase) HandleCorruption(cerr *CorruptRecordError, key interface{}) error {
+	switch lbase.config.CORRUPTION_POLICY {
+	case CORRUPTION_SKIP:
+		lbase.ReportCorruption(cerr)
+	case CORRUPTION_QUARANTINE:
+		lbase.ReportCorruption(cerr)
+		lbase.debug.Error(lbase.Quarantine(cerr, key))
+	default:
+		return lbase.debug.Error(cerr)
+	}
+	return nil
+}
+
+// Record a corrupt record for later inspection.
+func (lbase *Logbase) ReportCorruption(cerr *CorruptRecordError) {
+	lbase.debug.Error(cerr)
+	lbase.corruptlock.Lock()
+	lbase.corrupt = append(lbase.corrupt, cerr)
+	lbase.corruptlock.Unlock()
+	return
+}
+
+// Append the raw bytes of the corrupt record to the quarantine file.  If
+// the key is known, and the master catalog still points to the record, drop
+// the key and schedule the record for zapping.
+func (lbase *Logbase) Quarantine(cerr *CorruptRecordError, key interface{}) error {
+	lfile, err := lbase.GetLogfile(cerr.fnum)
+	if err != nil {return err}
+	byts, err := lfile.ReadVal(cerr.rpos, cerr.rsz)
+	if err != nil {return err}
+
+	qfile, _, err := lbase.GetFile(QUARANTINE_FILENAME)
+	if err != nil {return err}
+	lbase.corruptlock.Lock() // readers can find corruption concurrently
+	_, err = qfile.Append(byts)
+	if err == nil {err = qfile.CloseAppender()}
+	lbase.corruptlock.Unlock()
+	if err != nil {return err}
+	lbase.debug.Advise(
+		"Quarantined %d bytes from %s at position %d",
+		len(byts), lfile.abspath, cerr.rpos)
+
+	if key == nil {return nil}
+	mcr := lbase.mcat.Get(key)
+	if mcr == nil {return nil}
+	vloc := mcr.ToValueLocation()
+	rloc := vloc.ToRecordLocation(cerr.ksz, lfile.UintSize(), lfile.StampSize())
+	if vloc.fnum == cerr.fnum && rloc.rpos == cerr.rpos {
+		zrec := NewZapRecord()
+		zrec.RecordLocation = rloc
+		lbase.zmap.PutRecord(key, zrec)
+		lbase.RemoveFromCatalogs(key)
+	}
+	return nil
+}
+
+// Torn write recovery.
+
+// Summary of the recovery of the live log after a torn write.
+type RecoveryReport struct {
+	path		string // live log path
+	size		int // live log size before recovery
+	end			LBUINT // position of the end of the last good record
+	nindex		int // number of index records before recovery
+	nrecovered	int // number of index records after recovery
+	nsalvaged	int // number of records found that were missing from the index
+}
+
+// Number of bytes cut from the end of the live log.
+func (rep *RecoveryReport) DroppedBytes() int {return rep.size - int(rep.end)}
+
+// Did the recovery change the live log or its index file?
+func (rep *RecoveryReport) Changed() bool {
+	return rep.DroppedBytes() > 0 || rep.nindex != rep.nrecovered
+}
+
+func (rep *RecoveryReport) String() string {
+	return fmt.Sprintf(
+		"(path=%s size=%d end=%d dropped=%d nindex=%d nrecovered=%d nsalvaged=%d)",
+		rep.path,
+		rep.size,
+		rep.end,
+		rep.DroppedBytes(),
+		rep.nindex,
+		rep.nrecovered,
+		rep.nsalvaged)
+}
+
+// Return the report of the torn write recovery made during Init.
+func (lbase *Logbase) Recovery() *RecoveryReport {return lbase.recovery}
+
+// If the process died part way through writing to the live log, the log can
+// end with a partial record, and the index file can be missing records or
+// point past the end of the log.  Rescan the tail of the live log from the
+// last record in its index file that lies entirely within the log, truncate
+// the log after the last good record, and rewrite the index file to match.
+func (lbase *Logbase) RecoverLiveLog() (rep *RecoveryReport, err error) {
+	lfile := lbase.livelog
+	ifile := lfile.indexfile
+	rep = &RecoveryReport{path: lfile.abspath, size: lfile.size}
+	lfindex, err := ifile.Load()
+	if err != nil {return}
+	rep.nindex = len(lfindex.List)
+
+	// Keep the index records that lie within the log file
+	var keep []*IndexRecord
+	var start LBUINT = lfile.HeaderSize()
+	for _, irec := range lfindex.List {
+		rloc := irec.ToRecordLocation(lfile)
+		if int(rloc.rpos) + int(rloc.rsz) > lfile.size {break}
+		keep = append(keep, irec)
+	}
+	// Rescan from the start of the last of them
+	if len(keep) > 0 {
+		start = keep[len(keep) - 1].ToRecordLocation(lfile).rpos
+		keep = keep[:len(keep) - 1]
+	}
+	nkeep := len(keep)
+	irecs, corrupt, end, err := lfile.Scan(start)
+	if err != nil {return}
+	for _, cerr := range corrupt {
+		err = lbase.HandleCorruption(cerr, nil)
+		if err != nil {return}
+	}
+	keep = append(keep, irecs...)
+	// Drop any batch cut short before its commit marker
+	if i := UncommittedBatch(keep); i >= 0 {
+		end = keep[i].ToRecordLocation(lfile).rpos
+		keep = keep[:i]
+	}
+	rep.end = end
+	rep.nrecovered = len(keep)
+	if rep.nrecovered > rep.nindex {rep.nsalvaged = rep.nrecovered - rep.nindex}
+
+	if rep.DroppedBytes() > 0 {
+		lbase.debug.Advise(
+			"Truncating live log %s from %d to %d bytes after a torn write",
+			lfile.abspath, lfile.size, end)
+		err = lfile.Truncate(end)
+		if err != nil {return}
+	}
+	lfindex.List = keep
+	if nkeep + len(irecs) != rep.nindex || int(ifile.HeaderSize()) + len(lfindex.ToBytes()) != ifile.size {
+		lbase.debug.Advise(
+			"Rewriting index file %s with %d records, it had %d",
+			ifile.abspath, rep.nrecovered, rep.nindex)
+		err = ifile.Save(lfindex)
+		if err != nil {return}
+		ifile.Touch()
+	}
+	ifile.Index = lfindex
+	return
+}
+
+// Scan the log file from the given position, verifying each record.  Returns
+// index records for the good records, any corrupt records found along the way,
+// and the position just after the last good record.  A trailing record that is
+// incomplete, or fails its checksum, is taken to be a torn write and is not
+// reported as corrupt.
+func (lfile *Logfile) Scan(pos LBUINT) (irecs []*IndexRecord, corrupt []*CorruptRecordError, end LBUINT, err error) {
+	lfile.Open(READ_ONLY)
+	defer lfile.Close()
+	size := lfile.size
+	usz, ssz := lfile.UintSize(), lfile.StampSize()
+	var ksz, gvsz LBUINT
+	for int(pos) + int(2 * usz) <= size {
+		ksz, err = lfile.ReadLBUINT(pos, "keysize")
+		if err != nil {return}
+		gvsz, err = lfile.ReadLBUINT(pos + usz, "generic valsize")
+		if err != nil {return}
+		rsz := int(2 * usz) + int(ksz) + int(gvsz)
+		if ksz < LBUINT(LBTYPE_SIZE) || ksz > LBUINT(size) ||
+			gvsz < CRC_SIZE + ssz + LBUINT(LBTYPE_SIZE) || gvsz > LBUINT(size) ||
+			int(pos) + rsz > size {
+			break
+		}
+		var rec *GenericRecord
+		rec, _, err = lfile.ReadRecord(pos, LOG_RECORD, true)
+		if err != nil {return}
+		lrec := rec.ToLogRecord(lfile.debug)
+		irec := lrec.ToIndexRecord(lfile.debug)
+		irec.vpos = rec.vpos
+		if !lrec.Verify() {
+			if int(pos) + rsz == size {break}
+			corrupt = append(corrupt, FmtErrCorruptRecord(
+				lfile.abspath, lfile.fnum, irec.ToRecordLocation(lfile), lrec))
+		} else {
+			irecs = append(irecs, irec)
+		}
+		pos = pos.Plus(rsz)
+	}
+	end = pos
+	return
+}
@@ -0,0 +1,302 @@
+/*
+	Ordered iteration over the keys of a catalog.
+
+	Each Catalog keeps its keys in an OrderedKeys skiplist alongside its map,
+	ordered by CompareKeys, that is by LBTYPE and then by value.  An Iterator
+	walks the keys of a catalog in order, or in reverse, optionally from a
+	Seek key, within a Range or under a string Prefix, and up to a Limit.
+	Each step finds the key after the last one returned afresh, under the
+	catalog read lock, so that an iterator is never invalidated by writes to
+	the catalog between steps, and sees keys added after it started if they
+	sort after its position.  An iterator over a logbase skips the keys of
+	the chunks of streamed values (see stream.go).
+*/
+package logbase
+
+import (
+	"math/rand"
+	"strings"
+)
+
+const (
+	SKIPLIST_MAX_LEVEL int = 32
+	SKIPLIST_BRANCHING int = 4 // one in this many nodes rises a level
+)
+
+// A skiplist of keys in CompareKeys order.  Not safe for concurrent use on
+// its own, it is guarded by the lock of its catalog.
+type OrderedKeys struct {
+	head		*keyNode // sentinel, holds no key
+	tail		*keyNode // last node, or nil if empty
+	level		int // levels in use
+	length		int
+	rnd			*rand.Rand
+}
+
+type keyNode struct {
+	key			interface{}
+	next		[]*keyNode // one per level
+	prev		*keyNode // at the bottom level, nil for the first node
+}
+
+// Init an empty OrderedKeys.
+func NewOrderedKeys() *OrderedKeys {
+	return &OrderedKeys{
+		head:	&keyNode{next: make([]*keyNode, SKIPLIST_MAX_LEVEL)},
+		level:	1,
+		rnd:	rand.New(rand.NewSource(1)),
+	}
+}
+
+func (ok *OrderedKeys) Len() int {return ok.length}
+
+// Return the nodes at each level whose next node is the first with a key at
+// or after the given key.
+func (ok *OrderedKeys) path(key interface{}) []*keyNode {
+	path := make([]*keyNode, SKIPLIST_MAX_LEVEL)
+	node := ok.head
+	for lvl := ok.level - 1; lvl >= 0; lvl-- {
+		for node.next[lvl] != nil && CompareKeys(node.next[lvl].key, key) < 0 {
+			node = node.next[lvl]
+		}
+		path[lvl] = node
+	}
+	return path
+}
+
+// Add the key, if it is not already present.
+func (ok *OrderedKeys) Insert(key interface{}) {
+	path := ok.path(key)
+	if next := path[0].next[0]; next != nil && CompareKeys(next.key, key) == 0 {
+		return
+	}
+	lvl := 1
+	for lvl < SKIPLIST_MAX_LEVEL && ok.rnd.Intn(SKIPLIST_BRANCHING) == 0 {lvl++}
+	for ; ok.level < lvl; ok.level++ {path[ok.level] = ok.head}
+	node := &keyNode{key: key, next: make([]*keyNode, lvl)}
+	for i := 0; i < lvl; i++ {
+		node.next[i] = path[i].next[i]
+		path[i].next[i] = node
+	}
+	if path[0] != ok.head {node.prev = path[0]}
+	if node.next[0] == nil {
+		ok.tail = node
+	} else {
+		node.next[0].prev = node
+	}
+	ok.length++
+	return
+}
+
+// Remove the key, if it is present.
+func (ok *OrderedKeys) Delete(key interface{}) {
+	path := ok.path(key)
+	node := path[0].next[0]
+	if node == nil || CompareKeys(node.key, key) != 0 {return}
+	for i := range node.next {path[i].next[i] = node.next[i]}
+	if node.next[0] == nil {
+		ok.tail = node.prev
+	} else {
+		node.next[0].prev = node.prev
+	}
+	for ok.level > 1 && ok.head.next[ok.level - 1] == nil {ok.level--}
+	ok.length--
+	return
+}
+
+// Return the first key after the given key, or at it if inclusive, or the
+// first key of all if the given key is nil.
+func (ok *OrderedKeys) After(key interface{}, inclusive bool) (interface{}, bool) {
+	if key == nil {
+		if first := ok.head.next[0]; first != nil {return first.key, true}
+		return nil, false
+	}
+	node := ok.path(key)[0].next[0]
+	if node != nil && !inclusive && CompareKeys(node.key, key) == 0 {
+		node = node.next[0]
+	}
+	if node == nil {return nil, false}
+	return node.key, true
+}
+
+// Return the last key before the given key, or at it if inclusive, or the
+// last key of all if the given key is nil.
+func (ok *OrderedKeys) Before(key interface{}, inclusive bool) (interface{}, bool) {
+	if key == nil {
+		if ok.tail != nil {return ok.tail.key, true}
+		return nil, false
+	}
+	node := ok.path(key)[0].next[0] // first at or after the key
+	if inclusive && node != nil && CompareKeys(node.key, key) == 0 {
+		return node.key, true
+	}
+	if node == nil {
+		node = ok.tail
+	} else {
+		node = node.prev
+	}
+	if node == nil {return nil, false}
+	return node.key, true
+}
+
+// Iteration.
+
+// Walks the keys of a catalog in order.  Set it up with the chainable
+// methods before the first call to Next.
+type Iterator struct {
+	cat			*Catalog
+	lbase		*Logbase // to read values, if iterating the Master Catalog
+	lo, hi		interface{} // bounds, inclusive and exclusive, nil if open
+	prefix		*string // only string keys starting with this
+	reverse		bool
+	limit		int // 0 for none
+	count		int // keys returned so far
+	pos			interface{} // last key returned, or the seek key
+	inclusive	bool // whether pos itself may be returned next
+	key			interface{} // current key
+	cr			CatalogRecord // current record
+	done		bool
+}
+
+// Return an iterator over all keys of the catalog, in ascending order.
+func (cat *Catalog) Iterator() *Iterator {
+	return &Iterator{cat: cat}
+}
+
+// Return an iterator over all keys of the logbase, in ascending order.
+func (lbase *Logbase) Iterator() *Iterator {
+	return &Iterator{cat: lbase.mcat, lbase: lbase}
+}
+
+// Only return keys from lo, inclusive, to hi, exclusive.  Either may be nil
+// for no bound.
+func (it *Iterator) Range(lo, hi interface{}) *Iterator {
+	it.lo, it.hi = lo, hi
+	return it
+}
+
+// Only return string keys starting with the prefix.
+func (it *Iterator) Prefix(prefix string) *Iterator {
+	it.prefix = &prefix
+	return it
+}
+
+// Return keys in descending order.
+func (it *Iterator) Reverse() *Iterator {
+	it.reverse = true
+	return it
+}
+
+// Return no more than n keys in all.
+func (it *Iterator) Limit(n int) *Iterator {
+	it.limit = n
+	return it
+}
+
+// Move so that Next returns the first key at or after the given key, or at
+// or before it if in reverse.
+func (it *Iterator) Seek(key interface{}) *Iterator {
+	it.pos = key
+	it.inclusive = true
+	it.done = false
+	return it
+}
+
+// Getters.
+
+func (it *Iterator) Key() interface{} {return it.key}
+func (it *Iterator) Record() CatalogRecord {return it.cr}
+
+// Read the value of the current key from the logbase.  Returns nil if the key
+// has been deleted since it was reached.
+func (it *Iterator) Value() (vbyts []byte, vtype LBTYPE, err error) {
+	if it.lbase == nil {
+		err = FmtErrBadArgs("Only an iterator over a logbase can read values")
+		return
+	}
+	vbyts, vtype, _, err = it.lbase.Get(it.key)
+	return
+}
+
+// Move to the next key, returning false when there are no more.
+func (it *Iterator) Next() bool {
+	if it.done || (it.limit > 0 && it.count >= it.limit) {return it.stop()}
+	it.cat.RLock()
+	defer it.cat.RUnlock()
+	key, found := it.start()
+	for found && it.lbase != nil && IsChunkId(key) {
+		it.pos, it.inclusive = key, false // chunks of streamed values
+		key, found = it.start()
+	}
+	if !found || !it.inBounds(key) {return it.stop()}
+	it.pos, it.inclusive = key, false
+	it.key, it.cr = key, it.cat.index[key]
+	it.count++
+	return true
+}
+
+// Find the next key from the position, moved up to the start of the range
+// or prefix if it lies before it.  The key may lie past their end.
+func (it *Iterator) start() (interface{}, bool) {
+	pos, inclusive := it.pos, it.inclusive
+	if it.reverse {
+		hi := it.hi
+		if it.prefix != nil {
+			if end := PrefixEnd(*it.prefix); end != nil &&
+				(hi == nil || CompareKeys(end, hi) < 0) {hi = end}
+		}
+		if hi != nil && (pos == nil || CompareKeys(pos, hi) >= 0) {
+			pos, inclusive = hi, false
+		}
+		return it.cat.order.Before(pos, inclusive || pos == nil)
+	}
+	lo := it.lo
+	if it.prefix != nil && (lo == nil || CompareKeys(lo, *it.prefix) < 0) {
+		lo = *it.prefix
+	}
+	if lo != nil && (pos == nil || CompareKeys(pos, lo) < 0) {
+		pos, inclusive = lo, true
+	}
+	return it.cat.order.After(pos, inclusive || pos == nil)
+}
+
+// Has the iteration not yet passed the end of its range or prefix?
+func (it *Iterator) inBounds(key interface{}) bool {
+	if it.reverse {
+		if it.lo != nil && CompareKeys(key, it.lo) < 0 {return false}
+		if it.prefix != nil && CompareKeys(key, *it.prefix) < 0 {return false}
+		return true
+	}
+	if it.hi != nil && CompareKeys(key, it.hi) >= 0 {return false}
+	if it.prefix != nil {
+		str, ok := key.(string)
+		if !ok || !strings.HasPrefix(str, *it.prefix) {return false}
+	}
+	return true
+}
+
+// Return the least string after every string starting with the prefix, or
+// nil if there is none.
+func PrefixEnd(prefix string) interface{} {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i + 1])
+		}
+	}
+	return nil
+}
+
+func (it *Iterator) stop() bool {
+	it.done = true
+	it.key, it.cr = nil, nil
+	return false
+}
+
+// Return the keys of the iterator, up to its limit, from its position.
+func (it *Iterator) Keys() []interface{} {
+	var keys []interface{}
+	for it.Next() {keys = append(keys, it.key)}
+	return keys
+}
@@ -86,6 +86,10 @@
 	| value position, bytes (LBUINT) |   |
 	+--------------------------------+ --+
 
+	A key is deleted by appending a "tombstone" record, with an LBTYPE_NIL value, to the live log.  The key is removed from the master catalog, and both the old value and the tombstone are added to the zapmap.  When the master catalog is rebuilt from index files, a tombstone removes the key again, so that deleted keys stay deleted until the tombstone itself is zapped.
+
+	A Logbase is safe for concurrent use.  The logbase RWMutex is held for writing by anything that appends to the live log, rolls it over or moves data in the logfiles (Put, Delete, the conditional writes, WriteBatch.Commit, Zap, Merge, Migrate, Save and Close), and for reading by Get, so that a value cannot move while it is read.  Writers wait for durable syncs after releasing it.  Below it, each Catalog and the Zapmap has its own RWMutex, a Catalog's CATID counter has a separate mutex, and each Cache (of catalogs, files and nodes) is locked internally.  Each File counts its opens so that concurrent readers share one handle, and its Appender has a mutex for the write buffer.  The Syncer, the Compactor and the Reaper each have their own mutex, as does each Snapshot, and the logfile pins of snapshots, corruption reports and the quarantine file are each guarded by one more.  Locks are always taken in that order, from the logbase lock down.
+
 	Thanks to André Luiz Alves Moraes for the gocask demonstration code from which I drew inspiration while learning Go.
 */
 package logbase
@@ -96,6 +100,8 @@ import (
 	"os"
 	"path"
 	"path/filepath"
+	"sync"
+	"time"
 )
 
 // Logbase database instance.
@@ -112,6 +118,17 @@ type Logbase struct {
 	catcache    *Cache  // CatalogCache cache
 	filecache   *Cache  // File cache
 	nodecache   *Cache  // Node cache
+	corrupt		[]*CorruptRecordError // Corrupt records found so far
+	corruptlock	sync.Mutex // guards corrupt and the quarantine file
+	recovery	*RecoveryReport // Torn write recovery of the live log at init
+	compactor	*Compactor // Background compaction, if started
+	reaper		*Reaper // Background deletion of expired keys, if started
+	keyring		*Keyring // Keys for encrypting values, nil if none
+	syncer		*Syncer // Syncs writes to the log files
+	pins		map[LBUINT]int // Snapshots holding each logfile
+	pinlock		sync.Mutex // guards pins
+	seq			uint64 // Last record sequence number handed out
+	sync.RWMutex // Held to write to, or move data in, the logfiles
 }
 
 // Getters.
@@ -128,6 +145,8 @@ func (lbase *Logbase) Users() *Users {return lbase.users}
 func (lbase *Logbase) CatalogCache() *Cache {return lbase.catcache}
 func (lbase *Logbase) FileCache() *Cache {return lbase.filecache}
 func (lbase *Logbase) NodeCache() *Cache {return lbase.nodecache}
+func (lbase *Logbase) Compactor() *Compactor {return lbase.compactor}
+func (lbase *Logbase) Syncer() *Syncer {return lbase.syncer}
 
 // Make a new Logbase instance based on the given directory path.
 func MakeLogbase(abspath string, debug *gubed.Logger) *Logbase {
@@ -143,14 +162,17 @@ func MakeLogbase(abspath string, debug *gubed.Logger) *Logbase {
 
 // Initialise embedded fields.
 func NewLogbase(debug *gubed.Logger) *Logbase {
-	return &Logbase{
+	lbase := &Logbase{
 	    mcat:		MakeMasterCatalog(debug),
 	    zmap:		MakeZapmap(debug),
 		users:		NewUsers(),
 	    catcache:	NewCache(),
 	    filecache:	NewCache(),
 	    nodecache:	NewCache(),
+		pins:		make(map[LBUINT]int),
 	}
+	lbase.syncer = NewSyncer(lbase)
+	return lbase
 }
 
 // Per Logbase configuration
@@ -164,6 +186,37 @@ type LogbaseConfiguration struct {
 	// value is small enough, we can also keep it in RAM for speed 
 	CACHE_VALUES			bool
 	CACHE_VALUE_MAXSIZE		int
+	// Fraction of uncached reads for which the record checksum is verified,
+	// from 0 (never) to 1 (always)
+	CRC_READ_SAMPLE_RATE	float64
+	// What to do with a corrupt record, "fail", "skip" or "quarantine"
+	CORRUPTION_POLICY		string
+	// Background compaction of sealed logfiles
+	COMPACTION_AUTO			bool // Start the compactor at init
+	COMPACTION_STALE_RATIO	float64 // Compact logfiles at least this stale
+	COMPACTION_INTERVAL_SECS int // Time between compaction passes
+	COMPACTION_MAX_BYTES_PER_SEC int // IO rate limit, 0 for none
+	// When to sync writes to disk, "always", "interval" or "os"
+	DURABILITY				string
+	SYNC_INTERVAL_MS		int // Time between syncs for "interval"
+	MMAP_READS				bool // Read sealed logfiles through memory maps
+	// Background deletion of expired keys
+	EXPIRY_REAPER_AUTO		bool // Start the reaper at init
+	EXPIRY_REAP_INTERVAL_SECS int // Time between reaper passes
+	// Compression of values as they are stored
+	COMPRESS_VALUES			bool
+	COMPRESS_MIN_SIZE		int // Smallest value to compress, in bytes
+	// Encryption of values as they are stored, with a key derived from a
+	// passphrase or the contents of a key file, and the old keys still
+	// needed to read values until they are rekeyed
+	ENCRYPTION_PASSPHRASE	string
+	ENCRYPTION_KEYFILE		string // Relative to the logbase directory
+	ENCRYPTION_OLD_PASSPHRASES []string
+	ENCRYPTION_OLD_KEYFILES	[]string
+	// Largest chunk of a value put with PutReader, in bytes
+	STREAM_CHUNK_SIZE		int
+	// Hard link sealed logfiles into a backup rather than copy them
+	BACKUP_HARD_LINKS		bool
 }
 
 // Default configuration in case file is absent.
@@ -174,6 +227,21 @@ func DefaultConfig() *LogbaseConfiguration {
 		LOGFILE_MAXBYTES:           1048576, // 1 MB
 		CACHE_VALUES:				true, // cache in RAM
 		CACHE_VALUE_MAXSIZE:        1024, // 1 KB
+		CRC_READ_SAMPLE_RATE:		1, // verify every read
+		CORRUPTION_POLICY:			CORRUPTION_FAIL,
+		COMPACTION_AUTO:			false,
+		COMPACTION_STALE_RATIO:		0.5,
+		COMPACTION_INTERVAL_SECS:	60,
+		COMPACTION_MAX_BYTES_PER_SEC: 4194304, // 4 MB/s
+		DURABILITY:					DURABILITY_OS,
+		SYNC_INTERVAL_MS:			100,
+		MMAP_READS:					false,
+		EXPIRY_REAPER_AUTO:			false,
+		EXPIRY_REAP_INTERVAL_SECS:	60,
+		COMPRESS_VALUES:			false,
+		COMPRESS_MIN_SIZE:			256,
+		STREAM_CHUNK_SIZE:			65536, // 64 KB
+		BACKUP_HARD_LINKS:			false,
 	}
 }
 
@@ -195,11 +263,29 @@ func (lbase *Logbase) HasLiveLog() bool {
 	return lbase.livelog != nil
 }
 
+// Return an error if no live log file has been defined.  The live log can
+// change under a writer, so the caller must hold the logbase lock.
+func (lbase *Logbase) CheckLiveLog() error {
+	if !lbase.HasLiveLog() {return FmtErrLiveLogUndefined()}
+	return nil
+}
+
 // Execute an orderly shutdown including finalisation of index and
 // zap files.
 func (lbase *Logbase) Close() error {
 	lbase.debug.Advise("Closing logbase %q...", lbase.name)
-	return lbase.Save()
+	if lbase.compactor != nil {lbase.compactor.Stop()}
+	if lbase.reaper != nil {lbase.reaper.Stop()}
+	if lbase.config.DURABILITY != DURABILITY_OS {
+		lbase.debug.Error(lbase.syncer.Stop())
+	}
+	lbase.Lock()
+	defer lbase.Unlock()
+	if lbase.livelog != nil {
+		lbase.debug.Error(lbase.livelog.CloseAppenders())
+	}
+	lbase.UnmapAll()
+	return lbase.save()
 }
 
 // If a valid master and zapmap file exists, load them, otherwise
@@ -230,6 +316,9 @@ func (lbase *Logbase) Init(makeit bool) error {
 	lbase.debug.Error(errcfg)
 	lbase.config = config
 
+	lbase.keyring, err = lbase.LoadKeyring()
+	if err != nil {return err}
+
 	// Wire up the Master and Zapmap files
 	lbase.debug.Error(lbase.mcat.InitFile(lbase))
 	var zfile *File
@@ -238,6 +327,15 @@ func (lbase *Logbase) Init(makeit bool) error {
 	zfile.Touch()
 	lbase.zmap.file = NewZapfile(zfile)
 
+	// Initialise livelog, and recover it from any torn write before the
+	// index files are used
+	if err = lbase.debug.Error(lbase.SetLiveLog()); err != nil {return err}
+	lbase.recovery, err = lbase.RecoverLiveLog()
+	if lbase.debug.Error(err) != nil {return err}
+	if lbase.recovery.Changed() {
+		lbase.debug.Advise("Recovered live log %s", lbase.recovery)
+	}
+
 	var buildmasterzap bool = true
 	if lbase.mcat.file.size > 0 {
 		if lbase.debug.Error(lbase.mcat.Load(lbase)) == nil {
@@ -254,6 +352,19 @@ func (lbase *Logbase) Init(makeit bool) error {
 		}
 	}
 
+	if !buildmasterzap {
+		// Replay any records written after the master file was saved
+		cp := lbase.mcat.checkpoint
+		if cp != nil {
+			lbase.seq = cp.seq
+			if err = lbase.debug.Error(lbase.Replay(cp, false)); err != nil {return err}
+		} else {
+			lbase.debug.Advise(
+				"Master file has no checkpoint, records written after it " +
+				"was saved are not replayed")
+		}
+	}
+
 	if buildmasterzap {
 		lbase.debug.Advise(
 			"Could not find or load master and zapmap files, " +
@@ -261,9 +372,6 @@ func (lbase *Logbase) Init(makeit bool) error {
 		if err = lbase.debug.Error(lbase.Refresh(false)); err != nil {return err}
 	}
 
-	// Initialise livelog
-	if err = lbase.debug.Error(lbase.SetLiveLog()); err != nil {return err}
-
 	// Load other Catalogs, order important, must be done after
 	// Master Catalog since other catalogs will use pointers to
 	// existing Values or ValueLocations.
@@ -274,6 +382,12 @@ func (lbase *Logbase) Init(makeit bool) error {
 		}
 	}
 
+	if lbase.config.COMPACTION_AUTO {lbase.StartCompactor()}
+	if lbase.config.EXPIRY_REAPER_AUTO {lbase.StartReaper()}
+	if lbase.config.DURABILITY == DURABILITY_INTERVAL {
+		lbase.syncer.Start(time.Duration(lbase.config.SYNC_INTERVAL_MS) * time.Millisecond)
+	}
+
 	lbase.debug.Advise("Completed init of logbase %q", lbase.name)
 	return nil
 }
@@ -287,44 +401,192 @@ func (lbase *Logbase) Put(key interface{}, vbyts []byte, vtype LBTYPE) (CatalogR
 			key, ValBytesToString(vbyts, vtype), lbase.name)
 	}
 
-	if lbase.HasLiveLog() {
-		lrec := MakeLogRecord(key, vbyts, vtype, lbase.debug)
-		aftersize := lbase.livelog.size + len(lrec.Pack())
-		if aftersize > lbase.config.LOGFILE_MAXBYTES {
-			lbase.NewLiveLog()
-		}
+	lbase.Lock()
+	mcr, err := lbase.put(key, vbyts, vtype)
+	seq := lbase.syncer.Last()
+	lbase.Unlock()
+	if err != nil {return nil, err}
+	return mcr, lbase.WaitDurable(seq)
+}
 
-		// Store data immediately to file
-	    irec, err := lbase.livelog.StoreData(lrec)
-		if lbase.debug.Error(err) != nil {return nil, err}
-		// Schedule old data for zapping
-		_, vloc := lbase.UpdateZapmap(irec, lbase.livelog.fnum)
-
-		// Update Master Catalog in RAM with value or its location
-		var mcr CatalogRecord
-		if lbase.config.CACHE_VALUES && lbase.OkToCacheValue(vbyts, vtype) {
-			v := vloc.ToValue(vbyts, vtype)
-			mcr = lbase.mcat.Update(key, v)
-		} else {
-			mcr = lbase.mcat.Update(key, vloc)
+// Put, for a caller holding the logbase lock.
+func (lbase *Logbase) put(key interface{}, vbyts []byte, vtype LBTYPE) (CatalogRecord, error) {
+	return lbase.putExpiring(key, vbyts, vtype, 0)
+}
+
+// Put with the given expiry time in Unix nanoseconds, or 0 for none, for a
+// caller holding the logbase lock.
+func (lbase *Logbase) putExpiring(key interface{}, vbyts []byte, vtype LBTYPE, expiry int64) (CatalogRecord, error) {
+	if err := lbase.CheckLiveLog(); err != nil {return nil, err}
+	if err := CheckPutType(key, vtype); err != nil {return nil, err}
+	lrec, err := lbase.MakeValueRecord(key, vbyts, vtype, expiry)
+	if err != nil {return nil, err}
+	irec, err := lbase.StoreReplacing(key, lrec)
+	if err != nil {return nil, err}
+	return lbase.ApplyPut(key, irec, vbyts, vtype), nil
+}
+
+// Make the log record for putting the key-value pair, compressing and
+// encrypting the value if configured to, and wrapping it with the expiry
+// time, if not 0.
+func (lbase *Logbase) MakeValueRecord(key interface{}, vbyts []byte, vtype LBTYPE, expiry int64) (*LogRecord, error) {
+	vbyts, vtype = lbase.CompressValue(vbyts, vtype)
+	vbyts, vtype, err := lbase.keyring.Seal(vbyts, vtype)
+	if err != nil {return nil, err}
+	if expiry != 0 {
+		vbyts, vtype = WrapExpiry(vbyts, vtype, expiry), LBTYPE_EXPIRY
+	}
+	return MakeLogRecord(key, vbyts, vtype, lbase.debug), nil
+}
+
+// An LBTYPE_NIL value marks a tombstone, and an LBTYPE_CHUNKED value or a
+// CHUNKID_TYPE key a streamed value, so cannot be put.
+func CheckPutType(key interface{}, vtype LBTYPE) error {
+	if vtype == LBTYPE_NIL {
+		return FmtErrBadType(
+			"Cannot put key %v with value type %v, which is reserved for " +
+			"tombstones, use Delete instead", key, vtype)
+	}
+	if vtype == LBTYPE_CHUNKED || IsChunkId(key) {
+		return FmtErrBadType(
+			"Cannot put key %v of type %T with value type %v, which are " +
+			"reserved for streamed values, use PutReader instead", key, key, vtype)
+	}
+	return nil
+}
+
+// Update the Zapmap and Master Catalog for a value just stored in the live
+// log.
+func (lbase *Logbase) ApplyPut(key interface{}, irec *IndexRecord, vbyts []byte, vtype LBTYPE) CatalogRecord {
+	// Schedule old data for zapping
+	_, vloc := lbase.UpdateZapmap(irec, lbase.livelog.fnum)
+
+	// Update Master Catalog in RAM with value or its location
+	if lbase.config.CACHE_VALUES && lbase.OkToCacheValue(vbyts, vtype) {
+		v := vloc.ToValue(vbyts, vtype)
+		return lbase.mcat.Update(key, v)
+	}
+	return lbase.mcat.Update(key, vloc)
+}
+
+// Remove the key from the logbase by appending a "tombstone" record, that is
+// a record with an LBTYPE_NIL value, to the live log.  The old value and the
+// tombstone itself are scheduled for zapping.
+func (lbase *Logbase) Delete(key interface{}) error {
+	lbase.debug.Basic("Deleting %v from logbase %s", key, lbase.name)
+	lbase.Lock()
+	err := lbase.del(key)
+	seq := lbase.syncer.Last()
+	lbase.Unlock()
+	if err != nil {return err}
+	return lbase.WaitDurable(seq)
+}
+
+// Delete, for a caller holding the logbase lock.
+func (lbase *Logbase) del(key interface{}) error {
+	if err := lbase.CheckLiveLog(); err != nil {return err}
+	if lbase.mcat.Get(key) == nil {return FmtErrKeyNotFound(key)}
+
+	lrec := MakeLogRecord(key, nil, LBTYPE_NIL, lbase.debug)
+	irec, err := lbase.StoreReplacing(key, lrec)
+	if err != nil {return err}
+	lbase.ApplyTombstone(irec, lbase.livelog.fnum)
+	return nil
+}
+
+// Append the log record to the live log, spawning a new live log first if
+// the record would push it past LOGFILE_MAXBYTES, or the live log is in an
+// old format.
+func (lbase *Logbase) StoreRecord(lrec *LogRecord) (*IndexRecord, error) {
+	irecs, err := lbase.StoreRecords([]*LogRecord{lrec}, false)
+	if err != nil {return nil, err}
+	return irecs[0], nil
+}
+
+// Append the log records to the live log in a single write, as for
+// StoreRecord, stamping each with the next sequence number and the time.
+// The records are never split across logfiles.
+func (lbase *Logbase) StoreRecords(lrecs []*LogRecord, sync bool) ([]*IndexRecord, error) {
+	now := time.Now().UnixNano()
+	for _, lrec := range lrecs {
+		lbase.seq++
+		lrec.seq, lrec.ts = lbase.seq, now
+	}
+	aftersize := lbase.livelog.size
+	for _, lrec := range lrecs {aftersize += len(lrec.Pack())}
+	if aftersize > lbase.config.LOGFILE_MAXBYTES || !lbase.livelog.IsCurrent() {
+		if err := lbase.NewLiveLog(); err != nil {return nil, err}
+	}
+
+	// Store data immediately to file
+	irecs, err := lbase.livelog.StoreRecords(lrecs, sync)
+	if err != nil {return nil, lbase.debug.Error(err)}
+	if lbase.config.DURABILITY == DURABILITY_OS {
+		err = lbase.livelog.Flush()
+		if err != nil {return nil, lbase.debug.Error(err)}
+	}
+	lbase.syncer.Written(lbase.livelog.File)
+	lbase.syncer.Written(lbase.livelog.indexfile.File)
+	return irecs, nil
+}
+
+// Update the Zapmap and all catalogs for a tombstone index record.  Both the
+// stale value and the tombstone are zapped, the tombstone only being needed
+// until older records for the key have been zapped from earlier logfiles.
+func (lbase *Logbase) ApplyTombstone(irec *IndexRecord, fnum LBUINT) {
+	key, vloc := lbase.UpdateZapmap(irec, fnum)
+	zrec := NewZapRecord()
+	// The tombstone may be replayed from a logfile in an old format
+	zrec.RecordLocation = lbase.RecordLocation(vloc, irec.ksz)
+	lbase.zmap.PutRecord(key, zrec)
+	lbase.RemoveFromCatalogs(key)
+	return
+}
+
+// Remove the key from the master catalog, any other catalogs kept updated,
+// and the node cache.
+func (lbase *Logbase) RemoveFromCatalogs(key interface{}) {
+	for _, obj := range lbase.catcache.Values() {
+		cat := obj.(*Catalog)
+		if cat.ismaster || cat.update {
+			if cat.Get(key) != nil {cat.Delete(key)}
 		}
-		return mcr, nil
 	}
-	return nil, FmtErrLiveLogUndefined()
+	if name, ok := key.(string); ok {lbase.nodecache.Delete(name)}
+	return
 }
 
 // Retrieve the value for the given key.  Snips off the value type
 // prepend from the value bytes.
 func (lbase *Logbase) Get(key interface{}) (vbyts []byte, vtype LBTYPE, mcr CatalogRecord, err error) {
+	lbase.RLock() // don't let the value move while we read it
+	defer lbase.RUnlock()
+	vbyts, vtype, mcr, err = lbase.get(key)
+	if err == nil && vtype == LBTYPE_CHUNKED {
+		vbyts, vtype, err = lbase.ReadChunks(key, vbyts, lbase.mcat.Get)
+	}
+	return
+}
+
+// Get, for a caller holding the logbase lock, at least for reading.  The
+// value of a streamed key is its chunk list.
+func (lbase *Logbase) get(key interface{}) (vbyts []byte, vtype LBTYPE, mcr CatalogRecord, err error) {
 	mcr = lbase.mcat.Get(key)
+	if mcr != nil && mcr.ToValueLocation().Expired(time.Now()) {mcr = nil}
 	if mcr == nil {
 		err = nil
 		vbyts = nil
 		vtype = LBTYPE_NIL
 	} else {
-		vbyts, vtype, err = mcr.ReadVal(lbase)
-		if lbase.config.CACHE_VALUES && lbase.OkToCacheValue(vbyts, vtype) {
-			if vloc, ok := mcr.(*ValueLocation); ok {
+		vloc, isvloc := mcr.(*ValueLocation)
+		vbyts, vtype, err = lbase.ReadCatalogRecord(key, mcr)
+		if err == nil && vbyts == nil {
+			// The record is corrupt but the policy is to carry on
+			mcr = nil
+			return
+		}
+		if err == nil && lbase.config.CACHE_VALUES && lbase.OkToCacheValue(vbyts, vtype) {
+			if isvloc {
 				mcr := vloc.ToValue(vbyts, vtype)
 				lbase.mcat.Put(key, mcr)
 			}
@@ -333,30 +595,139 @@ func (lbase *Logbase) Get(key interface{}) (vbyts []byte, vtype LBTYPE, mcr Cata
 	return
 }
 
+// Read the value of the catalog record for the given key, verifying the
+// checksum of a sample of the uncached reads.  Returns a nil value if the
+// record is corrupt but the policy is to carry on.  The caller must hold the
+// logbase lock, at least for reading.
+func (lbase *Logbase) ReadCatalogRecord(key interface{}, cr CatalogRecord) ([]byte, LBTYPE, error) {
+	if vloc, isvloc := cr.(*ValueLocation); isvloc && lbase.SampleRead() {
+		return lbase.ReadVerifiedVal(key, vloc)
+	}
+	return cr.ReadVal(lbase)
+}
+
 func (lbase *Logbase) NewLiveLog() error {
+	err := lbase.debug.Error(lbase.livelog.CloseAppenders())
+	if err != nil {return err}
 	lfile, err := lbase.GetLogfile(lbase.livelog.fnum + 1)
 	if err != nil {return err}
 	lbase.livelog = lfile
 	return nil
 }
 
+// Zap stale data from all logfiles.  Logfiles are zapped in ascending order
+// so that the older values of a deleted key are always zapped before (or
+// together with) its tombstone.  After each logfile is zapped, the catalogs
+// are remapped and saved along with the zapmap, so that the files on disk
+// stay consistent with the zapped logfile.
 func (lbase *Logbase) Zap(bufsz LBUINT) error {
+	lbase.Lock()
+	defer lbase.Unlock()
 	_, fnums, err := lbase.GetLogfilePaths()
 	if err != nil {return err}
 	for _, fnum := range fnums {
-		lfile, err := lbase.GetLogfile(fnum)
-		if err != nil {return err}
-		err = lfile.Zap(lbase.zmap, bufsz)
+		if lbase.IsPinned(fnum) {continue} // its zap records wait for later
+		_, err = lbase.ZapLogfile(fnum, bufsz)
 		if err != nil {return err}
 	}
 	return err
 }
 
+// Zap stale data from the given logfile, then remap and save the catalogs
+// and zapmap.  Returns the zapped records, or nil if there were none or the
+// logfile is pinned by a snapshot.  The caller must hold the logbase lock.
+func (lbase *Logbase) ZapLogfile(fnum LBUINT, bufsz LBUINT) (zl *Zaplists, err error) {
+	if lbase.IsPinned(fnum) {
+		lbase.debug.Fine("Not zapping logfile %d, it is pinned by a snapshot", fnum)
+		return
+	}
+	lfile := lbase.livelog
+	if fnum != lfile.fnum {
+		lfile, err = lbase.GetLogfile(fnum)
+		if err != nil {return}
+	}
+	hold, err := lbase.HeldTombstones(lfile)
+	if err != nil {return}
+	zl, err = lfile.Zap(lbase.zmap, bufsz, hold)
+	if err != nil || zl == nil {return}
+	lbase.RemapCatalogs(fnum, zl)
+	err = lbase.save()
+	return
+}
+
+// Return the positions of the tombstones in the logfile which must not be
+// zapped yet, because an older logfile still holds a zap record for the key.
+// Zapping such a tombstone first would bring the older value back on a
+// rebuild.
+func (lbase *Logbase) HeldTombstones(lfile *Logfile) (hold map[LBUINT]bool, err error) {
+	hold = make(map[LBUINT]bool)
+	var cands []*ZapRecord
+	lbase.zmap.RLock()
+	for _, zrecs := range lbase.zmap.zapmap {
+		var older bool = false
+		for _, zrec := range zrecs {
+			if zrec.fnum < lfile.fnum {older = true}
+		}
+		if !older {continue}
+		for _, zrec := range zrecs {
+			if zrec.fnum == lfile.fnum {cands = append(cands, zrec)}
+		}
+	}
+	lbase.zmap.RUnlock()
+	for _, zrec := range cands {
+		var lrec *LogRecord
+		lrec, err = lfile.ReadLogRecord(zrec.rpos)
+		if err != nil {return}
+		if lrec.vtype == LBTYPE_NIL {hold[zrec.rpos] = true}
+	}
+	return
+}
+
+// Move the value locations in the given logfile, in all catalogs, to their
+// positions after the given records were zapped from the file.  Catalogs can
+// share value locations, so each is moved only once.
+func (lbase *Logbase) RemapCatalogs(fnum LBUINT, zl *Zaplists) {
+	moved := make(map[*ValueLocation]bool)
+	for _, obj := range lbase.catcache.Values() {
+		cat := obj.(*Catalog)
+		cat.Lock()
+		for key, cr := range cat.index {
+			vloc := cr.ToValueLocation()
+			if vloc.fnum != fnum {continue}
+			wasmoved, done := moved[vloc]
+			if !done {
+				vpos, zapped := zl.Shift(vloc.vpos)
+				if zapped {
+					lbase.debug.Error(FmtErrDataMismatch(
+						"Live value for key %v in catalog %q at %v was zapped",
+						key, cat.Name(), vloc))
+				}
+				wasmoved = vpos != vloc.vpos
+				vloc.vpos = vpos
+				moved[vloc] = wasmoved
+			}
+			if wasmoved {cat.changed = true}
+		}
+		cat.Unlock()
+	}
+	if cp := lbase.mcat.checkpoint; cp != nil && cp.fnum == fnum {
+		cp.pos, _ = zl.Shift(cp.pos)
+		lbase.mcat.changed = true
+	}
+	return
+}
+
 // Regenerate the Master Catalog and Zapmap.  If the given switch
 // forceIndexRefresh is on, refresh each logfile index file, otherwise only
 // refresh each index if it is not present.
 func (lbase *Logbase) Refresh(forceIndexRefresh bool) error {
 	lbase.mcat.ResetId()
+	return lbase.Replay(nil, forceIndexRefresh)
+}
+
+// Update the Master Catalog and Zapmap from the index records written after
+// the given checkpoint, or from all index records if the checkpoint is nil.
+func (lbase *Logbase) Replay(cp *Checkpoint, forceIndexRefresh bool) error {
 	// Get logfile list
 	fpaths, fnums, err2 := lbase.GetLogfilePaths()
 	if lbase.debug.Error(err2) != nil {return err2}
@@ -367,7 +738,9 @@ func (lbase *Logbase) Refresh(forceIndexRefresh bool) error {
 
 	// Iterate through all log files
 	var refreshIndex bool
+	var nreplay int = 0
 	for i, fnum := range fnums {
+		if cp != nil && fnum < cp.fnum {continue}
 		lbase.debug.Fine("Scan log file %d index", fnum)
 		refreshIndex = forceIndexRefresh
 		ipath := path.Join(lbase.abspath, lbase.MakeIndexfileRelPath(fnum))
@@ -390,10 +763,73 @@ func (lbase *Logbase) Refresh(forceIndexRefresh bool) error {
 			}
 		}
 		if lbase.debug.Error(err) != nil {return err}
-		for _, irec := range lfindex.List {
-			key, vloc := lbase.UpdateZapmap(irec, fnum)
-			lbase.mcat.Update(key, vloc)
+		if lfindex == nil {continue}
+		n, err := lbase.ReplayIndex(lfindex, fnum, cp)
+		if err != nil {return err}
+		nreplay += n
+	}
+	if cp != nil {
+		lbase.debug.Advise("Replayed %d records written after checkpoint %s", nreplay, cp)
+	}
+	return nil
+}
+
+// Update the Master Catalog and Zapmap from the index records of the log
+// file, skipping those before the checkpoint, if it lies in the file, and
+// the records of a batch with no commit marker.  Returns the number of
+// records applied.
+func (lbase *Logbase) ReplayIndex(lfindex *Index, fnum LBUINT, cp *Checkpoint) (nreplay int, err error) {
+	var batch []*IndexRecord // records waiting for a commit marker
+	var inbatch bool
+	for _, irec := range lfindex.List {
+		if cp != nil && fnum == cp.fnum && irec.vpos < cp.pos {
+			continue
+		}
+		if irec.seq > lbase.seq {lbase.seq = irec.seq}
+		switch irec.ktype {
+		case LBTYPE_BATCH:
+			inbatch, batch = true, nil
+			continue
+		case LBTYPE_COMMIT:
+			for _, brec := range batch {
+				err = lbase.ApplyIndexRecord(brec, fnum)
+				if err != nil {return}
+				nreplay++
+			}
+			inbatch, batch = false, nil
+			continue
 		}
+		if inbatch {
+			batch = append(batch, irec)
+			continue
+		}
+		err = lbase.ApplyIndexRecord(irec, fnum)
+		if err != nil {return}
+		nreplay++
+	}
+	if inbatch {
+		lbase.debug.Advise(
+			"Ignored %d records of an uncommitted batch in log file %d",
+			len(batch), fnum)
 	}
+	return
+}
+
+// Update the Master Catalog and Zapmap with an index record, unless the
+// Master Catalog already points to it.
+func (lbase *Logbase) ApplyIndexRecord(irec *IndexRecord, fnum LBUINT) error {
+	tomb, err := lbase.IsTombstone(irec, fnum)
+	if lbase.debug.Error(err) != nil {return err}
+	if tomb {
+		lbase.ApplyTombstone(irec, fnum)
+		return nil
+	}
+	vloc := NewValueLocation()
+	vloc.FromIndexRecord(irec, fnum)
+	key, err := MakeKey(irec.kbyts, irec.ktype, lbase.debug)
+	if err != nil {return err}
+	if vloc.Equals(lbase.mcat.Get(key)) {return nil}
+	key, vloc = lbase.UpdateZapmap(irec, fnum)
+	lbase.mcat.Update(key, vloc)
 	return nil
 }
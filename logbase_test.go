@@ -3,9 +3,18 @@ package logbase
 import (
 	"testing"
 	"github.com/h00gs/gubed"
-	//"fmt"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"math"
+	"io/ioutil"
 	"os"
 	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
 )
 
 const (
@@ -485,3 +494,1916 @@ func TestFind(t *testing.T) {
 	}
 	lbase.MasterCatalog().Dump()
 }
+
+// Make a fresh logbase in its own directory, separate from the global test
+// logbase.
+func freshLogbase(name string, t *testing.T) *Logbase {
+	cwd, _ := os.Getwd()
+	lbpath := filepath.Join(cwd, name)
+	err := os.RemoveAll(lbpath)
+	if err != nil {t.Fatalf("Trouble deleting dir %s: %s", lbpath, err)}
+	lb := MakeLogbase(lbpath, lbase.debug)
+	err = lb.Init(true)
+	if err != nil {t.Fatalf("Could not create logbase %s: %s", lbpath, err)}
+	lb.config.LOGFILE_MAXBYTES = logfile_maxbytes
+	return lb
+}
+
+// Re-initialise the given logbase from scratch, optionally deleting the
+// master catalog and zapmap files to force a rebuild from the index files.
+func reopenLogbase(lb *Logbase, rebuild bool, t *testing.T) *Logbase {
+	err := lb.Close()
+	if err != nil {t.Fatalf("Problem closing logbase: %s", err)}
+	if rebuild {
+		os.RemoveAll(lb.mcat.file.abspath)
+		os.RemoveAll(lb.zmap.file.abspath)
+	}
+	lb2 := MakeLogbase(lb.abspath, lb.debug)
+	err = lb2.Init(false)
+	if err != nil {t.Fatalf("Could not re-initialise logbase: %s", err)}
+	lb2.config.LOGFILE_MAXBYTES = logfile_maxbytes
+	return lb2
+}
+
+// Delete a key and ensure it stays deleted through a rebuild and a zap.
+func TestDelete(t *testing.T) {
+	lb := freshLogbase("test_delete", t)
+	lb.Put("keep", []byte("kept"), LBTYPE_STRING)
+	lb.Put("gone", []byte("going"), LBTYPE_STRING)
+	lb.Put("gone", []byte("going going"), LBTYPE_STRING)
+	err := lb.Delete("gone")
+	if err != nil {t.Fatalf("Problem deleting key: %s", err)}
+	vbyts, _, mcr, _ := lb.Get("gone")
+	if vbyts != nil || mcr != nil {
+		t.Fatalf("Deleted key should be absent but has value %q", vbyts)
+	}
+	if n := len(lb.zmap.Get("gone")); n != 3 {
+		t.Fatalf("The zapmap should hold 3 records for the key, but has %d", n)
+	}
+	if lb.Delete("gone") == nil {
+		t.Fatalf("Deleting an absent key should return an error")
+	}
+	if _, err = lb.Put("nil", nil, LBTYPE_NIL); err == nil {
+		t.Fatalf("Putting a nil value, which would read as a tombstone, should fail")
+	}
+	err = lb.NewWriteBatch().Put("nil", nil, LBTYPE_NIL).Put("keep", nil, LBTYPE_STRING).Commit()
+	if err == nil || lb.mcat.Get("nil") != nil {
+		t.Fatalf("A batch with a nil value put should fail")
+	}
+
+	lb = reopenLogbase(lb, true, t)
+	vbyts, _, _, _ = lb.Get("gone")
+	if vbyts != nil {
+		t.Fatalf("Deleted key reappeared after rebuild with value %q", vbyts)
+	}
+	if n := len(lb.zmap.Get("gone")); n != 3 {
+		t.Fatalf("The rebuilt zapmap should hold 3 records for the key, but has %d", n)
+	}
+
+	err = lb.Zap(5)
+	if err != nil {t.Fatalf("Problem zapping logfiles: %s", err)}
+	if lb.zmap.Get("gone") != nil {
+		t.Fatalf("The key tombstone should have been zapped")
+	}
+	lrecs, _ := lb.livelog.Load()
+	for _, lrec := range lrecs {
+		if string(lrec.kbyts) == "gone" {
+			t.Fatalf("Zapped logfile still contains %s", lrec)
+		}
+	}
+	vbyts, _, _, _ = lb.Get("keep")
+	if string(vbyts) != "kept" {
+		t.Fatalf("Expected value %q for surviving key but got %q", "kept", vbyts)
+	}
+}
+
+// Flip the bits of a byte in the value of the given key, on file.
+func corruptValue(lb *Logbase, key interface{}, t *testing.T) {
+	vloc := lb.mcat.Get(key).ToValueLocation()
+	lfile, _ := lb.GetLogfile(vloc.fnum)
+	f, err := os.OpenFile(lfile.abspath, os.O_RDWR, 0)
+	if err != nil {t.Fatalf("Could not open %s: %s", lfile.abspath, err)}
+	defer f.Close()
+	b := make([]byte, 1)
+	f.ReadAt(b, int64(vloc.vpos) + 1)
+	b[0] = ^b[0]
+	f.WriteAt(b, int64(vloc.vpos) + 1)
+}
+
+// Detect corrupt records on read and refresh under each corruption policy.
+func TestCorruption(t *testing.T) {
+	lb := freshLogbase("test_corrupt", t)
+	lb.config.CACHE_VALUES = false
+	lb.Put("good", []byte("good value"), LBTYPE_STRING)
+	lb.Put("bad", []byte("bad value"), LBTYPE_STRING)
+	corruptValue(lb, "bad", t)
+
+	_, _, _, err := lb.Get("bad")
+	if _, ok := err.(*CorruptRecordError); !ok {
+		t.Fatalf("Expected a CorruptRecordError but got %v", err)
+	}
+
+	lb.config.CORRUPTION_POLICY = CORRUPTION_SKIP
+	vbyts, _, _, err := lb.Get("bad")
+	if err != nil || vbyts != nil {
+		t.Fatalf("A skipped corrupt record should give no value and no error, " +
+			"but gave %q and %v", vbyts, err)
+	}
+	if len(lb.Corruptions()) != 1 {
+		t.Fatalf("There should be 1 corruption reported, but there are %d",
+			len(lb.Corruptions()))
+	}
+
+	err = lb.Refresh(true)
+	if err != nil {t.Fatalf("Problem refreshing logbase: %s", err)}
+	if len(lb.Corruptions()) != 2 {
+		t.Fatalf("The refresh should have reported the corrupt record")
+	}
+	vbyts, _, _, _ = lb.Get("good")
+	if string(vbyts) != "good value" {
+		t.Fatalf("Expected %q after refresh but got %q", "good value", vbyts)
+	}
+
+	lb.config.CORRUPTION_POLICY = CORRUPTION_QUARANTINE
+	lb.Get("bad")
+	if lb.mcat.Get("bad") != nil {
+		t.Fatalf("A quarantined key should be dropped from the master catalog")
+	}
+	qfile, _, _ := lb.GetFile(QUARANTINE_FILENAME)
+	if qfile.size == 0 {
+		t.Fatalf("The quarantine file should contain the corrupt record")
+	}
+}
+
+// Recover the live log after a simulated torn write.
+func TestTornWriteRecovery(t *testing.T) {
+	lb := freshLogbase("test_torn", t)
+	lb.config.LOGFILE_MAXBYTES = 1048576 // keep the records in one live log
+	lb.Put("a", []byte("alpha"), LBTYPE_STRING)
+	lb.Put("b", []byte("beta"), LBTYPE_STRING)
+	lb.Put("c", []byte("gamma"), LBTYPE_STRING)
+	size := lb.livelog.size
+	isize := lb.livelog.indexfile.size
+
+	// Drop the last index record part way through, and append part of a
+	// new record to the log
+	os.Truncate(lb.livelog.indexfile.abspath, int64(isize - 3))
+	partial := MakeLogRecord("d", []byte("delta"), LBTYPE_STRING, lb.debug).Pack()
+	f, _ := os.OpenFile(lb.livelog.abspath, os.O_WRONLY, 0)
+	f.WriteAt(partial[:len(partial) - 2], int64(size))
+	f.Close()
+
+	lb = reopenLogbase(lb, true, t)
+	rep := lb.Recovery()
+	if rep.DroppedBytes() != len(partial) - 2 {
+		t.Fatalf("Recovery should drop %d bytes but dropped %d: %s",
+			len(partial) - 2, rep.DroppedBytes(), rep)
+	}
+	if lb.livelog.size != size {
+		t.Fatalf("Live log should be truncated to %d bytes but is %d",
+			size, lb.livelog.size)
+	}
+	if rep.nrecovered != 3 || rep.nsalvaged != 1 {
+		t.Fatalf("Recovery should have salvaged the missing index record: %s", rep)
+	}
+	for key, val := range map[string]string{"a": "alpha", "b": "beta", "c": "gamma"} {
+		vbyts, _, _, err := lb.Get(key)
+		if err != nil || string(vbyts) != val {
+			t.Fatalf("Expected %q for key %q but got %q (%v)", val, key, vbyts, err)
+		}
+	}
+	lb.Put("d", []byte("delta"), LBTYPE_STRING)
+	lb = reopenLogbase(lb, true, t)
+	vbyts, _, _, err := lb.Get("d")
+	if err != nil || string(vbyts) != "delta" {
+		t.Fatalf("Expected %q after recovery but got %q (%v)", "delta", vbyts, err)
+	}
+}
+
+// Replay records written after the last save, as after a crash.
+func TestCheckpointReplay(t *testing.T) {
+	lb := freshLogbase("test_replay", t)
+	lb.Put("a", []byte("alpha"), LBTYPE_STRING)
+	lb.Put("b", []byte("beta"), LBTYPE_STRING)
+	lb.Put("c", []byte("gamma"), LBTYPE_STRING)
+	err := lb.Save()
+	if err != nil {t.Fatalf("Problem saving logbase: %s", err)}
+	cp := lb.mcat.Checkpoint()
+	if cp == nil || cp.fnum != lb.livelog.fnum || int(cp.pos) != lb.livelog.size {
+		t.Fatalf("Checkpoint %s should be at the end of the live log", cp)
+	}
+
+	// Change the logbase without saving
+	lb.Put("a", []byte("alpha2"), LBTYPE_STRING)
+	lb.Delete("b")
+	lb.Put("d", []byte("delta"), LBTYPE_STRING)
+	lb.Put("e", []byte("epsilon"), LBTYPE_STRING)
+
+	lb2 := MakeLogbase(lb.abspath, lb.debug)
+	err = lb2.Init(false)
+	if err != nil {t.Fatalf("Could not re-initialise logbase: %s", err)}
+	if !lb2.mcat.Checkpoint().Equals(cp) {
+		t.Fatalf("Loaded checkpoint %s should be %s", lb2.mcat.Checkpoint(), cp)
+	}
+	expected := map[string]string{"a": "alpha2", "c": "gamma", "d": "delta", "e": "epsilon"}
+	for key, val := range expected {
+		vbyts, _, _, err := lb2.Get(key)
+		if err != nil || string(vbyts) != val {
+			t.Fatalf("Expected %q for key %q but got %q (%v)", val, key, vbyts, err)
+		}
+	}
+	if lb2.mcat.Get("b") != nil {
+		t.Fatalf("Deleted key should not be replayed into the master catalog")
+	}
+	if lb2.mcat.Len() != len(expected) {
+		t.Fatalf("Master catalog should have %d keys but has %d",
+			len(expected), lb2.mcat.Len())
+	}
+	for _, key := range []string{"a", "b"} {
+		if !zapmapsMatch(lb.zmap.Get(key), lb2.zmap.Get(key)) {
+			t.Fatalf("Replayed zapmap records %v for key %q should be %v",
+				lb2.zmap.Get(key), key, lb.zmap.Get(key))
+		}
+	}
+}
+
+func zapmapsMatch(zrecs1, zrecs2 []*ZapRecord) bool {
+	if len(zrecs1) != len(zrecs2) {return false}
+	for i, zrec := range zrecs1 {
+		if !zrec.Equals(zrecs2[i]) {return false}
+	}
+	return true
+}
+
+// Map positions in a logfile to their positions after zapping.
+func TestZapShift(t *testing.T) {
+	zl := NewZaplists([]LBUINT{0,10,14}, []LBUINT{4,4,6})
+	for pos, exp := range map[LBUINT]LBUINT{4: 0, 9: 5, 20: 6, 25: 11} {
+		if newpos, zapped := zl.Shift(pos); zapped || newpos != exp {
+			t.Fatalf("Position %d should shift to %d but shifted to %d (zapped = %v)",
+				pos, exp, newpos, zapped)
+		}
+	}
+	if newpos, zapped := zl.Shift(15); !zapped || newpos != 6 {
+		t.Fatalf("Position 15 should be zapped leaving a gap at 6, but got %d (zapped = %v)",
+			newpos, zapped)
+	}
+}
+
+// Read the right values from all catalogs and index files after a zap.
+func TestZapRemap(t *testing.T) {
+	lb := freshLogbase("test_zap_remap", t)
+	for i := 0; i < 3; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			lb.Put(key, []byte(fmt.Sprintf("%s%d", key, i)), LBTYPE_STRING)
+		}
+	}
+	lb.Get("a") // cache a Value
+	sub, _ := lb.GetCatalog("sub")
+	sub.Put("b", lb.mcat.Get("b"))
+
+	err := lb.Zap(5)
+	if err != nil {t.Fatalf("Problem zapping logfiles: %s", err)}
+	if n := len(lb.zmap.zapmap); n != 0 {
+		t.Fatalf("The zapmap should be empty after zapping, but has %d keys", n)
+	}
+	check := func(lb *Logbase, when string) {
+		for _, key := range []string{"a", "b", "c"} {
+			val, _, err := lb.mcat.Get(key).ToValueLocation().ReadVal(lb)
+			if err != nil || string(val) != key + "2" {
+				t.Fatalf("Expected %q for key %q %s but got %q (%v)",
+					key + "2", key, when, val, err)
+			}
+		}
+	}
+	check(lb, "after zap")
+	val, _, err := sub.Get("b").ToValueLocation().ReadVal(lb)
+	if err != nil || string(val) != "b2" {
+		t.Fatalf("Expected %q from secondary catalog but got %q (%v)", "b2", val, err)
+	}
+
+	// Reload the saved catalogs, then rebuild them from the index files
+	lb2 := MakeLogbase(lb.abspath, lb.debug)
+	err = lb2.Init(false)
+	if err != nil {t.Fatalf("Could not re-initialise logbase: %s", err)}
+	check(lb2, "after reload")
+	lb = reopenLogbase(lb2, true, t)
+	check(lb, "after rebuild")
+	if n := len(lb.zmap.zapmap); n != 0 {
+		t.Fatalf("The rebuilt zapmap should be empty, but has %d keys", n)
+	}
+}
+
+// Merge sealed logfiles, leaving the live log alone.
+func TestMerge(t *testing.T) {
+	lb := freshLogbase("test_merge", t)
+	for i := 0; i < 4; i++ {
+		for _, key := range []string{"a", "b", "c", "d"} {
+			lb.Put(key, []byte(fmt.Sprintf("%s%d", key, i)), LBTYPE_STRING)
+		}
+	}
+	lb.Delete("d")
+	lb.Put("e", []byte("e0"), LBTYPE_STRING)
+	lb.Save()
+	_, before, _ := lb.GetLogfilePaths()
+	livefnum, livesize := lb.livelog.fnum, lb.livelog.size
+	premerge := readDir(lb.abspath, t)
+
+	rep, err := lb.Merge()
+	if err != nil {t.Fatalf("Problem merging logfiles: %s", err)}
+	_, after, _ := lb.GetLogfilePaths()
+	if len(after) >= len(before) || len(after) != len(rep.Outputs()) + 2 {
+		t.Fatalf("Merge %s should reduce %d logfiles, but left %v",
+			rep, len(before), after)
+	}
+	if after[0] != livefnum || rep.Outputs()[0] != livefnum + 1 {
+		t.Fatalf("Merge %s should write new logfiles after the live log %d, " +
+			"but left %v", rep, livefnum, after)
+	}
+	stat, _ := os.Stat(filepath.Join(lb.abspath, lb.MakeLogfileRelPath(livefnum)))
+	if stat.Size() != int64(livesize) {
+		t.Fatalf("The records of the live log should not be touched by a merge")
+	}
+	if lb.livelog.fnum != after[len(after) - 1] || lb.livelog.fnum <= rep.Outputs()[len(rep.Outputs()) - 1] {
+		t.Fatalf("The live log should be sealed after the merge outputs")
+	}
+	if rep.Reclaimed() <= 0 {t.Fatalf("Merge %s should reclaim space", rep)}
+	for _, fnum := range rep.Inputs() {
+		if rpos, _, _ := lb.zmap.Find(fnum); len(rpos) > 0 {
+			t.Fatalf("The zapmap still refers to merged logfile %d", fnum)
+		}
+	}
+
+	expected := map[string]string{"a": "a3", "b": "b3", "c": "c3", "e": "e0"}
+	check := func(lb *Logbase, when string) {
+		for key, val := range expected {
+			vbyts, _, err := lb.mcat.Get(key).ToValueLocation().ReadVal(lb)
+			if err != nil || string(vbyts) != val {
+				t.Fatalf("Expected %q for key %q %s but got %q (%v)",
+					val, key, when, vbyts, err)
+			}
+		}
+		if lb.mcat.Get("d") != nil {
+			t.Fatalf("Deleted key reappeared %s", when)
+		}
+	}
+	check(lb, "after merge")
+	postmerge := readDir(lb.abspath, t)
+	lb = reopenLogbase(lb, false, t)
+	check(lb, "after reload")
+	lb = reopenLogbase(lb, true, t)
+	check(lb, "after rebuild")
+
+	// A crash before the catalogs are saved leaves the old catalogs and the
+	// inputs, and a crash after leaves just the inputs
+	crashes := map[string]func(relpath string) bool{
+		"before the save": func(relpath string) bool {return true},
+		"before the deletes": func(relpath string) bool {
+			_, ok := postmerge[relpath]
+			return !ok
+		},
+	}
+	for when, fromPremerge := range crashes {
+		dir := lb.abspath + "_crash"
+		os.RemoveAll(dir)
+		writeDir(dir, postmerge, t)
+		for relpath, byts := range premerge {
+			if fromPremerge(relpath) {writeDir(dir, map[string][]byte{relpath: byts}, t)}
+		}
+		for _, rebuild := range []bool{false, true} {
+			crashed := MakeLogbase(dir, lb.debug)
+			if err = crashed.Init(false); err != nil {
+				t.Fatalf("Could not open logbase after a crash %s: %s", when, err)
+			}
+			check(crashed, "after a crash " + when)
+			crashed.Close()
+			if rebuild {continue}
+			os.RemoveAll(crashed.mcat.file.abspath)
+			os.RemoveAll(crashed.zmap.file.abspath)
+		}
+	}
+}
+
+// A merge failing part way, here on a corrupt record, leaves the directory as
+// it was, and the logbase reopens and merges as if it had never run.
+func TestMergeFailure(t *testing.T) {
+	lb := freshLogbase("test_merge_failure", t)
+	expected := make(map[string]string)
+	for i := 0; i < 8; i++ {
+		key := fmt.Sprintf("k%d", i)
+		expected[key] = fmt.Sprintf("v%d", i)
+		lb.Put(key, []byte(expected[key]), LBTYPE_STRING)
+	}
+	lb.Save()
+	// Corrupt the last record to be merged, after the others are copied
+	var bad string
+	var vloc *ValueLocation
+	for key := range expected {
+		v := lb.mcat.Get(key).ToValueLocation()
+		if v.fnum < lb.livelog.fnum && (vloc == nil || v.fnum > vloc.fnum ||
+			(v.fnum == vloc.fnum && v.vpos > vloc.vpos)) {
+			bad, vloc = key, v
+		}
+	}
+	f, err := os.OpenFile(filepath.Join(lb.abspath, lb.MakeLogfileRelPath(vloc.fnum)), os.O_WRONLY, 0)
+	if err != nil {t.Fatalf("Could not open logfile to corrupt it: %s", err)}
+	f.WriteAt([]byte("X"), int64(vloc.vpos + vloc.vsz - 1))
+	f.Close()
+	delete(expected, bad)
+	premerge := readDir(lb.abspath, t)
+
+	lb.config.CORRUPTION_POLICY = CORRUPTION_FAIL
+	if _, err = lb.Merge(); err == nil {t.Fatalf("Merge should fail on a corrupt record")}
+	postfail := readDir(lb.abspath, t)
+	for name := range postfail {
+		if _, ok := premerge[name]; !ok {t.Fatalf("A failed merge left file %s behind", name)}
+	}
+	for name, byts := range premerge {
+		if !bytes.Equal(postfail[name], byts) {t.Fatalf("A failed merge changed file %s", name)}
+	}
+
+	check := func(lb *Logbase, when string) {
+		for key, val := range expected {
+			vbyts, _, _, err := lb.Get(key)
+			if err != nil || string(vbyts) != val {
+				t.Fatalf("Expected %q for key %q %s but got %q (%v)", val, key, when, vbyts, err)
+			}
+		}
+	}
+	lb.Put("k0", []byte("v0 again"), LBTYPE_STRING)
+	expected["k0"] = "v0 again"
+	livefnum := lb.livelog.fnum
+	lb = reopenLogbase(lb, false, t)
+	if lb.livelog.fnum != livefnum {
+		t.Fatalf("Expected live log %d after reopening, got %d", livefnum, lb.livelog.fnum)
+	}
+	check(lb, "after a failed merge")
+	lb.config.CORRUPTION_POLICY = CORRUPTION_SKIP
+	if _, err = lb.Merge(); err != nil {t.Fatalf("A later merge should run: %s", err)}
+	check(lb, "after a later merge")
+}
+
+// Return the contents of the files in the directory, by relative path.
+func readDir(dir string, t *testing.T) map[string][]byte {
+	files := make(map[string][]byte)
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {t.Fatalf("Could not read dir %s: %s", dir, err)}
+	for _, info := range infos {
+		if info.IsDir() {continue}
+		byts, err := ioutil.ReadFile(filepath.Join(dir, info.Name()))
+		if err != nil {t.Fatalf("Could not read %s: %s", info.Name(), err)}
+		files[info.Name()] = byts
+	}
+	return files
+}
+
+// Write the given files, by relative path, into the directory.
+func writeDir(dir string, files map[string][]byte, t *testing.T) {
+	os.MkdirAll(dir, 0777)
+	for relpath, byts := range files {
+		err := ioutil.WriteFile(filepath.Join(dir, relpath), byts, 0666)
+		if err != nil {t.Fatalf("Could not write %s: %s", relpath, err)}
+	}
+}
+
+// Compact stale sealed logfiles in the background.
+func TestCompactor(t *testing.T) {
+	lb := freshLogbase("test_compactor", t)
+	lb.config.COMPACTION_INTERVAL_SECS = 3600
+	lb.config.COMPACTION_MAX_BYTES_PER_SEC = 0
+	for i := 0; i < 4; i++ {
+		for _, key := range []string{"a", "b", "c"} {
+			lb.Put(key, []byte(fmt.Sprintf("%s%d", key, i)), LBTYPE_STRING)
+		}
+	}
+	cands, err := lb.CompactionCandidates()
+	if err != nil || len(cands) == 0 {
+		t.Fatalf("There should be logfiles to compact, but got %v (%v)", cands, err)
+	}
+	for _, st := range cands {
+		if st.fnum == lb.livelog.fnum {t.Fatalf("The live log is not a candidate")}
+	}
+
+	comp := lb.StartCompactor()
+	comp.Pause()
+	comp.Resume() // triggers a pass
+	for i := 0; i < 100 && comp.Progress().Passes() == 0; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	comp.Stop()
+	prog := comp.Progress()
+	if prog.Running() || prog.Compacted() != len(cands) || prog.Reclaimed() <= 0 ||
+		prog.LastError() != nil {
+		t.Fatalf("Compactor should have compacted %d logfiles: %s", len(cands), prog)
+	}
+	cands, _ = lb.CompactionCandidates()
+	if len(cands) != 0 {
+		t.Fatalf("There should be no candidates left, but there are %v", cands)
+	}
+	for _, key := range []string{"a", "b", "c"} {
+		vbyts, _, err := lb.mcat.Get(key).ToValueLocation().ReadVal(lb)
+		if err != nil || string(vbyts) != key + "3" {
+			t.Fatalf("Expected %q for key %q but got %q (%v)", key + "3", key, vbyts, err)
+		}
+	}
+}
+
+// Pace the compactor within a logfile, leaving the logbase open for writes
+// while it copies, and drop the copy if a snapshot pins the logfile meanwhile.
+func TestCompactorPacing(t *testing.T) {
+	lb := freshLogbase("test_compactor_pacing", t)
+	lb.config.LOGFILE_MAXBYTES = 1 << 20
+	lb.config.COMPACTION_INTERVAL_SECS = 3600
+	lb.config.COMPACTION_STALE_RATIO = 0.1
+	lb.config.COMPACTION_MAX_BYTES_PER_SEC = 40000
+	val := bytes.Repeat([]byte("x"), 1000)
+	for i := 0; i < 40; i++ {lb.Put(fmt.Sprintf("k%02d", i), val, LBTYPE_STRING)}
+	for i := 0; i < 40; i += 2 {lb.Put(fmt.Sprintf("k%02d", i), []byte("new"), LBTYPE_STRING)}
+	fnum := lb.livelog.fnum
+	lb.Lock()
+	lb.NewLiveLog()
+	lb.Unlock()
+	lfile, _ := lb.GetLogfile(fnum)
+
+	comp := lb.StartCompactor()
+	defer comp.Stop()
+	compacting := func() {
+		comp.Resume() // triggers a pass
+		for i := 0; i < 100 && comp.Progress().Current() != fnum; i++ {
+			time.Sleep(5 * time.Millisecond)
+		}
+		if comp.Progress().Current() != fnum {t.Fatalf("Logfile %d is not being compacted", fnum)}
+	}
+	finished := func(passes int) *CompactionProgress {
+		for i := 0; i < 500; i++ {
+			if prog := comp.Progress(); prog.Passes() == passes && prog.Current() == 0 {return prog}
+			time.Sleep(10 * time.Millisecond)
+		}
+		t.Fatalf("The compactor did not finish pass %d: %s", passes, comp.Progress())
+		return nil
+	}
+
+	// A snapshot taken while the logfile is copied keeps it as it is
+	size := lfile.size
+	compacting()
+	snap := lb.Snapshot()
+	if prog := finished(1); prog.Compacted() != 0 || prog.LastError() != nil {
+		t.Fatalf("A logfile pinned while compacting should be left as it is: %s", prog)
+	}
+	if vbyts, _, err := snap.Get("k01"); err != nil || !bytes.Equal(vbyts, val) || lfile.size != size {
+		t.Fatalf("Expected the snapshot to read the logfile as it was (%v)", err)
+	}
+	snap.Release()
+
+	// The copy of 20 live records takes about half a second, during which
+	// writes go ahead
+	start := time.Now()
+	compacting()
+	before := time.Now()
+	if _, err := lb.Put("during", []byte("written while compacting"), LBTYPE_STRING); err != nil {
+		t.Fatalf("Problem writing while compacting: %s", err)
+	}
+	if took := time.Since(before); took > 200 * time.Millisecond {
+		t.Fatalf("A write took %v while a logfile was compacted", took)
+	}
+	prog := finished(2)
+	if took := time.Since(start); took < 400 * time.Millisecond {
+		t.Fatalf("Compacting %d bytes at %d bytes a second took only %v",
+			prog.Copied(), lb.config.COMPACTION_MAX_BYTES_PER_SEC, took)
+	}
+	if prog.Compacted() != 1 || prog.LastError() != nil || lfile.size >= size {
+		t.Fatalf("Expected logfile %d to be compacted: %s", fnum, prog)
+	}
+	for i := 0; i < 40; i++ {
+		want := val
+		if i % 2 == 0 {want = []byte("new")}
+		if vbyts, _, _, err := lb.Get(fmt.Sprintf("k%02d", i)); err != nil || !bytes.Equal(vbyts, want) {
+			t.Fatalf("Expected the value of key k%02d after compacting (%v)", i, err)
+		}
+	}
+}
+
+// Write a format v1 logfile and index file, with no headers and 32 bit sizes
+// and positions, holding the given key value pairs.
+func writeV1Logfile(lb *Logbase, fnum LBUINT, pairs [][2]string, t *testing.T) {
+	lbfr, ibfr := new(bytes.Buffer), new(bytes.Buffer)
+	for _, pair := range pairs {
+		lrec := MakeLogRecord(pair[0], []byte(pair[1]), LBTYPE_STRING, lb.debug)
+		rpos := lbfr.Len()
+		binary.Write(lbfr, BIGEND, uint32(lrec.ksz))
+		binary.Write(lbfr, BIGEND, uint32(lrec.vsz + CRC_SIZE))
+		lbfr.Write(InjectType(lrec.kbyts, lrec.ktype))
+		lbfr.Write(InjectType(lrec.vbyts, lrec.vtype))
+		binary.Write(lbfr, BIGEND, crc32.ChecksumIEEE(lbfr.Bytes()[rpos:]))
+		binary.Write(ibfr, BIGEND, uint32(lrec.ksz))
+		ibfr.Write(InjectType(lrec.kbyts, lrec.ktype))
+		binary.Write(ibfr, BIGEND, uint32(lrec.vsz))
+		binary.Write(ibfr, BIGEND, uint32(rpos + 8) + uint32(lrec.ksz))
+	}
+	for path, byts := range map[string][]byte{
+		lb.MakeLogfileRelPath(fnum): lbfr.Bytes(),
+		lb.MakeIndexfileRelPath(fnum): ibfr.Bytes(),
+	} {
+		err := ioutil.WriteFile(filepath.Join(lb.abspath, path), byts, 0666)
+		if err != nil {t.Fatalf("Problem writing v1 file %s: %s", path, err)}
+	}
+}
+
+// Read a format v1 logbase, then migrate it to the current format.
+func TestMigrate(t *testing.T) {
+	lb := freshLogbase("test_migrate", t)
+	livefnum := lb.livelog.fnum
+	writeV1Logfile(lb, livefnum, [][2]string{{"a", "a0"}, {"b", "b0"}}, t)
+	writeV1Logfile(lb, livefnum + 1, [][2]string{{"a", "a1"}, {"c", "c0"}}, t)
+	lb = reopenLogbase(lb, true, t)
+
+	expected := map[string]string{"a": "a1", "b": "b0", "c": "c0"}
+	check := func(lb *Logbase, when string) {
+		for key, val := range expected {
+			vbyts, _, _, err := lb.Get(key)
+			if err != nil || string(vbyts) != val {
+				t.Fatalf("Expected %q for key %q %s but got %q (%v)",
+					val, key, when, vbyts, err)
+			}
+		}
+	}
+	check(lb, "in format v1")
+	if needs, _ := lb.NeedsMigration(); !needs {
+		t.Fatalf("A format v1 logbase should need migrating")
+	}
+	_, err := lb.Put("d", []byte("d0"), LBTYPE_STRING)
+	if err != nil {t.Fatalf("Problem writing to a format v1 logbase: %s", err)}
+	if lb.livelog.fnum != livefnum + 2 || lb.livelog.Version() != FORMAT_CURRENT {
+		t.Fatalf("Writes should go to a new live log in the current format")
+	}
+	expected["d"] = "d0"
+
+	migrated, err := lb.Migrate()
+	if err != nil {t.Fatalf("Problem migrating logbase: %s", err)}
+	nlogs := 0
+	for _, relpath := range migrated {
+		if filepath.Ext(relpath) == "." + lb.config.LOGFILE_NAME_EXTENSION {nlogs++}
+	}
+	if nlogs != 2 {t.Fatalf("Expected two logfiles to migrate, got %v", migrated)}
+	if needs, _ := lb.NeedsMigration(); needs {
+		t.Fatalf("A migrated logbase should not need migrating")
+	}
+	relpaths, _ := lb.FormattedFilePaths()
+	for _, relpath := range relpaths {
+		byts, _ := ioutil.ReadFile(filepath.Join(lb.abspath, relpath))
+		if !bytes.HasPrefix(byts, []byte(FORMAT_MAGIC)) {
+			t.Fatalf("File %s has no format header", relpath)
+		}
+	}
+	check(lb, "after migration")
+	err = lb.Zap(1024)
+	if err != nil {t.Fatalf("Problem zapping migrated logbase: %s", err)}
+	check(lb, "after zap")
+	lb = reopenLogbase(lb, false, t)
+	check(lb, "after reload")
+	lb = reopenLogbase(lb, true, t)
+	check(lb, "after rebuild")
+
+	// Sizes within node values stay at 32 bits, but are an error, not an
+	// exit, when too big
+	if _, err = AsNODESIZE(int(NODESIZE_MAX) + 1); err == nil {
+		t.Fatalf("A node size over %d should be an error", NODESIZE_MAX)
+	}
+}
+
+// Commit write batches, and ignore a batch cut short before its commit marker.
+func TestWriteBatch(t *testing.T) {
+	lb := freshLogbase("test_batch", t)
+	lb.Put("c", []byte("c0"), LBTYPE_STRING)
+	err := lb.NewWriteBatch().
+		Put("a", []byte("a0"), LBTYPE_STRING).
+		Put("b", []byte("b0"), LBTYPE_STRING).
+		Delete("c").
+		Commit()
+	if err != nil {t.Fatalf("Problem committing batch: %s", err)}
+
+	check := func(lb *Logbase, expected map[string]string, when string) {
+		for key, val := range expected {
+			vbyts, _, _, err := lb.Get(key)
+			if err != nil || string(vbyts) != val {
+				t.Fatalf("Expected %q for key %q %s but got %q (%v)",
+					val, key, when, vbyts, err)
+			}
+		}
+	}
+	expected := map[string]string{"a": "a0", "b": "b0", "c": ""}
+	check(lb, expected, "after commit")
+	lb = reopenLogbase(lb, true, t)
+	check(lb, expected, "after rebuild")
+
+	// Cut the commit marker off the next batch
+	err = lb.NewWriteBatch().
+		Put("a", []byte("a1"), LBTYPE_STRING).
+		Put("x", []byte("x0"), LBTYPE_STRING).
+		Commit()
+	if err != nil {t.Fatalf("Problem committing batch: %s", err)}
+	check(lb, map[string]string{"a": "a1", "x": "x0"}, "after second commit")
+	livelog := lb.livelog
+	lb.Close()
+	os.Truncate(livelog.abspath, int64(livelog.size - 1))
+	lb = reopenLogbase(lb, true, t)
+	if lb.Recovery().DroppedBytes() == 0 || lb.livelog.size >= livelog.size {
+		t.Fatalf("Recovery should drop the uncommitted batch: %s", lb.Recovery())
+	}
+	check(lb, expected, "after losing the commit marker")
+	lb.Put("y", []byte("y0"), LBTYPE_STRING)
+	lb = reopenLogbase(lb, true, t)
+	expected["y"] = "y0"
+	expected["x"] = ""
+	check(lb, expected, "after writing past the lost batch")
+
+	// A batch whose sync fails leaves nothing behind to be written later
+	lb.config.LOGFILE_MAXBYTES = 1048576
+	lb.Put("z", []byte("z0"), LBTYPE_STRING)
+	lb.livelog.Flush()
+	size := lb.livelog.size
+	lb.livelog.appender.gofile.Close() // break the append handle
+	err = lb.NewWriteBatch().Put("w", []byte("w0"), LBTYPE_STRING).Commit()
+	if err == nil || lb.livelog.size != size || len(lb.livelog.appender.bfr) != 0 {
+		t.Fatalf("A failed batch should be undone, but got size %d of %d (%v)",
+			lb.livelog.size, size, err)
+	}
+	lb.livelog.CloseAppender()
+	lb = reopenLogbase(lb, true, t)
+	expected["z"] = "z0"
+	expected["w"] = ""
+	check(lb, expected, "after a failed batch")
+}
+
+// Conditional writes only go ahead if the key has not changed.
+func TestConditionalWrites(t *testing.T) {
+	lb := freshLogbase("test_conditional", t)
+	mcr, err := lb.PutIfAbsent("a", []byte("a0"), LBTYPE_STRING)
+	if err != nil || mcr == nil {t.Fatalf("Problem putting absent key: %v", err)}
+	_, err = lb.PutIfAbsent("a", []byte("a1"), LBTYPE_STRING)
+	if !IsConflict(err) {t.Fatalf("Expected a conflict putting a present key, got %v", err)}
+
+	_, _, stale, _ := lb.Get("a")
+	mcr, err = lb.PutIfMatch("a", stale, []byte("a1"), LBTYPE_STRING)
+	if err != nil {t.Fatalf("Problem putting matching key: %v", err)}
+	_, err = lb.PutIfMatch("a", stale, []byte("a2"), LBTYPE_STRING)
+	if !IsConflict(err) {t.Fatalf("Expected a conflict putting with a stale record, got %v", err)}
+	err = lb.DeleteIfMatch("a", stale)
+	if !IsConflict(err) {t.Fatalf("Expected a conflict deleting with a stale record, got %v", err)}
+	vbyts, _, _, _ := lb.Get("a")
+	if string(vbyts) != "a1" {t.Fatalf("Expected %q after conflicts but got %q", "a1", vbyts)}
+
+	err = lb.DeleteIfMatch("a", mcr)
+	if err != nil {t.Fatalf("Problem deleting matching key: %v", err)}
+	if vbyts, _, _, _ := lb.Get("a"); vbyts != nil {
+		t.Fatalf("Key should be deleted but has value %q", vbyts)
+	}
+
+	// A zap can move a newer value to where an older one was, but the older
+	// record still does not match
+	lb = freshLogbase("test_conditional_zap", t)
+	lb.config.LOGFILE_MAXBYTES = 1048576
+	stale, _ = lb.Put("b", []byte("b0"), LBTYPE_STRING)
+	lb.Put("b", []byte("b1"), LBTYPE_STRING)
+	if err = lb.Zap(1024); err != nil {t.Fatalf("Problem zapping: %s", err)}
+	_, _, current, _ := lb.Get("b")
+	if !current.ToValueLocation().Equals(stale.ToValueLocation()) {
+		t.Fatalf("The zap should have moved the newer value to %v, not %v",
+			stale.ToValueLocation(), current.ToValueLocation())
+	}
+	_, err = lb.PutIfMatch("b", stale, []byte("b2"), LBTYPE_STRING)
+	if !IsConflict(err) {t.Fatalf("Expected a conflict after a zap, got %v", err)}
+	_, err = lb.PutIfMatch("b", current, []byte("b2"), LBTYPE_STRING)
+	if err != nil {t.Fatalf("Problem putting with a record moved by a zap: %v", err)}
+}
+
+// Sync every write, sharing syncs between concurrent writers, or sync in the
+// background.
+func TestDurability(t *testing.T) {
+	lb := freshLogbase("test_durability", t)
+	lb.config.DURABILITY = DURABILITY_ALWAYS
+	lb.config.LOGFILE_MAXBYTES = 1048576
+	var wg sync.WaitGroup
+	nwriters, nputs := 8, 10
+	for w := 0; w < nwriters; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < nputs; i++ {
+				key := fmt.Sprintf("w%dk%d", w, i)
+				_, err := lb.Put(key, []byte(key), LBTYPE_STRING)
+				if err != nil {t.Errorf("Problem putting %q: %s", key, err)}
+			}
+		}(w)
+	}
+	wg.Wait()
+	syncer := lb.Syncer()
+	if syncer.durable != syncer.written || syncer.Syncs() == 0 ||
+		syncer.Syncs() > nwriters * nputs {
+		t.Fatalf("Every write should be synced, with syncs shared: %s", syncer)
+	}
+	for w := 0; w < nwriters; w++ {
+		key := fmt.Sprintf("w%dk%d", w, nputs - 1)
+		vbyts, _, _, err := lb.Get(key)
+		if err != nil || string(vbyts) != key {
+			t.Fatalf("Expected %q for key %q but got %q (%v)", key, key, vbyts, err)
+		}
+	}
+
+	lb.config.DURABILITY = DURABILITY_INTERVAL
+	syncer.Start(10 * time.Millisecond)
+	nsyncs := syncer.Syncs()
+	lb.Put("late", []byte("late"), LBTYPE_STRING)
+	for i := 0; i < 100 && syncer.Syncs() == nsyncs; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if syncer.Syncs() == nsyncs {t.Fatalf("Background sync did not happen: %s", syncer)}
+	lb.Close()
+}
+
+// Buffer writes to the live log until they are read, synced or closed.
+func TestAppendBuffer(t *testing.T) {
+	lb := freshLogbase("test_append", t)
+	lb.config.DURABILITY = DURABILITY_INTERVAL
+	lb.config.LOGFILE_MAXBYTES = 1048576
+	onDisk := func() int {
+		stat, _ := os.Stat(lb.livelog.abspath)
+		return int(stat.Size())
+	}
+	lb.Put("a", []byte("a0"), LBTYPE_STRING)
+	lb.Put("b", []byte("b0"), LBTYPE_STRING)
+	if onDisk() >= lb.livelog.size {
+		t.Fatalf("Writes should be buffered, but %d of %d bytes are on disk",
+			onDisk(), lb.livelog.size)
+	}
+	lb.config.CACHE_VALUES = false
+	lb.mcat.Put("a", lb.mcat.Get("a").ToValueLocation()) // force a read from file
+	vbyts, _, _, err := lb.Get("a")
+	if err != nil || string(vbyts) != "a0" {
+		t.Fatalf("Expected %q for a buffered write but got %q (%v)", "a0", vbyts, err)
+	}
+	if onDisk() != lb.livelog.size {
+		t.Fatalf("A read should write out the buffer, but %d of %d bytes are on disk",
+			onDisk(), lb.livelog.size)
+	}
+	lb.Put("c", []byte("c0"), LBTYPE_STRING)
+	lb = reopenLogbase(lb, true, t)
+	for _, key := range []string{"a", "b", "c"} {
+		vbyts, _, _, err := lb.Get(key)
+		if err != nil || string(vbyts) != key + "0" {
+			t.Fatalf("Expected %q for key %q after close but got %q (%v)",
+				key + "0", key, vbyts, err)
+		}
+	}
+}
+
+// Hammer the logbase from many goroutines, to be run with -race.
+func TestConcurrency(t *testing.T) {
+	lb := freshLogbase("test_concurrency", t)
+	lb.config.LOGFILE_MAXBYTES = 2048
+	lb.Put("shared", []byte("shared"), LBTYPE_STRING)
+	var wg sync.WaitGroup
+	nworkers, nops := 8, 50
+	// Values left uncached are cached by whichever Get reads them first, and
+	// the readers need to run in parallel to race, even on one CPU
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	lb.config.CACHE_VALUES = false
+	for i := 0; i < nops; i++ {
+		lb.Put(fmt.Sprintf("u%d", i), []byte(fmt.Sprintf("uv%d", i)), LBTYPE_STRING)
+	}
+	lb.config.CACHE_VALUES = true
+	start := make(chan bool)
+	for w := 0; w < nworkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			for i := 0; i < nops; i++ {
+				key, val := fmt.Sprintf("u%d", i), fmt.Sprintf("uv%d", i)
+				vbyts, _, _, err := lb.Get(key)
+				if err != nil || string(vbyts) != val {
+					t.Errorf("Expected %q but got %q (%v)", val, vbyts, err)
+				}
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	ids := make(chan CATID_TYPE, nworkers * nops)
+	for w := 0; w < nworkers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < nops; i++ {
+				key := fmt.Sprintf("w%dk%d", w, i % 5)
+				val := fmt.Sprintf("w%dv%d", w, i)
+				switch i % 10 {
+				case 3:
+					lb.Delete(key)
+				case 7:
+					batch := lb.NewWriteBatch()
+					batch.Put(key, []byte(val), LBTYPE_STRING)
+					batch.Put(key + "b", []byte(val), LBTYPE_STRING)
+					err := batch.Commit()
+					if err != nil {t.Errorf("Problem committing batch: %s", err)}
+				case 9:
+					if err := lb.Save(); err != nil {t.Errorf("Problem saving: %s", err)}
+				default:
+					_, err := lb.Put(key, []byte(val), LBTYPE_STRING)
+					if err != nil {t.Errorf("Problem putting %q: %s", key, err)}
+				}
+				vbyts, _, _, err := lb.Get("shared")
+				if err != nil || string(vbyts) != "shared" {
+					t.Errorf("Expected %q but got %q (%v)", "shared", vbyts, err)
+				}
+				ids <- lb.mcat.PopNextId()
+			}
+		}(w)
+	}
+	wg.Wait()
+	close(ids)
+	seen := make(map[CATID_TYPE]bool)
+	for id := range ids {
+		if seen[id] {t.Fatalf("CATID %v was handed out twice", id)}
+		seen[id] = true
+	}
+	lb = reopenLogbase(lb, true, t)
+	for w := 0; w < nworkers; w++ {
+		// Each worker's keys are its own, so replay its ops in order
+		expected := make(map[string]string)
+		for i := 0; i < nops; i++ {
+			key := fmt.Sprintf("w%dk%d", w, i % 5)
+			val := fmt.Sprintf("w%dv%d", w, i)
+			switch i % 10 {
+			case 3:
+				delete(expected, key)
+			case 7:
+				expected[key] = val
+				expected[key + "b"] = val
+			case 9:
+			default:
+				expected[key] = val
+			}
+		}
+		for k := 0; k < 5; k++ {
+			key := fmt.Sprintf("w%dk%d", w, k)
+			vbyts, _, _, err := lb.Get(key)
+			if err != nil || string(vbyts) != expected[key] {
+				t.Fatalf("Expected %q for key %q but got %q (%v)",
+					expected[key], key, vbyts, err)
+			}
+		}
+	}
+}
+
+// Never compact away a tombstone while an older logfile holds a stale value
+// of its key.
+func TestCompactTombstone(t *testing.T) {
+	lb := freshLogbase("test_compact_tombstone", t)
+	lb.config.LOGFILE_MAXBYTES = 200
+	lb.Put("a", []byte("alpha"), LBTYPE_STRING)
+	afnum := lb.mcat.Get("a").ToValueLocation().fnum
+	for i := 0; lb.livelog.fnum == afnum; i++ {
+		key := fmt.Sprintf("k%d", i)
+		lb.Put(key, []byte(key), LBTYPE_STRING)
+	}
+	lb.Delete("a")
+	for lb.livelog.fnum == afnum + 1 {
+		lb.Put("x", []byte("x0"), LBTYPE_STRING)
+		lb.Delete("x")
+	}
+	cands, err := lb.CompactionCandidates()
+	if err != nil || len(cands) != 1 || cands[0].fnum != afnum + 1 {
+		t.Fatalf("Only the tombstone logfile %d should be a candidate, but got %v (%v)",
+			afnum + 1, cands, err)
+	}
+
+	comp := &Compactor{lbase: lb, stop: make(chan bool)}
+	if err = comp.RunOnce(); err != nil {t.Fatalf("Problem compacting: %s", err)}
+	if comp.Progress().Reclaimed() <= 0 {
+		t.Fatalf("The other stale records should still be compacted: %s", comp.Progress())
+	}
+	if len(lb.zmap.Get("a")) != 2 {
+		t.Fatalf("The tombstone should be held in the zapmap, but has %v",
+			lb.zmap.Get("a"))
+	}
+	lb = reopenLogbase(lb, true, t)
+	if vbyts, _, _, _ := lb.Get("a"); vbyts != nil {
+		t.Fatalf("Deleted key came back after compaction with value %q", vbyts)
+	}
+	if err = lb.Zap(5); err != nil {t.Fatalf("Problem zapping: %s", err)}
+	if lb.zmap.Get("a") != nil {
+		t.Fatalf("A full zap should take the tombstone with the older value")
+	}
+	lb = reopenLogbase(lb, true, t)
+	if vbyts, _, _, _ := lb.Get("a"); vbyts != nil {
+		t.Fatalf("Deleted key came back after a full zap with value %q", vbyts)
+	}
+}
+
+// Read sealed logfiles through memory maps, and drop the maps when the files
+// are rewritten.
+func TestMmapReads(t *testing.T) {
+	if !MMAP_SUPPORTED {t.Skip("Memory maps are not supported here")}
+	lb := freshLogbase("test_mmap_reads", t)
+	lb.config.LOGFILE_MAXBYTES = 200
+	lb.config.MMAP_READS = true
+	lb.config.CACHE_VALUES = false
+	lb.Put("a", []byte("alpha"), LBTYPE_STRING)
+	lb.Put("a", []byte("alpha2"), LBTYPE_STRING)
+	afnum := lb.mcat.Get("a").ToValueLocation().fnum
+	for i := 0; lb.livelog.fnum == afnum; i++ {
+		key := fmt.Sprintf("k%d", i)
+		lb.Put(key, []byte(key), LBTYPE_STRING)
+	}
+	lb.Put("b", []byte("beta"), LBTYPE_STRING)
+	sealed, _ := lb.GetLogfile(afnum)
+
+	for _, rate := range []float64{1, 0} {
+		lb.config.CRC_READ_SAMPLE_RATE = rate
+		vbyts, _, _, err := lb.Get("a")
+		if err != nil || string(vbyts) != "alpha2" {
+			t.Fatalf("Expected alpha2 from the sealed logfile, got %q (%v)", vbyts, err)
+		}
+		if vbyts, _, _, err = lb.Get("b"); err != nil || string(vbyts) != "beta" {
+			t.Fatalf("Expected beta from the live log, got %q (%v)", vbyts, err)
+		}
+	}
+	if sealed.mapping == nil {t.Fatalf("The sealed logfile should be mapped")}
+	if lb.livelog.mapping != nil {t.Fatalf("The live log should not be mapped")}
+
+	if err := lb.Zap(5); err != nil {t.Fatalf("Problem zapping: %s", err)}
+	if sealed.mapping != nil {t.Fatalf("A zap should drop the map of its logfile")}
+	if vbyts, _, _, err := lb.Get("a"); err != nil || string(vbyts) != "alpha2" {
+		t.Fatalf("Expected alpha2 after the zap, got %q (%v)", vbyts, err)
+	}
+	if _, err := lb.Merge(); err != nil {t.Fatalf("Problem merging: %s", err)}
+	if vbyts, _, _, err := lb.Get("a"); err != nil || string(vbyts) != "alpha2" {
+		t.Fatalf("Expected alpha2 after the merge, got %q (%v)", vbyts, err)
+	}
+	lfile, _ := lb.GetLogfile(lb.mcat.Get("a").ToValueLocation().fnum)
+	if lfile.mapping == nil {t.Fatalf("The merge output should be mapped")}
+	if err := lb.Close(); err != nil {t.Fatalf("Problem closing: %s", err)}
+	if lfile.mapping != nil {t.Fatalf("Closing should drop all maps")}
+}
+
+// Read a snapshot while writes continue, and keep its logfiles from being
+// rewritten until it is released.
+func TestSnapshot(t *testing.T) {
+	lb := freshLogbase("test_snapshot", t)
+	lb.config.LOGFILE_MAXBYTES = 200
+	lb.Put("a", []byte("a0"), LBTYPE_STRING)
+	lb.Put("b", []byte("b0"), LBTYPE_STRING)
+	afnum := lb.mcat.Get("a").ToValueLocation().fnum
+	for i := 0; lb.livelog.fnum == afnum; i++ {
+		key := fmt.Sprintf("k%d", i)
+		lb.Put(key, []byte(key), LBTYPE_STRING)
+	}
+	snap := lb.Snapshot()
+	defer snap.Release()
+	lb.Put("a", []byte("a1"), LBTYPE_STRING)
+	lb.Delete("b")
+	lb.Put("c", []byte("c1"), LBTYPE_STRING)
+	for lb.livelog.fnum == afnum + 1 {lb.Put("x", []byte("x0"), LBTYPE_STRING)}
+
+	check := func(when string) {
+		for key, want := range map[string]string{"a": "a0", "b": "b0", "c": ""} {
+			vbyts, _, err := snap.Get(key)
+			if err != nil || string(vbyts) != want {
+				t.Fatalf("%s the snapshot should read %q for key %q, but got %q (%v)",
+					when, want, key, vbyts, err)
+			}
+		}
+		if vbyts, _, _, _ := lb.Get("a"); string(vbyts) != "a1" {
+			t.Fatalf("%s the logbase should read a1 for key a, but got %q", when, vbyts)
+		}
+	}
+	check("Before compaction")
+	if !lb.IsPinned(afnum) {t.Fatalf("Logfile %d should be pinned", afnum)}
+	if err := lb.Zap(5); err != nil {t.Fatalf("Problem zapping: %s", err)}
+	if rpos, _, _ := lb.zmap.Find(afnum); len(rpos) == 0 {
+		t.Fatalf("Zap should leave the stale records of pinned logfile %d", afnum)
+	}
+	rep, err := lb.Merge()
+	if err != nil {t.Fatalf("Problem merging: %s", err)}
+	for _, fnum := range rep.Inputs() {
+		if fnum >= afnum {t.Fatalf("Merge %s should not take pinned logfiles", rep)}
+	}
+	cands, _ := lb.CompactionCandidates()
+	for _, st := range cands {
+		if st.fnum == afnum {t.Fatalf("Pinned logfile %d is a compaction candidate", afnum)}
+	}
+	check("After compaction")
+	if snap.Len() != lb.mcat.Len() - 1 {
+		t.Fatalf("The snapshot should hold one key less than the logbase, but holds %d of %d",
+			snap.Len(), lb.mcat.Len())
+	}
+
+	snap.Release()
+	snap.Release()
+	if _, _, err = snap.Get("a"); err == nil {
+		t.Fatalf("A released snapshot should not be readable")
+	}
+	if lb.IsPinned(afnum) {t.Fatalf("Logfile %d should be unpinned", afnum)}
+	if err = lb.Zap(5); err != nil {t.Fatalf("Problem zapping: %s", err)}
+	if rpos, _, _ := lb.zmap.Find(afnum); len(rpos) > 0 {
+		t.Fatalf("Zap should take the stale records of unpinned logfile %d", afnum)
+	}
+	lb = reopenLogbase(lb, true, t)
+	for key, want := range map[string]string{"a": "a1", "b": "", "c": "c1"} {
+		if vbyts, _, _, _ := lb.Get(key); string(vbyts) != want {
+			t.Fatalf("Expected %q for key %q after a rebuild, got %q", want, key, vbyts)
+		}
+	}
+}
+
+// Iterate over keys in order, by type and then value, with seeks, ranges,
+// prefixes, limits and reverse iteration.
+func TestIterator(t *testing.T) {
+	lb := freshLogbase("test_iterator", t)
+	keys := []interface{}{
+		uint8(9), uint8(200), int32(-5), int32(7), float64(-1.5), float64(2),
+		"apple", "user:ann", "user:bob", "user:bob2", "usex", "zebra",
+	}
+	for i := len(keys) - 1; i >= 0; i-- {
+		lb.Put(keys[i], []byte(fmt.Sprint(keys[i])), LBTYPE_STRING)
+	}
+	lb.Put("gone", []byte("gone"), LBTYPE_STRING)
+	lb.Delete("gone")
+
+	same := func(got []interface{}, want ...interface{}) bool {
+		if len(got) != len(want) {return false}
+		for i := range got {
+			if CompareKeys(got[i], want[i]) != 0 {return false}
+		}
+		return true
+	}
+	tests := []struct{
+		desc	string
+		it		*Iterator
+		want	[]interface{}
+	}{
+		{"all", lb.Iterator(), keys},
+		{"prefix", lb.Iterator().Prefix("user:"), keys[7:10]},
+		{"reverse prefix", lb.Iterator().Prefix("user:").Reverse(),
+			[]interface{}{"user:bob2", "user:bob", "user:ann"}},
+		{"range", lb.Iterator().Range(int32(0), "user:bob"), keys[3:8]},
+		{"reverse range", lb.Iterator().Range(uint8(10), int32(7)).Reverse(),
+			[]interface{}{int32(-5), uint8(200)}},
+		{"seek", lb.Iterator().Seek("b"), keys[7:]},
+		{"reverse seek", lb.Iterator().Reverse().Seek(float64(0)).Limit(3),
+			[]interface{}{float64(-1.5), int32(7), int32(-5)}},
+		{"limit", lb.Iterator().Prefix("u").Limit(2), keys[7:9]},
+		{"empty prefix", lb.Iterator().Prefix("nope"), nil},
+	}
+	for _, test := range tests {
+		if got := test.it.Keys(); !same(got, test.want...) {
+			t.Fatalf("Iterating %s should give %v, but gave %v", test.desc, test.want, got)
+		}
+	}
+
+	it := lb.Iterator().Prefix("user:")
+	if !it.Next() || it.Key() != "user:ann" {t.Fatalf("Expected user:ann first")}
+	lb.Delete("user:bob")
+	lb.Put("user:bert", []byte("bert"), LBTYPE_STRING)
+	if !it.Next() || it.Key() != "user:bert" {
+		t.Fatalf("The iterator should see writes after its position, got %v", it.Key())
+	}
+	vbyts, _, err := it.Value()
+	if err != nil || string(vbyts) != "bert" {
+		t.Fatalf("Expected value bert for user:bert, got %q (%v)", vbyts, err)
+	}
+	if !it.Next() || it.Key() != "user:bob2" || it.Next() {
+		t.Fatalf("The iterator should end with user:bob2")
+	}
+
+	lb = reopenLogbase(lb, false, t)
+	got := lb.Iterator().Keys()
+	if len(got) != len(keys) || lb.mcat.order.Len() != lb.mcat.Len() {
+		t.Fatalf("The ordered keys should be loaded with the catalog, got %v", got)
+	}
+	for i := 1; i < len(got); i++ {
+		if CompareKeys(got[i - 1], got[i]) >= 0 {
+			t.Fatalf("Keys out of order after loading: %v", got)
+		}
+	}
+
+	ok := NewOrderedKeys()
+	want := make(map[int64]bool)
+	for i := int64(0); i < 2000; i++ {
+		n := (i * 7919) % 1000
+		if i % 3 == 0 {
+			ok.Delete(n)
+			delete(want, n)
+		} else {
+			ok.Insert(n)
+			want[n] = true
+		}
+	}
+	var n int64 = -1
+	count := 0
+	for key, found := ok.After(nil, true); found; key, found = ok.After(key, false) {
+		if key.(int64) <= n || !want[key.(int64)] {t.Fatalf("Bad key %v after %d", key, n)}
+		n = key.(int64)
+		count++
+	}
+	if count != len(want) || ok.Len() != len(want) {
+		t.Fatalf("Expected %d ordered keys, walked %d of %d", len(want), count, ok.Len())
+	}
+}
+
+// Put keys with a time-to-live, which survives reloading and rebuilding, and
+// reap them once expired.
+func TestTTL(t *testing.T) {
+	lb := freshLogbase("test_ttl", t)
+	lb.config.CACHE_VALUES = false
+	if _, err := lb.PutWithTTL("sess", []byte("s1"), LBTYPE_STRING, 0); err == nil {
+		t.Fatalf("A time-to-live of zero should be refused")
+	}
+	ttl := 300 * time.Millisecond
+	mcr, err := lb.PutWithTTL("sess", []byte("s1"), LBTYPE_STRING, ttl)
+	if err != nil {t.Fatalf("Problem putting with a time-to-live: %s", err)}
+	mcr2, _ := lb.PutWithTTL("sess2", []byte("s2"), LBTYPE_STRING, ttl)
+	lb.Put("keep", []byte("kept"), LBTYPE_STRING)
+	expiry := mcr.ToValueLocation().Expiry()
+	if expiry == 0 {t.Fatalf("The catalog record should carry the expiry")}
+
+	for i, rebuild := range []bool{false, false, true} {
+		lb.config.CRC_READ_SAMPLE_RATE = float64(i % 2)
+		vbyts, vtype, mcr, err := lb.Get("sess")
+		if err != nil || string(vbyts) != "s1" || vtype != LBTYPE_STRING {
+			t.Fatalf("Expected string s1 before expiry, got %q of type %d (%v)", vbyts, vtype, err)
+		}
+		if mcr.ToValueLocation().Expiry() != expiry {
+			t.Fatalf("Expected expiry %d, got %d", expiry, mcr.ToValueLocation().Expiry())
+		}
+		lb = reopenLogbase(lb, rebuild, t)
+		lb.config.CACHE_VALUES = false
+	}
+
+	time.Sleep(time.Until(time.Unix(0, mcr2.ToValueLocation().Expiry()))) // both expired
+	if vbyts, _, mcr, _ := lb.Get("sess"); vbyts != nil || mcr != nil {
+		t.Fatalf("An expired key should be absent, but got %q", vbyts)
+	}
+	if _, err = lb.PutIfAbsent("sess2", []byte("s3"), LBTYPE_STRING); err != nil {
+		t.Fatalf("An expired key should count as absent: %s", err)
+	}
+	n, err := lb.ReapExpired()
+	if err != nil || n != 1 {t.Fatalf("Expected to reap 1 key, reaped %d (%v)", n, err)}
+	if lb.mcat.Get("sess") != nil || len(lb.zmap.Get("sess")) != 2 {
+		t.Fatalf("Reaping should delete the key and zap its value and tombstone")
+	}
+	lb = reopenLogbase(lb, true, t)
+	for key, want := range map[string]string{"sess": "", "sess2": "s3", "keep": "kept"} {
+		if vbyts, _, _, _ := lb.Get(key); string(vbyts) != want {
+			t.Fatalf("Expected %q for key %q after a rebuild, got %q", want, key, vbyts)
+		}
+	}
+	reaper := lb.StartReaper()
+	if lb.StartReaper() != reaper {t.Fatalf("Only one reaper should run")}
+	if err = lb.Close(); err != nil || lb.reaper != nil {
+		t.Fatalf("Closing should stop the reaper (%v)", err)
+	}
+}
+
+// Stamp records with sequence numbers and times, and read back the history
+// of a key until it is zapped.
+func TestHistory(t *testing.T) {
+	lb := freshLogbase("test_history", t)
+	seq0 := lb.LastSeq()
+	lb.Put("a", []byte("a1"), LBTYPE_STRING)
+	seq1 := lb.LastSeq()
+	time.Sleep(5 * time.Millisecond)
+	between := time.Now()
+	time.Sleep(5 * time.Millisecond)
+	lb.Put("a", []byte("a2"), LBTYPE_STRING)
+	if err := lb.Delete("a"); err != nil {t.Fatalf("Problem deleting: %s", err)}
+	seq3 := lb.LastSeq()
+	lb.Put("a", []byte("a3"), LBTYPE_STRING)
+	seq4 := lb.LastSeq()
+	if seq1 != seq0 + 1 || seq4 != seq0 + 4 {
+		t.Fatalf("Expected sequence numbers %d to %d, got %d to %d", seq0 + 1, seq0 + 4, seq1, seq4)
+	}
+	list := lb.livelog.indexfile.List
+	if last := list[len(list) - 1]; last.seq != seq4 || last.ts == 0 {
+		t.Fatalf("The index record should be stamped with %d, got %v", seq4, last.Stamp)
+	}
+
+	check := func(lb *Logbase, when string) {
+		versions, err := lb.History("a")
+		if err != nil {t.Fatalf("Problem reading history %s: %s", when, err)}
+		want := []string{"a1", "a2", "", "a3"}
+		if len(versions) != len(want) {
+			t.Fatalf("Expected %d versions %s, got %d", len(want), when, len(versions))
+		}
+		for i, kv := range versions {
+			vbyts, _ := kv.Value()
+			if string(vbyts) != want[i] || kv.Deleted() != (want[i] == "") ||
+				kv.Seq() != seq1 + uint64(i) || kv.Time().IsZero() {
+				t.Fatalf("Unexpected version %d %s: %q seq %d deleted %v",
+					i, when, vbyts, kv.Seq(), kv.Deleted())
+			}
+		}
+		for asof, want := range map[interface{}]string{
+			seq0: "", seq1: "a1", seq1 + 1: "a2", seq3: "", seq4: "a3",
+			between: "a1", time.Now(): "a3",
+		} {
+			vbyts, _, err := lb.GetAsOf("a", asof)
+			if err != nil || string(vbyts) != want {
+				t.Fatalf("Expected %q as of %v %s, got %q (%v)", want, asof, when, vbyts, err)
+			}
+		}
+	}
+	check(lb, "before reload")
+	if _, _, err := lb.GetAsOf("a", 3); err == nil {
+		t.Fatalf("GetAsOf should refuse an int")
+	}
+	lb = reopenLogbase(lb, false, t)
+	check(lb, "after reload")
+	lb = reopenLogbase(lb, true, t)
+	check(lb, "after rebuild")
+	if lb.LastSeq() != seq4 {
+		t.Fatalf("Expected sequence numbers to carry on from %d, got %d", seq4, lb.LastSeq())
+	}
+
+	if err := lb.Zap(1024); err != nil {t.Fatalf("Problem zapping: %s", err)}
+	versions, err := lb.History("a")
+	if err != nil || len(versions) != 1 || versions[0].Seq() != seq4 {
+		t.Fatalf("Only the current version should survive a zap, got %d (%v)", len(versions), err)
+	}
+	if vbyts, _, _ := lb.GetAsOf("a", seq1); vbyts != nil {
+		t.Fatalf("A zapped version should be gone, got %q", vbyts)
+	}
+	lb.Put("b", []byte("b1"), LBTYPE_STRING)
+	if lb.LastSeq() != seq4 + 1 {
+		t.Fatalf("Expected sequence number %d after a zap, got %d", seq4 + 1, lb.LastSeq())
+	}
+}
+
+// Compress large values as they are stored, and read them back whatever the
+// current setting.
+func TestCompression(t *testing.T) {
+	lb := freshLogbase("test_compress", t)
+	lb.config.CACHE_VALUES = false
+	lb.config.COMPRESS_VALUES = true
+	lb.config.COMPRESS_MIN_SIZE = 64
+	big := strings.Repeat(`{"name":"logbase","kind":"kv"},`, 40)
+	expected := map[string]string{
+		"big": big, "small": "tiny", "ttl": big + "ttl", "batch": big + "batch",
+	}
+	mcr, err := lb.Put("big", []byte(big), LBTYPE_STRING)
+	if err != nil {t.Fatalf("Problem putting a compressible value: %s", err)}
+	vloc := mcr.ToValueLocation()
+	if int(vloc.vsz) >= len(big) {
+		t.Fatalf("Expected a stored size under %d bytes, got %d", len(big), vloc.vsz)
+	}
+	lrec, _ := lb.livelog.ReadLogRecord(lb.RecordLocation(vloc, AsLBUINT(len("big") + LBTYPE_SIZE)).rpos)
+	if lrec == nil || lrec.vtype != LBTYPE_COMPRESSED {
+		t.Fatalf("The log record should be flagged as compressed: %v", lrec)
+	}
+	mcr, _ = lb.Put("small", []byte("tiny"), LBTYPE_STRING)
+	if mcr.ToValueLocation().vsz != AsLBUINT(len("tiny") + LBTYPE_SIZE) {
+		t.Fatalf("A value under COMPRESS_MIN_SIZE should be stored as it is")
+	}
+	mcr, _ = lb.PutWithTTL("ttl", []byte(big + "ttl"), LBTYPE_STRING, time.Hour)
+	if mcr.ToValueLocation().Expiry() == 0 {t.Fatalf("A compressed value should keep its expiry")}
+	err = lb.NewWriteBatch().Put("batch", []byte(big + "batch"), LBTYPE_STRING).Commit()
+	if err != nil {t.Fatalf("Problem committing a batch: %s", err)}
+
+	check := func(lb *Logbase, when string) {
+		for _, rate := range []float64{0, 1} {
+			lb.config.CRC_READ_SAMPLE_RATE = rate
+			for key, val := range expected {
+				vbyts, vtype, _, err := lb.Get(key)
+				if err != nil || string(vbyts) != val || vtype != LBTYPE_STRING {
+					t.Fatalf("Expected %d bytes for key %q %s, got %d of type %d (%v)",
+						len(val), key, when, len(vbyts), vtype, err)
+				}
+			}
+		}
+	}
+	check(lb, "before reload")
+	lb.config.CACHE_VALUES = true
+	lb.config.CACHE_VALUE_MAXSIZE = 4096
+	lb.Get("big")
+	if v, ok := lb.mcat.Get("big").(*Value); !ok || string(v.vbyts) != big {
+		t.Fatalf("The value cache should hold the value uncompressed")
+	}
+	versions, err := lb.History("big")
+	if vbyts, _ := versions[0].Value(); err != nil || string(vbyts) != big {
+		t.Fatalf("History should read the value uncompressed (%v)", err)
+	}
+	lb = reopenLogbase(lb, false, t)
+	lb.config.COMPRESS_VALUES = false
+	check(lb, "after reload")
+	lb = reopenLogbase(lb, true, t)
+	check(lb, "after rebuild")
+}
+
+// Values are sealed on disk, read back with the key, refused without it,
+// and rewritten under a new key by Rekey.
+func TestEncryption(t *testing.T) {
+	lb := freshLogbase("test_encrypt", t)
+	configure := func(lb *Logbase, rebuild bool, pass string, olds ...string) *Logbase {
+		lb = reopenLogbase(lb, rebuild, t)
+		lb.config.CACHE_VALUES = false
+		lb.config.ENCRYPTION_PASSPHRASE = pass
+		lb.config.ENCRYPTION_OLD_PASSPHRASES = olds
+		var err error
+		lb.keyring, err = lb.LoadKeyring()
+		if err != nil {t.Fatalf("Problem loading keys: %s", err)}
+		return lb
+	}
+	lb = configure(lb, false, "first")
+	if !lb.keyring.Encrypting() {t.Fatalf("The logbase should be encrypting values")}
+	expected := map[string]string{
+		"name": "Ada Lovelace", "pass": "hashed password", "ttl": "short lived",
+		"batch": "batched secret",
+	}
+	for _, key := range []string{"name", "pass"} {
+		if _, err := lb.Put(key, []byte(expected[key]), LBTYPE_STRING); err != nil {
+			t.Fatalf("Problem putting key %q: %s", key, err)
+		}
+	}
+	lb.PutWithTTL("ttl", []byte(expected["ttl"]), LBTYPE_STRING, time.Hour)
+	err := lb.NewWriteBatch().Put("batch", []byte(expected["batch"]), LBTYPE_STRING).Commit()
+	if err != nil {t.Fatalf("Problem committing a batch: %s", err)}
+
+	fpaths, _, _ := lb.GetLogfilePaths()
+	for _, fpath := range fpaths {
+		byts, _ := ioutil.ReadFile(fpath)
+		for key, val := range expected {
+			if bytes.Contains(byts, []byte(val)) {
+				t.Fatalf("The value of key %q is in the clear in %s", key, fpath)
+			}
+		}
+	}
+	check := func(lb *Logbase, when string) {
+		for key, val := range expected {
+			vbyts, vtype, _, err := lb.Get(key)
+			if err != nil || string(vbyts) != val || vtype != LBTYPE_STRING {
+				t.Fatalf("Expected %q for key %q %s, got %q of type %d (%v)",
+					val, key, when, vbyts, vtype, err)
+			}
+		}
+	}
+	check(lb, "before reload")
+	lb = configure(lb, true, "first")
+	check(lb, "after rebuild")
+
+	lb = configure(lb, false, "second")
+	if _, _, _, err = lb.Get("name"); err == nil {
+		t.Fatalf("Reading a value sealed under another key should fail")
+	}
+
+	lb = configure(lb, false, "second", "first")
+	if !lb.keyring.HasOldKeys() {t.Fatalf("The keyring should hold the old key")}
+	check(lb, "with the old key")
+	rep, err := lb.Rekey()
+	if err != nil || rep.Records() != len(expected) {
+		t.Fatalf("Expected %d values rekeyed, got %v (%v)", len(expected), rep, err)
+	}
+	lb = configure(lb, false, "second")
+	check(lb, "after rekeying")
+	if vloc := lb.mcat.Get("ttl").ToValueLocation(); vloc.Expiry() == 0 {
+		t.Fatalf("A rekeyed value should keep its expiry")
+	}
+}
+
+// A reader that fails after the given number of bytes.
+type failingReader struct {
+	left	int
+}
+
+func (fr *failingReader) Read(p []byte) (int, error) {
+	if fr.left <= 0 {return 0, fmt.Errorf("reader failed")}
+	if len(p) > fr.left {p = p[:fr.left]}
+	for i := range p {p[i] = 'x'}
+	fr.left -= len(p)
+	return len(p), nil
+}
+
+// Stream a value bigger than a logfile in and out, and replace, delete and
+// fail to stream values, leaving no chunks behind.
+func TestStreaming(t *testing.T) {
+	lb := freshLogbase("test_stream", t)
+	lb.config.LOGFILE_MAXBYTES = 2048
+	lb.config.STREAM_CHUNK_SIZE = 1000
+	big := make([]byte, 10000)
+	for i := range big {big[i] = byte(i * 7 % 251)}
+	chunks := func(lb *Logbase) (n int) {
+		lb.mcat.RLock()
+		defer lb.mcat.RUnlock()
+		for key := range lb.mcat.index {
+			if IsChunkId(key) {n++}
+		}
+		return
+	}
+	stream := func(lb *Logbase, key string, when string) {
+		rdr, vtype, err := lb.GetReader(key)
+		if err != nil || rdr == nil {t.Fatalf("Problem opening reader %s: %v", when, err)}
+		defer rdr.Close()
+		vbyts, err := ioutil.ReadAll(rdr)
+		if err != nil || !bytes.Equal(vbyts, big) || vtype != LBTYPE_BYTES {
+			t.Fatalf("Expected %d streamed bytes %s, got %d of type %d (%v)",
+				len(big), when, len(vbyts), vtype, err)
+		}
+	}
+
+	_, err := lb.PutReader("big", bytes.NewReader(big), LBTYPE_BYTES)
+	if err != nil {t.Fatalf("Problem streaming value: %s", err)}
+	if n := chunks(lb); n != 10 {t.Fatalf("Expected 10 chunks, got %d", n)}
+	if _, fnums, _ := lb.GetLogfilePaths(); len(fnums) < 5 {
+		t.Fatalf("The chunks should span several logfiles, not %v", fnums)
+	}
+	stream(lb, "big", "after put")
+	if vbyts, vtype, _, err := lb.Get("big"); err != nil || !bytes.Equal(vbyts, big) || vtype != LBTYPE_BYTES {
+		t.Fatalf("Get should read the streamed value whole (%v)", err)
+	}
+	if keys := lb.Iterator().Keys(); len(keys) != 1 || keys[0] != "big" {
+		t.Fatalf("Iterating should only find the key, not its chunks: %v", keys)
+	}
+	lb = reopenLogbase(lb, true, t)
+	lb.config.LOGFILE_MAXBYTES = 2048
+	stream(lb, "big", "after rebuild")
+
+	// Replace the value while it is being read
+	rdr, _, err := lb.GetReader("big")
+	if err != nil {t.Fatalf("Problem opening reader: %s", err)}
+	_, err = lb.Put("big", []byte("small"), LBTYPE_STRING)
+	if err != nil {t.Fatalf("Problem replacing streamed value: %s", err)}
+	if n := chunks(lb); n != 0 {t.Fatalf("Replacing the value left %d chunks", n)}
+	lb.Zap(COMPACTION_BUFFER_SIZE)
+	lb.Merge()
+	vbyts, err := ioutil.ReadAll(rdr)
+	if err != nil || !bytes.Equal(vbyts, big) {
+		t.Fatalf("An open reader should read the old value, got %d bytes (%v)", len(vbyts), err)
+	}
+	rdr.Close()
+	if _, pinned := lb.OldestPinned(); pinned {t.Fatalf("Closing the reader should unpin its logfiles")}
+	if vbyts, _, _, _ := lb.Get("big"); string(vbyts) != "small" {
+		t.Fatalf("Expected the replaced value, got %q", vbyts)
+	}
+
+	lb.PutReader("big", bytes.NewReader(big), LBTYPE_BYTES)
+	if err = lb.Delete("big"); err != nil {t.Fatalf("Problem deleting streamed value: %s", err)}
+	if n := chunks(lb); n != 0 {t.Fatalf("Deleting the value left %d chunks", n)}
+	_, err = lb.PutReader("broken", &failingReader{left: 2500}, LBTYPE_BYTES)
+	if err == nil {t.Fatalf("A failing reader should fail the put")}
+	if n := chunks(lb); n != 0 {t.Fatalf("A failed put left %d chunks", n)}
+	if _, err = lb.Put(CHUNKID_TYPE(1), []byte("x"), LBTYPE_BYTES); err == nil {
+		t.Fatalf("Putting a chunk key directly should fail")
+	}
+}
+
+// Back up a logbase while it is written to, check the manifest against the
+// files, and open the backup as a logbase as it was.
+func TestBackup(t *testing.T) {
+	lb := freshLogbase("test_backup", t)
+	for i := 0; i < 20; i++ {
+		lb.Put(fmt.Sprintf("key%02d", i), []byte(fmt.Sprintf("value%02d", i)), LBTYPE_STRING)
+	}
+	lb.Delete("key03")
+	cwd, _ := os.Getwd()
+	for _, link := range []bool{false, true} {
+		lb.config.BACKUP_HARD_LINKS = link
+		dest := filepath.Join(cwd, fmt.Sprintf("test_backup_copy_%v", link))
+		os.RemoveAll(dest)
+
+		done := make(chan bool)
+		go func() {
+			defer close(done)
+			for i := 0; i < 50; i++ {
+				lb.Put(fmt.Sprintf("later%v%02d", link, i), []byte("written during the backup"), LBTYPE_STRING)
+			}
+		}()
+		man, err := lb.Backup(dest)
+		<-done
+		if err != nil {t.Fatalf("Problem backing up: %s", err)}
+		if _, err = lb.Backup(dest); err == nil {
+			t.Fatalf("Backing up into a backup should fail")
+		}
+
+		// Writes and a zap after the backup must leave it as it was
+		lb.Put("key01", []byte("changed"), LBTYPE_STRING)
+		if err = lb.Zap(COMPACTION_BUFFER_SIZE); err != nil {t.Fatalf("Problem zapping: %s", err)}
+		// So must rewriting an index file, which a check then repairs
+		lfile, err := lb.GetLogfile(1)
+		if err != nil {t.Fatalf("Problem getting logfile 1: %s", err)}
+		lfindex, err := lfile.GetIndexfile().Load()
+		if err != nil || len(lfindex.List) == 0 {t.Fatalf("Problem loading index of logfile 1: %v", err)}
+		lfindex.List = lfindex.List[1:]
+		if err = lfile.GetIndexfile().Save(lfindex); err != nil {t.Fatalf("Problem saving index: %s", err)}
+		loaded, err := LoadBackupManifest(dest)
+		if err != nil || len(loaded.Files) != len(man.Files) || loaded.Seq != man.Seq {
+			t.Fatalf("Expected to load manifest %+v, got %+v (%v)", man, loaded, err)
+		}
+		for _, bf := range loaded.Files {
+			got, err := MakeBackupFile(dest, bf.Path)
+			if err != nil || *got != *bf {
+				t.Fatalf("File %s in the backup should match the manifest %+v, got %+v (%v)",
+					bf.Path, bf, got, err)
+			}
+		}
+		if rep, err := lb.Check(true); err != nil || len(rep.Problems()) != 1 {
+			t.Fatalf("Expected a check to repair the index of logfile 1: %v (%v)", rep, err)
+		}
+
+		blb := MakeLogbase(dest, lb.debug)
+		if err = blb.Init(false); err != nil {t.Fatalf("Could not open backup: %s", err)}
+		for i := 0; i < 20; i++ {
+			key := fmt.Sprintf("key%02d", i)
+			vbyts, _, _, err := blb.Get(key)
+			if i == 3 {
+				if vbyts != nil {t.Fatalf("Deleted key %q is in the backup", key)}
+				continue
+			}
+			if err != nil || string(vbyts) != fmt.Sprintf("value%02d", i) {
+				t.Fatalf("Expected the value of key %q in the backup, got %q (%v)", key, vbyts, err)
+			}
+		}
+		if blb.LastSeq() != man.Seq {
+			t.Fatalf("The backup should reach sequence number %d, not %d", man.Seq, blb.LastSeq())
+		}
+		for i := 0; i < 50; i++ {
+			key := fmt.Sprintf("later%v%02d", link, i)
+			versions, _ := lb.History(key)
+			vbyts, _, _, _ := blb.Get(key)
+			if before := versions[0].Seq() <= man.Seq; before != (vbyts != nil) {
+				t.Fatalf("Key %q written at sequence number %d should be in a backup " +
+					"up to %d: %v, but found %q", key, versions[0].Seq(), man.Seq, before, vbyts)
+			}
+		}
+		blb.Close()
+		lb.Delete("key01")
+		lb.Put("key01", []byte("value01"), LBTYPE_STRING)
+	}
+}
+
+func TestRestore(t *testing.T) {
+	lb := freshLogbase("test_restore", t)
+	for i := 0; i < 10; i++ {
+		lb.Put(fmt.Sprintf("key%02d", i), []byte(fmt.Sprintf("value%02d", i)), LBTYPE_STRING)
+	}
+	cwd, _ := os.Getwd()
+	dest := filepath.Join(cwd, "test_restore_backup")
+	os.RemoveAll(dest)
+	man, err := lb.Backup(dest)
+	if err != nil {t.Fatalf("Problem backing up: %s", err)}
+
+	// Writes after the backup, spread over several logfiles
+	put := func(from, to int) {
+		for i := from; i < to; i++ {
+			lb.Put(fmt.Sprintf("after%02d", i), []byte(fmt.Sprintf("value%02d", i)), LBTYPE_STRING)
+		}
+	}
+	put(0, 10)
+	seq := lb.LastSeq()
+	err = lb.NewWriteBatch().
+		Put("after10", []byte("value10"), LBTYPE_STRING).
+		Put("after11", []byte("value11"), LBTYPE_STRING).Commit()
+	if err != nil {t.Fatalf("Problem committing batch: %s", err)}
+	put(12, 20)
+	when := time.Now()
+	put(20, 30)
+	lb.Delete("key05")
+
+	check := func(target string, until interface{}, upto int, last uint64) {
+		os.RemoveAll(target)
+		rep, err := RestoreLogbase(dest, target, until, lb.debug, lb.abspath)
+		if err != nil {t.Fatalf("Problem restoring to %v: %s", until, err)}
+		if last > 0 && rep.LastSeq() != last {
+			t.Fatalf("Restore to %v should end at sequence number %d, not %d", until, last, rep.LastSeq())
+		}
+		rlb := MakeLogbase(target, lb.debug)
+		if err = rlb.Init(false); err != nil {t.Fatalf("Could not open restored logbase: %s", err)}
+		defer rlb.Close()
+		for i := 0; i < 30; i++ {
+			key := fmt.Sprintf("after%02d", i)
+			vbyts, _, _, err := rlb.Get(key)
+			if i < upto && (err != nil || string(vbyts) != fmt.Sprintf("value%02d", i)) {
+				t.Fatalf("Expected key %q restored to %v, got %q (%v)", key, until, vbyts, err)
+			}
+			if i >= upto && vbyts != nil {
+				t.Fatalf("Key %q is after the restore point %v", key, until)
+			}
+		}
+		vbyts, _, _, _ := rlb.Get("key05")
+		if (upto == 30) != (vbyts == nil) {
+			t.Fatalf("Key %q should be deleted only in a full restore, got %q", "key05", vbyts)
+		}
+	}
+	check(filepath.Join(cwd, "test_restore_seq"), seq, 10, seq)
+	// A point inside the batch leaves all of it out
+	check(filepath.Join(cwd, "test_restore_batch"), seq + 2, 10, seq)
+	check(filepath.Join(cwd, "test_restore_time"), when, 20, 0)
+	check(filepath.Join(cwd, "test_restore_all"), nil, 30, lb.LastSeq())
+
+	if _, err = RestoreLogbase(dest, filepath.Join(cwd, "test_restore_early"), man.Seq - 1, lb.debug, lb.abspath); err == nil {
+		t.Fatalf("Restoring to a point before the backup should fail")
+	}
+	corrupt := filepath.Join(dest, filepath.FromSlash(man.Files[0].Path))
+	byts, _ := ioutil.ReadFile(corrupt)
+	ioutil.WriteFile(corrupt, append(byts, 0), 0666)
+	target := filepath.Join(cwd, "test_restore_corrupt")
+	os.RemoveAll(target)
+	if _, err = RestoreLogbase(dest, target, nil, lb.debug); err == nil {
+		t.Fatalf("Restoring a backup with a corrupt file should fail")
+	}
+	if Exists(target) {t.Fatalf("Nothing should be restored from a corrupt backup")}
+}
+
+func TestExport(t *testing.T) {
+	lb := freshLogbase("test_export", t)
+	lb.config.LOGFILE_MAXBYTES = 100000
+	lb.config.STREAM_CHUNK_SIZE = 16
+	put := func(key interface{}, val interface{}, vtype LBTYPE) {
+		vbyts, err := ToBytes(val, vtype, lb.debug)
+		if err == nil {_, err = lb.Put(key, vbyts, vtype)}
+		if err != nil {t.Fatalf("Problem putting key %v: %s", key, err)}
+	}
+	put("uint8", uint8(200), LBTYPE_UINT8)
+	put("uint64", uint64(1 << 64 - 1), LBTYPE_UINT64)
+	put("int16", int16(-300), LBTYPE_INT16)
+	put("float32", float32(0.1), LBTYPE_FLOAT32)
+	put("nan", math.NaN(), LBTYPE_FLOAT64)
+	put("inf", float32(math.Inf(1)), LBTYPE_FLOAT32)
+	put("complex64", complex64(1.5 - 2i), LBTYPE_COMPLEX64)
+	put("complex128", complex(0.25, math.Inf(-1)), LBTYPE_COMPLEX128)
+	put("location", "/tmp/a \"quoted\" path", LBTYPE_LOCATION)
+	put("bytes", []byte{0, 1, 0xfe, 0xff}, LBTYPE_BYTES)
+	put(uint64(1 << 64 - 1), "max key", LBTYPE_STRING)
+	put(int8(-5), "negative key", LBTYPE_STRING)
+	put(float64(-2.5), "float key", LBTYPE_STRING)
+	put(complex64(3i), "complex key", LBTYPE_STRING)
+	cidset := MakeCatalogIdSet(12)
+	cidset.Add(NewCatalogId(30))
+	lb.Put("catids", cidset.ToBytes(lb.debug), LBTYPE_CATID_SET)
+	if _, err := lb.PutWithTTL("ttl", []byte("soon gone"), LBTYPE_STRING, time.Hour); err != nil {
+		t.Fatalf("Problem putting with a time-to-live: %s", err)
+	}
+	streamed := strings.Repeat("a streamed value ", 10)
+	if _, err := lb.PutReader("streamed", strings.NewReader(streamed), LBTYPE_STRING); err != nil {
+		t.Fatalf("Problem streaming a value: %s", err)
+	}
+	colour, _, _ := lb.Kind("Colour")
+	colour.Save(lb)
+	frog, _, _ := lb.Doc("frog")
+	frog.AddParent(colour).SetFieldWithType("eyes", uint8(2), LBTYPE_UINT8)
+	frog.SetFieldWithType("weight", 0.5, LBTYPE_FLOAT64)
+	frog.Save(lb)
+
+	var bfr bytes.Buffer
+	n, err := lb.Export(&bfr)
+	if err != nil {t.Fatalf("Problem exporting: %s", err)}
+	lines := strings.Split(strings.TrimSpace(bfr.String()), "\n")
+	if len(lines) != n || n != 21 {
+		t.Fatalf("Expected 21 lines exported, got %d for %d keys:\n%s", len(lines), n, bfr.String())
+	}
+	for _, line := range []string{
+		`{"key":"nan","ktype":171,"vtype":91,"value":"NaN"}`,
+		`{"key":"float32","ktype":171,"vtype":90,"value":0.1}`,
+		`{"key":"complex128","ktype":171,"vtype":111,"value":{"real":0.25,"imag":"-Inf"}}`,
+		`{"key":"bytes","ktype":171,"vtype":170,"value":"AAH+/w=="}`,
+		`{"key":"catids","ktype":171,"vtype":180,"value":[12,30]}`,
+		`{"key":18446744073709551615,"ktype":53,"vtype":171,"value":"max key"}`,
+		`{"key":11,"ktype":121,"vtype":191,"value":{"id":11,"name":"doc:frog",` +
+			`"fields":{"eyes":{"vtype":50,"value":2},"weight":{"vtype":91,"value":0.5}},"parents":[10]}}`,
+	} {
+		if !strings.Contains(bfr.String(), line + "\n") {
+			t.Fatalf("Expected line %s in the export:\n%s", line, bfr.String())
+		}
+	}
+	var located bytes.Buffer
+	lb.ExportWithLocations(&located)
+	if strings.Count(located.String(), `"location":{"fnum":`) != n {
+		t.Fatalf("Expected a location on every line:\n%s", located.String())
+	}
+
+	// Importing the export gives the same export back
+	ilb := freshLogbase("test_export_import", t)
+	ilb.config.LOGFILE_MAXBYTES = 100000
+	ilb.config.STREAM_CHUNK_SIZE = 16
+	m, err := ilb.Import(bytes.NewReader(bfr.Bytes()))
+	if err != nil || m != n {t.Fatalf("Expected to import %d keys, imported %d (%v)", n, m, err)}
+	var again bytes.Buffer
+	ilb.Export(&again)
+	if again.String() != bfr.String() {
+		t.Fatalf("Expected the import to export as\n%s\nbut got\n%s", bfr.String(), again.String())
+	}
+	if ids, _ := ilb.ChunksOf("streamed"); len(ids) == 0 {
+		t.Fatalf("The streamed value should be imported streamed")
+	}
+	if kind, exists, err := ilb.GetKind("Colour"); err != nil || !exists || !kind.CATID().Equals(colour.CATID()) {
+		t.Fatalf("Expected to find the imported kind %q, got %v (%v)", "Colour", kind, err)
+	}
+
+	bad := `{"key":"ok","ktype":171,"vtype":171,"value":"fine"}
+{"key":"big","ktype":171,"vtype":50,"value":300}
+`
+	if m, err = ilb.Import(strings.NewReader(bad)); err == nil || m != 1 {
+		t.Fatalf("Import should stop at an out of range value after 1 key, got %d (%v)", m, err)
+	}
+}
+
+// Check a sound logbase, then break each of its files in turn, check again,
+// repair and check the repair.
+func TestCheck(t *testing.T) {
+	lb := freshLogbase("test_check", t)
+	lb.config.STREAM_CHUNK_SIZE = 16
+	for i := 0; i < 10; i++ {
+		lb.Put(fmt.Sprintf("k%d", i), []byte(fmt.Sprintf("v%d", i)), LBTYPE_STRING)
+	}
+	lb.Put("k0", []byte("v0 again"), LBTYPE_STRING)
+	lb.Delete("k9")
+	err := lb.NewWriteBatch().Put("b0", []byte("b0"), LBTYPE_STRING).Delete("k8").Commit()
+	if err != nil {t.Fatalf("Problem committing batch: %s", err)}
+	lb.PutWithTTL("ttl", []byte("soon gone"), LBTYPE_STRING, time.Hour)
+	streamed := strings.Repeat("streamed ", 8)
+	if _, err = lb.PutReader("streamed", strings.NewReader(streamed), LBTYPE_STRING); err != nil {
+		t.Fatalf("Problem streaming a value: %s", err)
+	}
+	if err = lb.InitSecurity("admin", "secret"); err != nil {t.Fatalf("Problem adding a user: %s", err)}
+	cat, _ := lb.GetCatalog("chosen")
+	for _, key := range []string{"k1", "k3"} {cat.Put(key, lb.mcat.Get(key))}
+	lb.Zap(COMPACTION_BUFFER_SIZE)
+	lb.Save()
+
+	check := func(repair bool, when string) *CheckReport {
+		rep, err := lb.Check(repair)
+		if err != nil {t.Fatalf("Problem checking %s: %s", when, err)}
+		return rep
+	}
+	kinds := func(rep *CheckReport) map[string]int {
+		found := make(map[string]int)
+		for _, prob := range rep.Problems() {found[prob.Kind()]++}
+		return found
+	}
+	if rep := check(false, "a sound logbase"); !rep.OK() || rep.nusers != 1 || rep.ncatalogs != 1 {
+		t.Fatalf("Expected a sound logbase with a user and a catalog, got %s %v", rep, rep.Problems())
+	}
+
+	_, fnums, _ := lb.GetLogfilePaths()
+	os.Remove(filepath.Join(lb.abspath, lb.MakeIndexfileRelPath(fnums[0])))
+	lfile, _ := lb.GetLogfile(fnums[1])
+	lfindex, _ := lfile.indexfile.Load()
+	lfile.indexfile.Save(&Index{List: lfindex.List[:len(lfindex.List) - 1]})
+	ioutil.WriteFile(filepath.Join(lb.abspath, lb.MakeIndexfileRelPath(999)), nil, 0666)
+	bogus := NewValueLocation()
+	bogus.fnum, bogus.vsz, bogus.vpos = fnums[0], 2, 3
+	lb.mcat.Delete("k2")
+	lb.mcat.Put("ghost", bogus)
+	live := NewZapRecord()
+	live.RecordLocation = lb.RecordLocation(lb.mcat.Get("k1").ToValueLocation(),
+		LBUINT(len(InjectKeyType("k1", lb.debug))))
+	lb.zmap.PutRecord("k1", live)
+	lb.Put("k4", []byte("v4 again"), LBTYPE_STRING)
+	lb.zmap.Delete("k4")
+	if _, err = lb.putChunk([]byte("stray")); err != nil {t.Fatalf("Problem storing a chunk: %s", err)}
+	cat.Put("k3", bogus)
+	cat.Put("k9", bogus)
+	cat.Save()
+	ioutil.WriteFile(filepath.Join(lb.UserPermissionDirPath(), "ghost"), nil, 0666)
+
+	expected := map[string]int{
+		CHECK_INDEX:		3,
+		CHECK_MASTER:		2,
+		CHECK_ZAPMAP:		2,
+		CHECK_CHUNK:		1,
+		CHECK_CATALOG:		2,
+		CHECK_PERMISSION:	1,
+	}
+	for _, repair := range []bool{false, true} {
+		rep := check(repair, "a broken logbase")
+		if found := kinds(rep); fmt.Sprint(found) != fmt.Sprint(expected) {
+			t.Fatalf("Expected problems %v with repair %v, found %v: %v",
+				expected, repair, found, rep.Problems())
+		}
+		if unrepaired := rep.Unrepaired(); (repair && unrepaired != 0) || (!repair && unrepaired != 11) {
+			t.Fatalf("Expected all problems to be repaired only with repair on, got %s", rep)
+		}
+	}
+	if rep := check(false, "a repaired logbase"); !rep.OK() {
+		t.Fatalf("Expected the repair to leave no problems, got %v", rep.Problems())
+	}
+	vbyts, _, _, _ := lb.Get("k2")
+	ghost, _, _, _ := lb.Get("ghost")
+	if string(vbyts) != "v2" || ghost != nil {
+		t.Fatalf("Expected the repair to restore k2 and drop ghost, got %q and %q", vbyts, ghost)
+	}
+	if cr := cat.Get("k3"); cr != lb.mcat.Get("k3") || cat.Get("k9") != nil {
+		t.Fatalf("Expected the catalog to point at the Master Catalog, got %v", cat.Map())
+	}
+
+	for _, rebuild := range []bool{false, true} {
+		lb = reopenLogbase(lb, rebuild, t)
+		if rep := check(false, "after reopening"); !rep.OK() {
+			t.Fatalf("Expected no problems after reopening (rebuild %v), got %v", rebuild, rep.Problems())
+		}
+		rdr, _, err := lb.GetReader("streamed")
+		if err != nil {t.Fatalf("Problem opening reader: %s", err)}
+		vbyts, _ = ioutil.ReadAll(rdr)
+		rdr.Close()
+		if string(vbyts) != streamed {t.Fatalf("Expected the streamed value, got %q", vbyts)}
+	}
+}
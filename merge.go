@@ -0,0 +1,246 @@
+/*
+	Merging of sealed logfiles, in the manner of Bitcask.
+
+	Where Zap compacts each logfile in place, Merge reads the live records from
+	all sealed logfiles (every logfile but the live log), and writes them out
+	afresh into as few new logfiles as LOGFILE_MAXBYTES allows, each with a new
+	index ("hint") file.  Tombstones are dropped, since every older record for
+	a deleted key is in one of the inputs.  Values are written under the
+	current encryption key, if they are not already (see encrypt.go).
+
+	The new logfiles are numbered after the live log, whose records are left
+	as they are, but which is then sealed so that later writes sort after the
+	merged records.  No key in the merged logfiles has a record in the old
+	live log, so the order between them does not matter.  The outputs are
+	synced before the live log is sealed and the catalogs switched over to
+	them, and a merge failing before then removes them again, since the
+	next Init would take the last of them for the live log.  The catalogs and
+	zapmap are saved before any input is deleted.  A crash before the save
+	replays the outputs over the old catalogs from their checkpoint, and a
+	crash after it leaves inputs holding only stale records, which the next
+	merge deletes.
+
+	While a snapshot pins a logfile, only the sealed logfiles older than every
+	pinned one are merged.  Those still hold every older record of a deleted
+	key whose tombstone they hold, and no newer logfile holds a record of a
+	key whose live record they hold.
+*/
+package logbase
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Summary of a merge.
+type MergeReport struct {
+	inputs		[]LBUINT // logfile numbers merged
+	outputs		[]LBUINT // logfile numbers written
+	nrecords	int // number of live records copied
+	insize		int // total size of the inputs
+	outsize		int // total size of the outputs
+}
+
+func (rep *MergeReport) Inputs() []LBUINT {return rep.inputs}
+func (rep *MergeReport) Outputs() []LBUINT {return rep.outputs}
+func (rep *MergeReport) Records() int {return rep.nrecords}
+
+// Number of bytes reclaimed by the merge.
+func (rep *MergeReport) Reclaimed() int {return rep.insize - rep.outsize}
+
+func (rep *MergeReport) String() string {
+	return fmt.Sprintf(
+		"(inputs=%v outputs=%v nrecords=%d insize=%d outsize=%d)",
+		rep.inputs,
+		rep.outputs,
+		rep.nrecords,
+		rep.insize,
+		rep.outsize)
+}
+
+// A live record to be copied by a merge.
+type mergeRecord struct {
+	key		interface{}
+	vloc	*ValueLocation
+}
+
+// Merge the live records of all sealed logfiles, short of any pinned by a
+// snapshot, into new logfiles, switch all catalogs over to them and delete
+// the inputs.  The records of the live
+// log are not touched, but it is sealed if any records were merged.
+func (lbase *Logbase) Merge() (rep *MergeReport, err error) {
+	rep = &MergeReport{}
+	lbase.Lock()
+	defer lbase.Unlock()
+	if err = lbase.CheckLiveLog(); err != nil {return}
+	_, fnums, err := lbase.GetLogfilePaths()
+	if err != nil {return}
+	pinned, haspins := lbase.OldestPinned()
+	inputs := make(map[LBUINT]*Logfile)
+	for _, fnum := range fnums {
+		if fnum >= lbase.livelog.fnum {continue}
+		if haspins && fnum >= pinned {continue}
+		var lfile *Logfile
+		lfile, err = lbase.GetLogfile(fnum)
+		if err != nil {return}
+		inputs[fnum] = lfile
+		rep.inputs = append(rep.inputs, fnum)
+		rep.insize += lfile.size
+	}
+	if len(rep.inputs) == 0 {
+		lbase.debug.Fine("No sealed logfiles to merge")
+		return
+	}
+	lbase.debug.Basic("Merging logfiles %v", rep.inputs)
+
+	// Collect the live records in the inputs, in log order
+	var mrecs []*mergeRecord
+	lbase.mcat.RLock()
+	for key, mcr := range lbase.mcat.index {
+		vloc := mcr.ToValueLocation()
+		if _, ok := inputs[vloc.fnum]; ok {
+			mrecs = append(mrecs, &mergeRecord{key, vloc})
+		}
+	}
+	lbase.mcat.RUnlock()
+	sort.Slice(mrecs, func(i, j int) bool {
+		if mrecs[i].vloc.fnum != mrecs[j].vloc.fnum {
+			return mrecs[i].vloc.fnum < mrecs[j].vloc.fnum
+		}
+		return mrecs[i].vloc.vpos < mrecs[j].vloc.vpos
+	})
+
+	// Copy them into new logfiles after the live log, removing them again
+	// if the merge fails before they are switched to
+	var outs []*Logfile
+	var out *Logfile
+	var switched bool
+	defer func() {
+		if err == nil || switched {return}
+		for _, out := range outs {lbase.RemoveLogfile(out)}
+	}()
+	newvlocs := make([]*ValueLocation, len(mrecs))
+	for i, mrec := range mrecs {
+		var lrec *LogRecord
+		lrec, err = lbase.ReadVerifiedRecord(inputs[mrec.vloc.fnum], mrec.key, mrec.vloc)
+		if err != nil {return}
+		if lrec == nil {continue} // corrupt, but the policy is to carry on
+		lrec, err = lbase.Reseal(lrec)
+		if err != nil {return}
+		rsz := len(lrec.Pack())
+		if out == nil || (out.size > 0 &&
+			out.size + rsz > lbase.config.LOGFILE_MAXBYTES) {
+			if out, err = lbase.NewMergeOutput(out); err != nil {return}
+			outs = append(outs, out)
+			rep.outputs = append(rep.outputs, out.fnum)
+		}
+		var irec *IndexRecord
+		irec, err = out.StoreData(lrec)
+		if err != nil {return}
+		newvlocs[i] = NewValueLocation()
+		newvlocs[i].FromIndexRecord(irec, out.fnum)
+		rep.nrecords++
+	}
+
+	// Get the outputs onto disk, then seal the live log after them
+	for _, out := range outs {
+		err = lbase.debug.Error(out.SyncAndClose())
+		if err != nil {return}
+		rep.outsize += out.size
+	}
+	if out != nil {
+		err = lbase.debug.Error(lbase.livelog.CloseAppenders())
+		if err != nil {return}
+		var lfile *Logfile
+		lfile, err = lbase.GetLogfile(out.fnum + 1)
+		if err != nil {return}
+		lbase.livelog = lfile
+		lbase.mcat.changed = true // move the checkpoint past the outputs
+	}
+	switched = true
+	for _, fnum := range rep.inputs {lbase.zmap.Purge(fnum, lbase.debug)}
+
+	// Switch the catalogs over.  Catalogs share value locations with the
+	// master, so these are updated in place.
+	moved := make(map[*ValueLocation]bool)
+	for i, mrec := range mrecs {
+		if newvlocs[i] == nil {continue}
+		mrec.vloc.fnum = newvlocs[i].fnum
+		mrec.vloc.vpos = newvlocs[i].vpos
+		mrec.vloc.vsz = newvlocs[i].vsz // changed if rekeyed
+		moved[mrec.vloc] = true
+	}
+	for _, obj := range lbase.catcache.Values() {
+		cat := obj.(*Catalog)
+		cat.RLock()
+		for _, cr := range cat.index {
+			if moved[cr.ToValueLocation()] {
+				cat.changed = true
+				break
+			}
+		}
+		cat.RUnlock()
+	}
+
+	// Only now that the catalogs point at the outputs on file, delete the
+	// inputs
+	err = lbase.save()
+	if err != nil {return}
+	for _, fnum := range rep.inputs {
+		err = lbase.RemoveLogfile(inputs[fnum])
+		if err != nil {return}
+	}
+	lbase.debug.Advise("Merged logfiles %s", rep)
+	return
+}
+
+// Return a new, empty logfile for merged records, numbered after the given
+// previous output, or after the live log if there is none.
+func (lbase *Logbase) NewMergeOutput(prev *Logfile) (*Logfile, error) {
+	fnum := lbase.livelog.fnum + 1
+	if prev != nil {fnum = prev.fnum + 1}
+	out, err := lbase.GetLogfile(fnum)
+	if err != nil {return nil, err}
+	if out.size > 0 || out.indexfile.size > 0 {
+		return nil, FmtErrDataMismatch(
+			"Merge output logfile %s already holds data", out.abspath)
+	}
+	return out, nil
+}
+
+// Sync the logfile and its index file to disk, and close their append
+// handles.
+func (lfile *Logfile) SyncAndClose() error {
+	for _, file := range []*File{lfile.File, lfile.indexfile.File} {
+		if err := file.Sync(); err != nil {return err}
+	}
+	return lfile.CloseAppenders()
+}
+
+// Return a Logfile for writing rewritten records to the tmp twins of this
+// logfile and its index file, which are emptied first.
+func (lfile *Logfile) MergeTwin() (*Logfile, error) {
+	twin := NewLogfile()
+	twin.File = lfile.tmp
+	twin.fnum = lfile.fnum
+	twin.indexfile.File = lfile.indexfile.tmp
+	for _, file := range []*File{twin.File, twin.indexfile.File} {
+		if Exists(file.abspath) {
+			if err := file.Remove(); err != nil {return nil, err}
+		}
+		file.size = 0
+		file.version = 0
+	}
+	return twin, nil
+}
+
+// Delete the logfile and its index file.
+func (lbase *Logbase) RemoveLogfile(lfile *Logfile) error {
+	lbase.debug.Basic("Removing logfile %s", lfile.abspath)
+	for _, file := range []*File{lfile.File, lfile.indexfile.File} {
+		err := lbase.debug.Error(file.Remove())
+		if err != nil {return err}
+		lbase.FileCache().Delete(file.abspath)
+	}
+	return nil
+}
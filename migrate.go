@@ -0,0 +1,236 @@
+/*
+	Migration of a logbase to the current on-disk format.
+
+	Old format logfiles are rewritten record by record into their tmp twins,
+	so that every record gains 64 bit sizes and a stamp, and so moves.  The
+	stamp is left empty, since when the record was written is not known.  The catalogs,
+	zapmap and master checkpoint are then remapped to the new positions.
+	Index files are rebuilt alongside their logfiles, and the catalog, zapmap
+	and user permission files are simply saved again, since they are always
+	written in the current format.  Migration runs under the logbase lock,
+	and files already in the current format are left alone.
+*/
+package logbase
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+)
+
+// Return the paths, relative to the logbase, of the existing files that
+// carry a format header.
+func (lbase *Logbase) FormattedFilePaths() (relpaths []string, err error) {
+	var candidates []string
+	_, fnums, err := lbase.GetLogfilePaths()
+	if err != nil {return}
+	for _, fnum := range fnums {
+		candidates = append(candidates,
+			lbase.MakeLogfileRelPath(fnum),
+			lbase.MakeIndexfileRelPath(fnum))
+	}
+	catnames, err := lbase.GetCatalogNames()
+	if err != nil {return}
+	candidates = append(candidates, CATALOG_FILENAME_PREFIX + MASTER_CATALOG_NAME)
+	for _, name := range catnames {
+		candidates = append(candidates, CATALOG_FILENAME_PREFIX + name)
+	}
+	candidates = append(candidates, ZAPMAP_FILENAME)
+	users, _ := ioutil.ReadDir(lbase.UserPermissionDirPath()) // may not exist
+	for _, info := range users {
+		if info.IsDir() || strings.HasPrefix(info.Name(), TMPFILE_PREFIX) {continue}
+		candidates = append(candidates, lbase.UserPermissionRelPath(info.Name()))
+	}
+	for _, relpath := range candidates {
+		if Exists(filepath.Join(lbase.abspath, relpath)) {
+			relpaths = append(relpaths, relpath)
+		}
+	}
+	return
+}
+
+// Rewrite every file of the logbase that is in an old format in the current
+// format.  Returns the relative paths of the files migrated.  Fails if an old
+// logfile is pinned by a snapshot.
+func (lbase *Logbase) Migrate() (migrated []string, err error) {
+	lbase.Lock()
+	defer lbase.Unlock()
+	relpaths, err := lbase.FormattedFilePaths()
+	if err != nil {return}
+	old := make(map[string]bool)
+	for _, relpath := range relpaths {
+		var file *File
+		file, _, err = lbase.GetFile(relpath)
+		if err != nil {return}
+		if !file.IsCurrent() {
+			old[relpath] = true
+			migrated = append(migrated, relpath)
+		}
+	}
+	if len(migrated) == 0 {
+		lbase.debug.Fine("Logbase %q is already in format v%d", lbase.name, FORMAT_CURRENT)
+		return
+	}
+	lbase.debug.Basic("Migrating %v to format v%d", migrated, FORMAT_CURRENT)
+
+	// Logfiles and their index files
+	_, fnums, err := lbase.GetLogfilePaths()
+	if err != nil {return}
+	for _, fnum := range fnums {
+		relpath := lbase.MakeLogfileRelPath(fnum)
+		if old[relpath] && lbase.IsPinned(fnum) {
+			migrated, err = nil, lbase.debug.Error(FmtErrFilePinned(relpath))
+			return
+		}
+	}
+	for _, fnum := range fnums {
+		lfile := lbase.livelog
+		if lfile == nil || fnum != lfile.fnum {
+			lfile, err = lbase.GetLogfile(fnum)
+			if err != nil {return}
+		}
+		if !lfile.IsCurrent() {
+			err = lbase.MigrateLogfile(lfile)
+		} else if !lfile.indexfile.IsCurrent() {
+			var lfindex *Index
+			lfindex, err = lfile.indexfile.Load()
+			if err != nil {return}
+			err = lfile.indexfile.Save(lfindex)
+			lfile.indexfile.Index = lfindex
+		}
+		if lbase.debug.Error(err) != nil {return}
+	}
+
+	// Everything else is rewritten in the current format on saving
+	for _, obj := range lbase.catcache.Values() {
+		cat := obj.(*Catalog)
+		if cat.file != nil && old[cat.file.RelPath(lbase)] {cat.changed = true}
+	}
+	if old[ZAPMAP_FILENAME] {lbase.zmap.changed = true}
+	for relpath := range old {
+		if filepath.Dir(relpath) != lbase.permdir {continue}
+		user := filepath.Base(relpath)
+		up, ok := lbase.users.perm[user]
+		if !ok {
+			var file *File
+			file, _, err = lbase.GetFile(relpath)
+			if err != nil {return}
+			up = NewUserPermissions(nil, lbase.debug)
+			up.file = NewUserPermissionFile(file)
+			err = up.Load()
+			if lbase.debug.Error(err) != nil {return}
+		}
+		err = lbase.debug.Error(up.Save())
+		if err != nil {return}
+		up.changed = false
+	}
+	err = lbase.SaveAll()
+	if err != nil {return}
+	lbase.debug.Advise("Migrated %d files to format v%d", len(migrated), FORMAT_CURRENT)
+	return
+}
+
+// Rewrite an old format logfile and its index file in the current format,
+// and remap the catalogs, zapmap and checkpoint to the new record positions.
+// Records that fail their checksum are handled according to the corruption
+// policy and are not carried over.  The caller must hold the logbase lock.
+func (lbase *Logbase) MigrateLogfile(lfile *Logfile) (err error) {
+	lbase.debug.Basic("Migrating logfile %s from format v%d",
+		lfile.abspath, lfile.Version())
+	irecs, corrupt, _, err := lfile.Scan(lfile.HeaderSize())
+	if err != nil {return}
+	for _, cerr := range corrupt {
+		err = lbase.HandleCorruption(cerr, nil)
+		if err != nil {return}
+	}
+	twin, err := lfile.MergeTwin()
+	if err != nil {return}
+	vposmap := make(map[LBUINT]LBUINT)
+	rlocmap := make(map[LBUINT]*RecordLocation)
+	for _, irec := range irecs {
+		rloc := irec.ToRecordLocation(lfile)
+		var lrec *LogRecord
+		lrec, err = lfile.ReadLogRecord(rloc.rpos)
+		if err != nil {return}
+		var newirec *IndexRecord
+		newirec, err = twin.StoreData(lrec)
+		if err != nil {return}
+		vposmap[irec.vpos] = newirec.vpos
+		rlocmap[rloc.rpos] = newirec.ToRecordLocation(twin)
+	}
+
+	// Swap in the rewritten files
+	err = lfile.ReplaceWithTmpTwin()
+	if lbase.debug.Error(err) != nil {return}
+	err = lfile.indexfile.ReplaceWithTmpTwin()
+	if lbase.debug.Error(err) != nil {return}
+	lfile.indexfile.Index = twin.indexfile.Index
+
+	// Remap the catalogs, which can share value locations
+	moved := make(map[*ValueLocation]bool)
+	var lost []interface{}
+	for _, obj := range lbase.catcache.Values() {
+		cat := obj.(*Catalog)
+		cat.Lock()
+		for key, cr := range cat.index {
+			vloc := cr.ToValueLocation()
+			if vloc.fnum != lfile.fnum {continue}
+			cat.changed = true
+			if moved[vloc] {continue}
+			vpos, ok := vposmap[vloc.vpos]
+			if !ok {
+				lost = append(lost, key)
+				continue
+			}
+			vloc.vpos = vpos
+			moved[vloc] = true
+		}
+		cat.Unlock()
+	}
+	for _, key := range lost {
+		lbase.debug.Error(FmtErrDataMismatch(
+			"Value for key %v in logfile %s was not migrated", key, lfile.abspath))
+		lbase.RemoveFromCatalogs(key)
+	}
+	if cp := lbase.mcat.checkpoint; cp != nil && cp.fnum == lfile.fnum {
+		lbase.mcat.changed = true // a fresh checkpoint is taken on saving
+	}
+
+	// Remap the zapmap
+	lbase.zmap.Lock()
+	for key, zrecs := range lbase.zmap.zapmap {
+		var keep []*ZapRecord
+		for _, zrec := range zrecs {
+			if zrec.fnum == lfile.fnum {
+				rloc, ok := rlocmap[zrec.rpos]
+				if !ok {continue}
+				zrec.rpos = rloc.rpos
+				zrec.rsz = rloc.rsz
+				lbase.zmap.changed = true
+			}
+			keep = append(keep, zrec)
+		}
+		if len(keep) == 0 {
+			delete(lbase.zmap.zapmap, key)
+			lbase.zmap.changed = true
+		} else {
+			lbase.zmap.zapmap[key] = keep
+		}
+	}
+	lbase.zmap.Unlock()
+	return
+}
+
+// Save the logbase, including any changed catalogs that are not saved
+// automatically.
+func (lbase *Logbase) SaveAll() error {
+	for _, obj := range lbase.catcache.Values() {
+		cat := obj.(*Catalog)
+		if !cat.autosave && cat.changed && cat.file != nil {
+			err := lbase.debug.Error(cat.Save())
+			if err != nil {return err}
+			cat.changed = false
+		}
+	}
+	return lbase.save()
+}
@@ -0,0 +1,83 @@
+/*
+	Memory-mapped reads of values in sealed logfiles.
+
+	With MMAP_READS on, values and checked records in sealed logfiles (every
+	logfile but the live log) are read through a read-only memory map of the
+	file, made on the first read and kept with the cached File, so that a read
+	needs no system calls.  Bytes are copied out of the map, so none outlive
+	it.  The map is dropped before its file is replaced, truncated or removed
+	by a zap, merge or migration, which only happens under the logbase write
+	lock and so never during a Get, and when the logbase is closed.  Where
+	memory maps are not supported, logfiles are read with ReadAt as usual.
+*/
+package logbase
+
+// Should the logfile be read through a memory map?  Only sealed logfiles
+// are, and only if the configuration allows it.  The caller must hold the
+// logbase lock, at least for reading, so that the live log stays put.
+func (lbase *Logbase) MapsLogfile(lfile *Logfile) bool {
+	return lbase.config.MMAP_READS && MMAP_SUPPORTED &&
+		lbase.livelog != nil && lfile.fnum != lbase.livelog.fnum
+}
+
+// Read a value from the logfile, through a memory map if it is sealed.
+func (lbase *Logbase) ReadLogfileVal(lfile *Logfile, vpos, vsz LBUINT) ([]byte, error) {
+	if lbase.MapsLogfile(lfile) {return lfile.MappedReadAt(vpos, vsz, "value")}
+	return lfile.ReadVal(vpos, vsz)
+}
+
+// Read a whole log record from the logfile, through a memory map if it is
+// sealed.
+func (lbase *Logbase) ReadLogfileRecord(lfile *Logfile, rloc *RecordLocation) (*LogRecord, error) {
+	if !lbase.MapsLogfile(lfile) {return lfile.ReadLogRecord(rloc.rpos)}
+	byts, err := lfile.MappedReadAt(rloc.rpos, rloc.rsz, "log record")
+	if err != nil {return nil, err}
+	return BytesToLogRecord(byts, lfile.UintSize(), lfile.StampSize(), lfile.debug), nil
+}
+
+// Read bytes from the file through its memory map, mapping it if need be.
+func (file *File) MappedReadAt(pos, size LBUINT, desc string) ([]byte, error) {
+	data, err := file.Map()
+	if err != nil {return nil, err}
+	if pos > LBUINT(len(data)) || size > LBUINT(len(data)) - pos {
+		nr := 0
+		if pos < LBUINT(len(data)) {nr = len(data) - int(pos)}
+		return nil, FmtErrReadSize(desc, file.abspath, size, nr)
+	}
+	byts := make([]byte, size)
+	copy(byts, data[pos:pos + size])
+	return byts, nil
+}
+
+// Return the memory map of the whole file, mapping it if need be.
+func (file *File) Map() ([]byte, error) {
+	file.maplock.Lock()
+	defer file.maplock.Unlock()
+	if file.mapping != nil || file.size == 0 {return file.mapping, nil}
+	gofile, err := OpenFile(file.abspath, READ_ONLY)
+	if err != nil {return nil, err}
+	defer gofile.Close() // the map outlives the handle
+	data, err := mmapFile(gofile, file.size)
+	if err != nil {return nil, err}
+	file.debug.Fine("Mapped %d bytes of %s", len(data), file.abspath)
+	file.mapping = data
+	return data, nil
+}
+
+// Drop the memory map of the file, if any.
+func (file *File) Unmap() error {
+	file.maplock.Lock()
+	defer file.maplock.Unlock()
+	if file.mapping == nil {return nil}
+	err := munmapFile(file.mapping)
+	file.mapping = nil
+	return err
+}
+
+// Drop the memory maps of all files of the logbase.
+func (lbase *Logbase) UnmapAll() (err error) {
+	for _, obj := range lbase.FileCache().Values() {
+		if err2 := obj.(*File).Unmap(); err == nil {err = err2}
+	}
+	return lbase.debug.Error(err)
+}
@@ -0,0 +1,20 @@
+// +build !darwin,!dragonfly,!freebsd,!linux,!netbsd,!openbsd,!solaris
+
+/*
+	Memory maps are not supported here, so reads always use ReadAt.
+*/
+package logbase
+
+import (
+	"os"
+)
+
+const MMAP_SUPPORTED bool = false
+
+func mmapFile(gofile *os.File, size int) ([]byte, error) {
+	return nil, FmtErrBadArgs("Memory maps are not supported, cannot map %s", gofile.Name())
+}
+
+func munmapFile(data []byte) error {
+	return nil
+}
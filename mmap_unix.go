@@ -0,0 +1,21 @@
+// +build darwin dragonfly freebsd linux netbsd openbsd solaris
+
+/*
+	Memory maps where the system supports them.
+*/
+package logbase
+
+import (
+	"os"
+	"syscall"
+)
+
+const MMAP_SUPPORTED bool = true
+
+func mmapFile(gofile *os.File, size int) ([]byte, error) {
+	return syscall.Mmap(int(gofile.Fd()), 0, size, syscall.PROT_READ, syscall.MAP_SHARED)
+}
+
+func munmapFile(data []byte) error {
+	return syscall.Munmap(data)
+}
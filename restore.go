@@ -0,0 +1,203 @@
+/*
+	Restore of a logbase from a backup, with point-in-time recovery.
+
+	RestoreLogbase first checks every file in a backup against the size and
+	SHA-256 in its manifest, then copies them into the target directory.
+	Logfiles written after the backup, those numbered from the live log
+	started by the backup on, can then be replayed on top of it, by naming the
+	directories holding them, usually that of the logbase backed up.  They
+	are copied without their index files, and scanned in order up to the
+	restore point, a sequence number (uint64) or a time (time.Time).  The
+	logfile holding the first record after the point is truncated at the
+	start of that record, or of the batch it belongs to, and any logfiles
+	after it are left out.  The target is then opened with Init, which
+	rebuilds the missing index files and replays the records after the
+	checkpoint saved with the backup, and closed again.
+
+	Recovery to a point is exact only if the later logfiles have not been
+	zapped since the backup, as a zap drops the older versions of keys.  A
+	logfile merged since the backup holds records from before it, and is
+	refused.
+*/
+package logbase
+
+import (
+	"github.com/h00gs/gubed"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// Summary of a restore.
+type RestoreReport struct {
+	nfiles		int // number of files copied from the backup
+	nlogfiles	int // number of later logfiles copied
+	ndropped	int // number of later logfiles left out, being after the point
+	cut			LBUINT // logfile truncated at the restore point, 0 if none
+	cutpos		LBUINT // position it was truncated at
+	seq			uint64 // last sequence number in the restored logbase
+}
+
+// The last sequence number in the restored logbase.
+func (rep *RestoreReport) LastSeq() uint64 {return rep.seq}
+
+func (rep *RestoreReport) String() string {
+	return fmt.Sprintf(
+		"(nfiles=%d nlogfiles=%d ndropped=%d cut=%d cutpos=%d seq=%d)",
+		rep.nfiles,
+		rep.nlogfiles,
+		rep.ndropped,
+		rep.cut,
+		rep.cutpos,
+		rep.seq)
+}
+
+// Restore the backup in backupDir into targetDir, which must be empty or not
+// exist, replaying the logfiles written after the backup found in logdirs up
+// to the given point, a sequence number (uint64) or a time (time.Time), or
+// all of them if it is nil.  Where logdirs hold the same logfile, the first
+// is used.
+func RestoreLogbase(backupDir, targetDir string, until interface{}, debug *gubed.Logger, logdirs ...string) (rep *RestoreReport, err error) {
+	man, err := VerifyBackup(backupDir)
+	if err != nil {return}
+	var after func(irec *IndexRecord) bool
+	switch until := until.(type) {
+	case nil:
+	case uint64:
+		if until < man.Seq {
+			return nil, FmtErrBadArgs(
+				"The backup in %q holds records up to sequence number %d, " +
+				"after the restore point %d", backupDir, man.Seq, until)
+		}
+		after = func(irec *IndexRecord) bool {return irec.seq > until}
+	case time.Time:
+		if until.Before(man.Created) {
+			return nil, FmtErrBadArgs(
+				"The backup in %q was made at %v, after the restore point %v",
+				backupDir, man.Created, until)
+		}
+		after = func(irec *IndexRecord) bool {return irec.ts > until.UnixNano()}
+	default:
+		return nil, FmtErrBadArgs(
+			"Restore point %v must be a sequence number (uint64) or a " +
+			"time.Time, not %T", until, until)
+	}
+	targetDir, err = filepath.Abs(targetDir)
+	if err != nil {return}
+	if entries, _ := ioutil.ReadDir(targetDir); len(entries) > 0 {
+		return nil, FmtErrBadArgs("Restore directory %q is not empty", targetDir)
+	}
+	if err = os.MkdirAll(targetDir, 0777); err != nil {return}
+	debug.Basic("Restoring backup %s into %s", backupDir, targetDir)
+
+	rep = &RestoreReport{}
+	bak := MakeLogbase(backupDir, debug)
+	for _, bf := range man.Files {
+		var got *BackupFile
+		got, err = bak.copyInto(targetDir, filepath.FromSlash(bf.Path), false)
+		if err != nil {return}
+		if *got != *bf {
+			return nil, FmtErrBackupCorrupt(backupDir, bf.Path, "it changed while being restored")
+		}
+		rep.nfiles++
+	}
+
+	if len(logdirs) > 0 {
+		lbase := MakeLogbase(targetDir, debug)
+		lbase.config, err = LoadConfig(filepath.Join(targetDir, CONFIG_FILENAME))
+		if err != nil {return}
+		err = lbase.restoreLogfiles(man, after, logdirs, rep)
+		if err != nil {return}
+	}
+
+	lbase := MakeLogbase(targetDir, debug)
+	if err = lbase.Init(false); err != nil {return}
+	rep.seq = lbase.LastSeq()
+	if err = lbase.Close(); err != nil {return}
+	debug.Advise("Restored backup %s into %s %s", backupDir, targetDir, rep)
+	return
+}
+
+// Check every file in the backup in the given directory against its
+// manifest, returning the manifest.
+func VerifyBackup(dir string) (*BackupManifest, error) {
+	man, err := LoadBackupManifest(dir)
+	if err != nil {return nil, err}
+	for _, bf := range man.Files {
+		got, err := MakeBackupFile(dir, filepath.FromSlash(bf.Path))
+		switch {
+		case err != nil:
+			return nil, FmtErrBackupCorrupt(dir, bf.Path, err.Error())
+		case got.Size != bf.Size:
+			return nil, FmtErrBackupCorrupt(dir, bf.Path, fmt.Sprintf(
+				"it has %d bytes, not %d", got.Size, bf.Size))
+		case got.SHA256 != bf.SHA256:
+			return nil, FmtErrBackupCorrupt(dir, bf.Path, "its checksum differs")
+		}
+	}
+	return man, nil
+}
+
+// Copy the logfiles written since the backup from the given directories
+// into the restored logbase, truncating the first to hold a record after the
+// restore point, if any, and leaving out those after it.
+func (lbase *Logbase) restoreLogfiles(man *BackupManifest, after func(irec *IndexRecord) bool, logdirs []string, rep *RestoreReport) error {
+	srcs := make(map[LBUINT]*Logbase)
+	var fnums []LBUINT
+	for _, dir := range logdirs {
+		src := MakeLogbase(dir, lbase.debug)
+		src.config = lbase.config
+		_, dfnums, err := src.GetLogfilePaths()
+		if err != nil {return err}
+		for _, fnum := range dfnums {
+			if fnum < man.Livelog || srcs[fnum] != nil {continue}
+			srcs[fnum] = src
+			fnums = append(fnums, fnum)
+		}
+	}
+	sort.Slice(fnums, func(i, j int) bool {return fnums[i] < fnums[j]})
+
+	for i, fnum := range fnums {
+		// Replace the empty live log of the backup, leaving the index file
+		// to be rebuilt
+		relpath := lbase.MakeLogfileRelPath(fnum)
+		for _, fpath := range []string{relpath, lbase.MakeIndexfileRelPath(fnum)} {
+			err := os.Remove(filepath.Join(lbase.abspath, fpath))
+			if err != nil && !os.IsNotExist(err) {return err}
+		}
+		if _, err := srcs[fnum].copyInto(lbase.abspath, relpath, false); err != nil {return err}
+		rep.nlogfiles++
+
+		lfile, err := lbase.GetLogfile(fnum)
+		if err != nil {return err}
+		irecs, _, _, err := lfile.Scan(lfile.HeaderSize())
+		if err != nil {return err}
+		cut := -1
+		for j, irec := range irecs {
+			if irec.seq != 0 && irec.seq <= man.Seq {
+				return FmtErrBadArgs(
+					"Logfile %s holds records from before the backup, it has " +
+					"been merged since", filepath.Join(srcs[fnum].abspath, relpath))
+			}
+			if after != nil && after(irec) {
+				cut = j
+				break
+			}
+		}
+		if cut < 0 {continue}
+		// Keep a batch whole by cutting it off at its marker
+		if k := UncommittedBatch(irecs[:cut]); k >= 0 {cut = k}
+		pos := irecs[cut].ToRecordLocation(lfile).rpos
+		lbase.debug.Advise(
+			"Truncating logfile %s from %d to %d bytes at the restore point",
+			lfile.abspath, lfile.size, pos)
+		if err = lfile.Truncate(pos); err != nil {return err}
+		rep.cut, rep.cutpos = fnum, pos
+		rep.ndropped = len(fnums) - i - 1
+		break
+	}
+	return nil
+}
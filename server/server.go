@@ -5,6 +5,7 @@ package main
 
 import (
 	lb "github.com/h00gs/logbase"
+	"github.com/h00gs/gubed"
 	"os"
 	"fmt"
 )
@@ -18,6 +19,7 @@ func main() {
 
 	if len(os.Args) > 1 {
 		if os.Args[1] == "-p" {lb.MakePassHash()}
+		if os.Args[1] == "-m" && len(os.Args) > 2 {os.Exit(Migrate(os.Args[2]))}
 	}
 
 	pass := lb.AskForPass()
@@ -55,3 +57,23 @@ func MakeKillFile() error {
 	_, err = fmt.Fprintf(file, "kill -SIGKILL %d # Terminate parent\n", pid)
     return err
 }
+
+// Migrate the logbase at the given path to the current file format, returning
+// an exit code.
+func Migrate(path string) int {
+	lbase := lb.MakeLogbase(path, gubed.ScreenLogger)
+	err := lbase.Init(false)
+	if err == nil {
+		var migrated []string
+		migrated, err = lbase.Migrate()
+		if err == nil {
+			fmt.Printf("Migrated %d files in %s\n", len(migrated), path)
+			err = lbase.Close()
+		}
+	}
+	if err != nil {
+		fmt.Printf("Problem migrating logbase %s: %s\n", path, err)
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,152 @@
+/*
+	Snapshots, read-only views of a logbase at a point in time.
+
+	A Snapshot shares the index of the Master Catalog as it was when taken, and
+	the catalog copies its index before the next write, so taking a snapshot
+	copies nothing.  Each logfile holding a value in the snapshot is pinned
+	until the snapshot is released.  Zap and the compactor pass over pinned
+	logfiles, leaving their zap records for later, Merge only merges the
+	sealed logfiles older than every pinned one, and Migrate refuses to
+	rewrite a pinned logfile.  Values in the live log are appended to but never
+	moved, so a snapshot reads them in place.
+*/
+package logbase
+
+import (
+	"sync"
+	"time"
+)
+
+// A read-only view of the Master Catalog, with its logfiles pinned.
+type Snapshot struct {
+	lbase		*Logbase
+	index		map[interface{}]CatalogRecord // never written
+	fnums		[]LBUINT // pinned logfiles
+	released	bool
+	sync.Mutex
+}
+
+// Take a snapshot of the logbase.  It must be released when done with.
+func (lbase *Logbase) Snapshot() *Snapshot {
+	lbase.RLock() // no value moves while we pin its logfile
+	defer lbase.RUnlock()
+	snap := &Snapshot{
+		lbase:	lbase,
+		index:	lbase.mcat.Share(),
+	}
+	seen := make(map[LBUINT]bool)
+	for _, cr := range snap.index {
+		fnum := cr.ToValueLocation().fnum
+		if !seen[fnum] {
+			seen[fnum] = true
+			snap.fnums = append(snap.fnums, fnum)
+		}
+	}
+	lbase.Pin(snap.fnums)
+	lbase.debug.Fine("Took snapshot pinning logfiles %v", snap.fnums)
+	return snap
+}
+
+// Getters.
+
+func (snap *Snapshot) Logbase() *Logbase {return snap.lbase}
+
+// Number of keys in the snapshot, or 0 once it is released.
+func (snap *Snapshot) Len() int {
+	snap.Lock()
+	defer snap.Unlock()
+	return len(snap.index)
+}
+
+// Return the keys in the snapshot, bar those of chunks, in no particular
+// order.
+func (snap *Snapshot) Keys() []interface{} {
+	snap.Lock()
+	defer snap.Unlock()
+	keys := make([]interface{}, 0, len(snap.index))
+	for key := range snap.index {
+		if !IsChunkId(key) {keys = append(keys, key)}
+	}
+	return keys
+}
+
+// Return the catalog record of the key as it was when the snapshot was taken,
+// or nil if the key was absent or the snapshot has been released.
+func (snap *Snapshot) Record(key interface{}) CatalogRecord {
+	snap.Lock()
+	defer snap.Unlock()
+	return snap.index[key]
+}
+
+// Retrieve the value for the given key as it was when the snapshot was
+// taken.  Returns nil if the key was absent, or has since expired.
+func (snap *Snapshot) Get(key interface{}) (vbyts []byte, vtype LBTYPE, err error) {
+	snap.lbase.RLock() // the live log can roll over under us
+	defer snap.lbase.RUnlock()
+	snap.Lock()
+	defer snap.Unlock()
+	if snap.released {
+		err = FmtErrSnapshotReleased()
+		return
+	}
+	cr := snap.index[key]
+	if cr == nil || cr.ToValueLocation().Expired(time.Now()) {
+		return nil, LBTYPE_NIL, nil
+	}
+	vbyts, vtype, err = snap.lbase.ReadCatalogRecord(key, cr)
+	if err == nil && vtype == LBTYPE_CHUNKED {
+		lookup := func(id interface{}) CatalogRecord {return snap.index[id]}
+		vbyts, vtype, err = snap.lbase.ReadChunks(key, vbyts, lookup)
+	}
+	return
+}
+
+// Unpin the logfiles of the snapshot, which can no longer be read.  Releasing
+// a snapshot again does nothing.
+func (snap *Snapshot) Release() {
+	snap.Lock()
+	defer snap.Unlock()
+	if snap.released {return}
+	snap.released = true
+	snap.index = nil
+	lbase := snap.lbase
+	lbase.Unpin(snap.fnums)
+	lbase.debug.Fine("Released snapshot pinning logfiles %v", snap.fnums)
+	return
+}
+
+// Pin the logfiles, so that they are neither zapped, merged nor migrated
+// until unpinned.  Pins are counted, so a logfile can be pinned more than
+// once.
+func (lbase *Logbase) Pin(fnums []LBUINT) {
+	lbase.pinlock.Lock()
+	defer lbase.pinlock.Unlock()
+	for _, fnum := range fnums {lbase.pins[fnum]++}
+}
+
+// Release a pin on each of the logfiles.
+func (lbase *Logbase) Unpin(fnums []LBUINT) {
+	lbase.pinlock.Lock()
+	defer lbase.pinlock.Unlock()
+	for _, fnum := range fnums {
+		lbase.pins[fnum]--
+		if lbase.pins[fnum] <= 0 {delete(lbase.pins, fnum)}
+	}
+}
+
+// Is the logfile pinned by a snapshot?
+func (lbase *Logbase) IsPinned(fnum LBUINT) bool {
+	lbase.pinlock.Lock()
+	defer lbase.pinlock.Unlock()
+	return lbase.pins[fnum] > 0
+}
+
+// Return the oldest logfile pinned by a snapshot, if any.
+func (lbase *Logbase) OldestPinned() (oldest LBUINT, ok bool) {
+	lbase.pinlock.Lock()
+	defer lbase.pinlock.Unlock()
+	for fnum := range lbase.pins {
+		if !ok || fnum < oldest {oldest, ok = fnum, true}
+	}
+	return
+}
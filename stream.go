@@ -0,0 +1,320 @@
+/*
+	Streaming of values too large to hold in one log record or in memory.
+
+	PutReader reads a value from an io.Reader in chunks of STREAM_CHUNK_SIZE
+	bytes, or less if need be to fit a logfile, and stores each one in a log
+	record of its own, keyed by a CHUNKID_TYPE, so the chunks of a value chain
+	across as many logfiles as they need.  A chunk id is the sequence number
+	of its record, so is never reused.  Chunks are compressed and encrypted
+	like any other value, and moved by zaps and merges like any other record.
+	Once every chunk is stored, the key is put with a value of type
+	LBTYPE_CHUNKED, listing the length and LBTYPE of the whole value and the
+	ids of its chunks in order.  It is written in the clear, never compressed
+	or encrypted, so that its type can be read from the first byte.
+
+	GetReader streams the value back a chunk at a time, pinning the logfiles
+	of its chunks, as a snapshot does, until it is closed.  Get and
+	Snapshot.Get read a streamed value whole, while History and GetAsOf return
+	its chunk list.  Putting or deleting a key whose value is streamed
+	deletes its chunks in the same batch, and a PutReader that fails deletes
+	the chunks it stored.  A crash part way through a PutReader leaves chunks
+	that no key lists.  Chunk keys are skipped by logbase iterators.
+*/
+package logbase
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"sort"
+)
+
+const (
+	MANIFEST_HEADER_SIZE int = 8 + LBTYPE_SIZE // value length and LBTYPE
+)
+
+// Is the key that of a chunk of a streamed value?
+func IsChunkId(key interface{}) bool {
+	_, ischunk := key.(CHUNKID_TYPE)
+	return ischunk
+}
+
+// The size of chunk to store, no bigger than will fit in an empty logfile.
+func (lbase *Logbase) ChunkSize() int {
+	size := lbase.config.STREAM_CHUNK_SIZE
+	// Allow for the sizes, key, value type, stamp and checksum of the record
+	over := 2 * int(LBUINT_SIZE) + 8 + 2 * LBTYPE_SIZE + int(STAMP_SIZE) + int(CRC_SIZE)
+	room := lbase.config.LOGFILE_MAXBYTES - over - lbase.keyring.Overhead()
+	if size > room {size = room}
+	if size < 1 {size = 1}
+	return size
+}
+
+// Put the value read from the reader, until EOF, as a streamed value.
+func (lbase *Logbase) PutReader(key interface{}, rdr io.Reader, vtype LBTYPE) (CatalogRecord, error) {
+	if err := CheckPutType(key, vtype); err != nil {return nil, err}
+	lbase.debug.Basic("Streaming %v into logbase %s", key, lbase.name)
+	var ids []CHUNKID_TYPE
+	var total uint64
+	size := lbase.ChunkSize()
+	for {
+		buf := make([]byte, size) // a small chunk is kept in the cache
+		n, err := io.ReadFull(rdr, buf)
+		if n > 0 {
+			id, err2 := lbase.putChunk(buf[:n])
+			if err2 != nil {
+				lbase.dropChunks(ids)
+				return nil, err2
+			}
+			ids = append(ids, id)
+			total += uint64(n)
+		}
+		if err == io.EOF || err == io.ErrUnexpectedEOF {break}
+		if err != nil {
+			lbase.dropChunks(ids)
+			return nil, lbase.debug.Error(err)
+		}
+	}
+
+	manifest := MakeManifest(total, vtype, ids)
+	lbase.Lock()
+	mcr, err := lbase.putManifest(key, manifest)
+	seq := lbase.syncer.Last()
+	lbase.Unlock()
+	if err != nil {
+		lbase.dropChunks(ids)
+		return nil, err
+	}
+	lbase.debug.Basic("Streamed %d bytes in %d chunks into key %v", total, len(ids), key)
+	return mcr, lbase.WaitDurable(seq)
+}
+
+// Store a chunk of a streamed value, returning its id.
+func (lbase *Logbase) putChunk(chunk []byte) (CHUNKID_TYPE, error) {
+	lbase.Lock()
+	id, err := lbase.storeChunk(chunk)
+	seq := lbase.syncer.Last()
+	lbase.Unlock()
+	if err != nil {return 0, err}
+	return id, lbase.WaitDurable(seq)
+}
+
+// Store a chunk, for a caller holding the logbase lock.
+func (lbase *Logbase) storeChunk(chunk []byte) (CHUNKID_TYPE, error) {
+	if err := lbase.CheckLiveLog(); err != nil {return 0, err}
+	id := CHUNKID_TYPE(lbase.seq + 1) // the sequence number of its record
+	if lbase.mcat.Get(id) != nil {
+		return 0, FmtErrDataMismatch(
+			"Chunk id %d is already in use in logbase %q", id, lbase.name)
+	}
+	lrec, err := lbase.MakeValueRecord(id, chunk, LBTYPE_BYTES, 0)
+	if err != nil {return 0, err}
+	irec, err := lbase.StoreRecord(lrec)
+	if err != nil {return 0, err}
+	lbase.ApplyPut(id, irec, chunk, LBTYPE_BYTES)
+	return id, nil
+}
+
+// Put the chunk list of a streamed value, for a caller holding the logbase
+// lock.
+func (lbase *Logbase) putManifest(key interface{}, manifest []byte) (CatalogRecord, error) {
+	if err := lbase.CheckLiveLog(); err != nil {return nil, err}
+	lrec := MakeLogRecord(key, manifest, LBTYPE_CHUNKED, lbase.debug)
+	irec, err := lbase.StoreReplacing(key, lrec)
+	if err != nil {return nil, err}
+	return lbase.ApplyPut(key, irec, manifest, LBTYPE_CHUNKED), nil
+}
+
+// Delete the chunks of a failed PutReader, logging any error.
+func (lbase *Logbase) dropChunks(ids []CHUNKID_TYPE) {
+	if len(ids) == 0 {return}
+	lbase.Lock()
+	defer lbase.Unlock()
+	if lbase.debug.Error(lbase.CheckLiveLog()) != nil {return}
+	irecs, err := lbase.StoreBatch(ChunkTombstones(ids, lbase))
+	if lbase.debug.Error(err) != nil {return}
+	for _, irec := range irecs {lbase.ApplyTombstone(irec, lbase.livelog.fnum)}
+}
+
+// Return tombstone records for the chunks.
+func ChunkTombstones(ids []CHUNKID_TYPE, lbase *Logbase) []*LogRecord {
+	lrecs := make([]*LogRecord, len(ids))
+	for i, id := range ids {
+		lrecs[i] = MakeLogRecord(id, nil, LBTYPE_NIL, lbase.debug)
+	}
+	return lrecs
+}
+
+// Append the log record for a put or delete of the key to the live log,
+// along with tombstones for the chunks of its current value, if streamed,
+// in a batch so that they take effect together.  The tombstones are
+// applied, and the index record of the write returned for the caller to
+// apply.  The caller must hold the logbase lock.
+func (lbase *Logbase) StoreReplacing(key interface{}, lrec *LogRecord) (*IndexRecord, error) {
+	ids, err := lbase.ChunksOf(key)
+	if err != nil {return nil, err}
+	if len(ids) == 0 {return lbase.StoreRecord(lrec)}
+	lrecs := append([]*LogRecord{lrec}, ChunkTombstones(ids, lbase)...)
+	irecs, err := lbase.StoreBatch(lrecs)
+	if err != nil {return nil, err}
+	for _, irec := range irecs[1:] {lbase.ApplyTombstone(irec, lbase.livelog.fnum)}
+	return irecs[0], nil
+}
+
+// Return the ids of the chunks of the current value of the key, if it is a
+// streamed value still in the logbase.  Only the type of a value not in the
+// cache is read, unless it is streamed.  The caller must hold the logbase
+// lock, at least for reading.
+func (lbase *Logbase) ChunksOf(key interface{}) ([]CHUNKID_TYPE, error) {
+	if IsChunkId(key) {return nil, nil}
+	mcr := lbase.mcat.Get(key)
+	if mcr == nil {return nil, nil}
+	if v, ok := mcr.(*Value); ok && v.vtype != LBTYPE_CHUNKED {return nil, nil}
+	vloc := mcr.ToValueLocation()
+	if int(vloc.vsz) < LBTYPE_SIZE + MANIFEST_HEADER_SIZE {return nil, nil}
+	lfile, err := vloc.Logfile(lbase)
+	if err != nil {return nil, err}
+	tbyts, err := lbase.ReadLogfileVal(lfile, vloc.vpos, LBUINT(LBTYPE_SIZE))
+	if err != nil {return nil, err}
+	if LBTYPE(tbyts[0]) != LBTYPE_CHUNKED {return nil, nil}
+	manifest, vtype, err := lbase.ReadCatalogRecord(key, mcr)
+	if err != nil || vtype != LBTYPE_CHUNKED {return nil, err}
+	_, _, ids, err := ReadManifest(manifest)
+	return ids, err
+}
+
+// Manifests.
+
+// Return the chunk list of a streamed value.
+func MakeManifest(total uint64, vtype LBTYPE, ids []CHUNKID_TYPE) []byte {
+	bfr := new(bytes.Buffer)
+	binary.Write(bfr, BIGEND, total)
+	binary.Write(bfr, BIGEND, vtype)
+	for _, id := range ids {binary.Write(bfr, BIGEND, id)}
+	return bfr.Bytes()
+}
+
+// Read the length and LBTYPE of a streamed value and the ids of its chunks
+// from its chunk list.
+func ReadManifest(manifest []byte) (total uint64, vtype LBTYPE, ids []CHUNKID_TYPE, err error) {
+	if len(manifest) < MANIFEST_HEADER_SIZE ||
+		(len(manifest) - MANIFEST_HEADER_SIZE) % 8 != 0 {
+		err = FmtErrDataMismatch(
+			"A chunk list of %d bytes is not a header of %d bytes followed " +
+			"by 8 byte chunk ids", len(manifest), MANIFEST_HEADER_SIZE)
+		return
+	}
+	total = BIGEND.Uint64(manifest)
+	vtype = LBTYPE(manifest[8])
+	for pos := MANIFEST_HEADER_SIZE; pos < len(manifest); pos += 8 {
+		ids = append(ids, CHUNKID_TYPE(BIGEND.Uint64(manifest[pos:])))
+	}
+	return
+}
+
+// Read a streamed value whole, given its chunk list, finding the record of
+// each chunk with the lookup.  The caller must hold the logbase lock, at
+// least for reading.
+func (lbase *Logbase) ReadChunks(key interface{}, manifest []byte, lookup func(interface{}) CatalogRecord) ([]byte, LBTYPE, error) {
+	total, vtype, ids, err := ReadManifest(manifest)
+	if err != nil {return nil, LBTYPE_NIL, err}
+	val := make([]byte, 0, total)
+	for i, id := range ids {
+		cr := lookup(id)
+		if cr == nil {return nil, LBTYPE_NIL, FmtErrChunkMissing(key, i, id)}
+		chunk, err := lbase.readChunk(key, i, id, cr)
+		if err != nil {return nil, LBTYPE_NIL, err}
+		val = append(val, chunk...)
+	}
+	if uint64(len(val)) != total {
+		return nil, LBTYPE_NIL, FmtErrDataMismatch(
+			"Streamed value of key %v has %d bytes, but its chunk list gives %d",
+			key, len(val), total)
+	}
+	return val, vtype, nil
+}
+
+// Read a chunk of the streamed value of the key, which must not be corrupt.
+// The caller must hold the logbase lock, at least for reading.
+func (lbase *Logbase) readChunk(key interface{}, i int, id CHUNKID_TYPE, cr CatalogRecord) ([]byte, error) {
+	chunk, _, err := lbase.ReadCatalogRecord(id, cr)
+	if err != nil {return nil, err}
+	if chunk == nil {
+		// Corrupt, and a stream cannot skip it whatever the policy
+		return nil, FmtErrChunkMissing(key, i, id)
+	}
+	return chunk, nil
+}
+
+// Streaming reads.
+
+// Streams a value back from the logbase.
+type ValueReader struct {
+	lbase		*Logbase
+	key			interface{}
+	ids			[]CHUNKID_TYPE
+	vlocs		[]*ValueLocation // of the chunks, as when opened
+	fnums		[]LBUINT // pinned logfiles
+	next		int // next chunk to read
+	rdr			*bytes.Reader // the chunk being read
+	closed		bool
+}
+
+// Return a reader streaming the value of the key, and its type.  A value
+// that is not streamed is read whole first.  The reader must be closed
+// when done with.  Returns nil if the key is absent or has expired.
+func (lbase *Logbase) GetReader(key interface{}) (io.ReadCloser, LBTYPE, error) {
+	lbase.RLock() // don't let the chunks move until they are pinned
+	defer lbase.RUnlock()
+	vbyts, vtype, mcr, err := lbase.get(key)
+	if err != nil || mcr == nil {return nil, LBTYPE_NIL, err}
+	if vtype != LBTYPE_CHUNKED {
+		return ioutil.NopCloser(bytes.NewReader(vbyts)), vtype, nil
+	}
+	_, vtype, ids, err := ReadManifest(vbyts)
+	if err != nil {return nil, LBTYPE_NIL, err}
+	vr := &ValueReader{lbase: lbase, key: key, ids: ids, rdr: bytes.NewReader(nil)}
+	seen := make(map[LBUINT]bool)
+	for i, id := range ids {
+		cr := lbase.mcat.Get(id)
+		if cr == nil {return nil, LBTYPE_NIL, FmtErrChunkMissing(key, i, id)}
+		vloc := cr.ToValueLocation()
+		vr.vlocs = append(vr.vlocs, &ValueLocation{
+			fnum:		vloc.fnum,
+			Vsize:		&Vsize{vloc.vsz},
+			Vpos:		&Vpos{vloc.vpos},
+			version:	vloc.version,
+		})
+		if !seen[vloc.fnum] {
+			seen[vloc.fnum] = true
+			vr.fnums = append(vr.fnums, vloc.fnum)
+		}
+	}
+	sort.Slice(vr.fnums, func(i, j int) bool {return vr.fnums[i] < vr.fnums[j]})
+	lbase.Pin(vr.fnums)
+	return vr, vtype, nil
+}
+
+// Read the next bytes of the value.
+func (vr *ValueReader) Read(p []byte) (int, error) {
+	if vr.closed {return 0, FmtErrReaderClosed()}
+	for vr.rdr.Len() == 0 {
+		if vr.next >= len(vr.ids) {return 0, io.EOF}
+		vr.lbase.RLock() // the live log can roll over under us
+		chunk, err := vr.lbase.readChunk(vr.key, vr.next, vr.ids[vr.next], vr.vlocs[vr.next])
+		vr.lbase.RUnlock()
+		if err != nil {return 0, err}
+		vr.rdr = bytes.NewReader(chunk)
+		vr.next++
+	}
+	return vr.rdr.Read(p)
+}
+
+// Unpin the logfiles of the value.  Closing a reader again does nothing.
+func (vr *ValueReader) Close() error {
+	if vr.closed {return nil}
+	vr.closed = true
+	vr.lbase.Unpin(vr.fnums)
+	return nil
+}
@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"bytes"
 	"encoding/binary"
+	"strings"
 )
 
 // Keys
@@ -78,6 +79,10 @@ func MakeTypeFromBytes(byts []byte, typ LBTYPE) (interface{}, error) {
 		var v CATID_TYPE
 		err := binary.Read(bfr, BIGEND, &v)
 		return v, err
+	case LBTYPE_CHUNKID:
+		var v CHUNKID_TYPE
+		err := binary.Read(bfr, BIGEND, &v)
+		return v, err
 	case LBTYPE_STRING,
 		 LBTYPE_LOCATION,
 		 LBTYPE_CATKEY:
@@ -97,7 +102,16 @@ func MakeTypeFromBytes(byts []byte, typ LBTYPE) (interface{}, error) {
 }
 
 func GetKeyType(key interface{}, debug *gubed.Logger) LBTYPE {
-	switch ktype := key.(type) {
+	ktype := KeyTypeOf(key)
+	if ktype == LBTYPE_NIL {
+		debug.Error(FmtErrBadType("Unrecognised key type: %d", key))
+	}
+	return ktype
+}
+
+// Return the LBTYPE of the key, or LBTYPE_NIL if it is not of a key type.
+func KeyTypeOf(key interface{}) LBTYPE {
+	switch key.(type) {
 	case uint8:
 		return LBTYPE_UINT8
 	case uint16:
@@ -124,14 +138,78 @@ func GetKeyType(key interface{}, debug *gubed.Logger) LBTYPE {
 		return LBTYPE_COMPLEX128
 	case CATID_TYPE:
 		return LBTYPE_CATID
+	case CHUNKID_TYPE:
+		return LBTYPE_CHUNKID
 	case string:
 		return LBTYPE_STRING
-	default:
-		debug.Error(FmtErrBadType("Unrecognised key type: %d", ktype))
 	}
     return LBTYPE_NIL
 }
 
+// Order two keys, first by LBTYPE and then by value, returning -1, 0 or 1 as
+// a is less than, equal to or greater than b.  Complex numbers are ordered
+// by real then imaginary part, and NaN before any other float.
+func CompareKeys(a, b interface{}) int {
+	ta, tb := KeyTypeOf(a), KeyTypeOf(b)
+	if ta != tb {return compareUints(uint64(ta), uint64(tb))}
+	switch x := a.(type) {
+	case uint8:
+		return compareUints(uint64(x), uint64(b.(uint8)))
+	case uint16:
+		return compareUints(uint64(x), uint64(b.(uint16)))
+	case uint32:
+		return compareUints(uint64(x), uint64(b.(uint32)))
+	case uint64:
+		return compareUints(x, b.(uint64))
+	case CATID_TYPE:
+		return compareUints(uint64(x), uint64(b.(CATID_TYPE)))
+	case CHUNKID_TYPE:
+		return compareUints(uint64(x), uint64(b.(CHUNKID_TYPE)))
+	case int8:
+		return compareInts(int64(x), int64(b.(int8)))
+	case int16:
+		return compareInts(int64(x), int64(b.(int16)))
+	case int32:
+		return compareInts(int64(x), int64(b.(int32)))
+	case int64:
+		return compareInts(x, b.(int64))
+	case float32:
+		return compareFloats(float64(x), float64(b.(float32)))
+	case float64:
+		return compareFloats(x, b.(float64))
+	case complex64:
+		return compareComplexes(complex128(x), complex128(b.(complex64)))
+	case complex128:
+		return compareComplexes(x, b.(complex128))
+	case string:
+		return strings.Compare(x, b.(string))
+	}
+	return 0
+}
+
+func compareUints(a, b uint64) int {
+	if a < b {return -1}
+	if a > b {return 1}
+	return 0
+}
+
+func compareInts(a, b int64) int {
+	if a < b {return -1}
+	if a > b {return 1}
+	return 0
+}
+
+func compareFloats(a, b float64) int {
+	if a < b || (a != a && b == b) {return -1} // a is NaN
+	if a > b || (a == a && b != b) {return 1} // b is NaN
+	return 0
+}
+
+func compareComplexes(a, b complex128) int {
+	if c := compareFloats(real(a), real(b)); c != 0 {return c}
+	return compareFloats(imag(a), imag(b))
+}
+
 func IsStringType(typ LBTYPE) bool {
 	switch typ {
 	case LBTYPE_STRING,
@@ -156,7 +234,8 @@ func IsNumberType(typ LBTYPE) bool {
 		 LBTYPE_FLOAT64,
 		 LBTYPE_COMPLEX64,
 		 LBTYPE_COMPLEX128,
-		 LBTYPE_CATID:
+		 LBTYPE_CATID,
+		 LBTYPE_CHUNKID:
 		return true
 	}
 	return false
@@ -210,6 +289,9 @@ func ToBytes(val interface{}, vt LBTYPE, debug *gubed.Logger) (byts []byte, err
     case CATID_TYPE:
 		if vt != LBTYPE_CATID {return nil, debug.Error(FmtErrBadType(es, v, vt))}
 		binary.Write(bfr, BIGEND, v)
+    case CHUNKID_TYPE:
+		if vt != LBTYPE_CHUNKID {return nil, debug.Error(FmtErrBadType(es, v, vt))}
+		binary.Write(bfr, BIGEND, v)
     case []byte:
 		if vt != LBTYPE_BYTES {
 			return nil, debug.Error(FmtErrBadType(es, v, vt))